@@ -1,17 +1,23 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"strings"
-	"net/http"
-	"fmt"
-	"io"
-	"crypto/sha256"
+	"strconv"
+	"net/url"
+	"time"
 
+	"github.com/derjabineli/httpfromtcp/internal/compress"
+	"github.com/derjabineli/httpfromtcp/internal/content"
+	"github.com/derjabineli/httpfromtcp/internal/negotiate"
+	"github.com/derjabineli/httpfromtcp/internal/proxy"
 	"github.com/derjabineli/httpfromtcp/internal/server"
+	"github.com/derjabineli/httpfromtcp/internal/sse"
 	"github.com/derjabineli/httpfromtcp/internal/request"
 	"github.com/derjabineli/httpfromtcp/internal/response"
 
@@ -19,13 +25,60 @@ import (
 
 const port = 42010
 
+var httpBinProxy = &proxy.ReverseProxy{
+	Upstream: &url.URL{Scheme: "https", Host: "httpbin.org"},
+	Rewrite:  proxy.StripPrefix("/httpbin"),
+	Timeout:  30 * time.Second,
+	Cache:    proxy.NewCache(proxy.NewMemoryStore(64 << 20)),
+}
+
+// forwardProxy handles absolute-form requests for other hosts and CONNECT
+// requests. It is only on when PROXY_ALLOW, a comma separated allow-list of
+// destinations, is set. PROXY_USER and PROXY_PASSWORD turn on Basic proxy
+// authentication.
+var forwardProxy = newForwardProxy()
+
+// assets serves the files below ./assets at /assets/.
+var assets = &content.FileServer{Root: content.Dir("./assets"), Prefix: "/assets"}
+
+// pages answers conditional requests for the pages with ETags computed from
+// their bodies.
+var pages = content.NewConditional(handler200)
+
+// events streams the server time at /events, one event a second.
+var events = sse.NewHub()
+
+func newForwardProxy() *proxy.ForwardProxy {
+	allow := allowList(os.Getenv("PROXY_ALLOW"))
+	if len(allow) == 0 {
+		return nil
+	}
+	return &proxy.ForwardProxy{
+		Allow:    allow,
+		Username: os.Getenv("PROXY_USER"),
+		Password: os.Getenv("PROXY_PASSWORD"),
+		Timeout:  30 * time.Second,
+	}
+}
+
+func allowList(value string) []string {
+	var allow []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			allow = append(allow, entry)
+		}
+	}
+	return allow
+}
+
 func main() {
-	server, err := server.Serve(port, handler)
+	server, err := server.Serve(port, compress.New(compress.NewDecompress(handler).Serve).Serve)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 	defer server.Close()
 	log.Println("Server started on port", port)
+	go publishTime()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -33,28 +86,91 @@ func main() {
 	log.Println("Server gracefully stopped")
 }
 
+func publishTime() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		events.Publish(sse.Event{Event: "time", Data: now.UTC().Format(time.RFC3339)})
+	}
+}
+
 func handler(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+	absoluteForm := !strings.HasPrefix(target, "/") && target != "*"
+	if req.RequestLine.Method == "CONNECT" || (absoluteForm && !servedHere(req)) {
+		if forwardProxy == nil {
+			response.WriteError(w, response.StatusForbidden, "This server isn't a proxy")
+			return
+		}
+		log.Printf("Proxying %s %s for %s", req.RequestLine.Method, target, req.RemoteAddr)
+		forwardProxy.Serve(w, req)
+		return
+	}
+	// An absolute-form request for this server is routed by its path
+	if absoluteForm {
+		if u, err := url.Parse(target); err == nil {
+			target = u.RequestURI()
+			req.RequestLine.RequestTarget = target
+		}
+	}
 	if req.RequestLine.RequestTarget == "/yourproblem" {
-		handler400(w)
+		handler400(w, req)
 		return
 	}
 	if req.RequestLine.RequestTarget == "/myproblem" {
-		handler500(w)
+		handler500(w, req)
 		return
 	}
 	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		httpBinProxy(w, req)
+		httpBinProxy.Serve(w, req)
+		return
+	}
+	if target == "/assets" || strings.HasPrefix(target, "/assets/") || strings.HasPrefix(target, "/assets?") {
+		assets.Serve(w, req)
+		return
+	}
+	if req.RequestLine.RequestTarget == "/events" {
+		events.Serve(w, req)
 		return
 	}
 	if req.RequestLine.RequestTarget == "/video" {
 		handlerVideo(w, req)
 		return
 	}
-	handler200(w)
+	pages.Serve(w, req)
 	return
 }
 
-func handler400(w *response.Writer) {
+// servedHere reports whether the authority of req, which ValidateHost took
+// from an absolute-form target, names this server.
+func servedHere(req *request.Request) bool {
+	if req.Port() != strconv.Itoa(port) {
+		return false
+	}
+	host := req.Hostname()
+	if hostname, err := os.Hostname(); host == "localhost" || (err == nil && strings.EqualFold(host, hostname)) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func handler400(w *response.Writer, req *request.Request) {
 	body := []byte(`
 		<html>
   <head>
@@ -66,15 +182,10 @@ func handler400(w *response.Writer) {
   </body>
 </html>
 	`)
-	w.WriteStatusLine(response.StatusBadRequest)
-	headers:= response.GetDefaultHeaders(len(body))
-	headers.Overwrite("content-type", "text/html")
-	w.WriteHeaders(headers)
-	w.WriteBody(body)
-	return
+	writePage(w, req, response.StatusBadRequest, body, "Your request honestly kinda sucked.")
 }
 
-func handler500(w *response.Writer) {
+func handler500(w *response.Writer, req *request.Request) {
 	body := []byte(`
 <html>
   <head>
@@ -86,15 +197,10 @@ func handler500(w *response.Writer) {
   </body>
 </html>
 	`)
-	w.WriteStatusLine(response.StatusInternalServerError)
-	headers:= response.GetDefaultHeaders(len(body))
-	headers.Overwrite("content-type", "text/html")
-	w.WriteHeaders(headers)
-	w.WriteBody(body)
-	return
+	writePage(w, req, response.StatusInternalServerError, body, "Okay, you know what? This one is on me.")
 }
 
-func handler200(w *response.Writer) {
+func handler200(w *response.Writer, req *request.Request) {
 	body := []byte(`
 <html>
   <head>
@@ -106,72 +212,51 @@ func handler200(w *response.Writer) {
   </body>
 </html>
 	`)
-	w.WriteStatusLine(response.StatusOK)
-	headers:= response.GetDefaultHeaders(len(body))
-	headers.Overwrite("content-type", "text/html")
-	w.WriteHeaders(headers)
-	w.WriteBody(body)
-	return
+	writePage(w, req, response.StatusOK, body, "Your request was an absolute banger.")
 }
 
-func httpBinProxy(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	url := fmt.Sprintf("https://httpbin.org/%s", target)
-	resp, err := http.Get(url)
-	if err != nil {
-		handler500(w)
-		return
-	}
-	defer resp.Body.Close()
-
-	w.WriteStatusLine(response.StatusOK)
-	headers := response.GetDefaultHeaders(0)
-	headers.Delete("content-length")
-	headers.Overwrite("Transfer-Encoding", "chunked")
-	headers.Overwrite("Trailers", "X-Content-SHA256, X-Content-Length")
-	w.WriteHeaders(headers)
-
-	fullBody := []byte{}
-	var maxBufferSize = 1024
-	buf := make([]byte, maxBufferSize)
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			_, err = w.WriteChunkedBody(buf[:n])
-			if err != nil {
-				fmt.Println("Error writing chunked body: ", err)
-				break
-			}
-			fullBody = append(fullBody, buf[:n]...)
+// writePage answers with the HTML page for browsers or the message as JSON
+// for scripts. Error pages fall back to HTML rather than a 406 when the
+// client accepts neither.
+func writePage(w *response.Writer, req *request.Request, statusCode response.StatusCode, html []byte, message string) {
+	offers := []string{"text/html", "application/json"}
+	var contentType string
+	if statusCode == response.StatusOK {
+		var ok bool
+		if contentType, ok = negotiate.Negotiate(w, req, "Accept", offers...); !ok {
+			return
 		}
-		if err == io.EOF {
-			break	
-		}
-		if err != nil {
-			fmt.Println("Error reading from response body: ", err)
-			break
+	} else {
+		if contentType = negotiate.MediaType(req.Headers, offers...); contentType == "" {
+			contentType = "text/html"
 		}
+		w.Header().Set("Vary", "Accept")
 	}
-	w.WriteChunkedBodyDone()
 
-	sha256 := fmt.Sprintf("%x", sha256.Sum256(fullBody))
-	trailers := response.GetDefaultHeaders(0)
-	trailers.Delete("content-length")
-	trailers.Overwrite("X-Content-SHA256", sha256)
-	trailers.Overwrite("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-	w.WriteTrailers(trailers)
+	body := html
+	if contentType == "application/json" {
+		body, _ = json.Marshal(map[string]any{"status": int(statusCode), "message": message})
+	}
+	rw := response.NewResponseWriter(w)
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(statusCode)
+	rw.Write(body)
 }
 
 func handlerVideo(w *response.Writer, req *request.Request) {
-	body, err := os.ReadFile("./assets/vim.mp4")
+	file, err := os.Open("./assets/vim.mp4")
+	if err != nil {
+		handler500(w, req)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
 	if err != nil {
-		handler500(w)
+		handler500(w, req)
 		return
 	}
 
-	w.WriteStatusLine(response.StatusOK)
-	headers := response.GetDefaultHeaders(len(body))
-	headers.Overwrite("Content-Type", "video/mp4")
-	w.WriteHeaders(headers)
-	w.WriteBody(body)
+	w.Header().Set("Content-Type", "video/mp4")
+	content.Serve(w, req, info.Name(), info.ModTime(), file)
 }
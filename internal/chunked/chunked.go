@@ -0,0 +1,133 @@
+// Package chunked decodes the chunked transfer coding of RFC 9112 section 7.1
+// incrementally, for the request and response parsers.
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+)
+
+type decoderState int
+
+const (
+	decoderStateChunkSize decoderState = iota
+	decoderStateChunkData
+	decoderStateChunkEnd
+	decoderStateTrailers
+	decoderStateDone
+)
+
+type Decoder struct {
+	state     decoderState
+	remaining int64
+	trailers  headers.Headers
+}
+
+// NewDecoder returns a Decoder that stores the trailer fields in trailers.
+func NewDecoder(trailers headers.Headers) *Decoder {
+	return &Decoder{
+		state:    decoderStateChunkSize,
+		trailers: trailers,
+	}
+}
+
+func (d *Decoder) Done() bool {
+	return d.state == decoderStateDone
+}
+
+// Decode consumes as much of data as it can, appending the decoded bytes to
+// body. It returns the number of bytes of data consumed and the extended
+// body; anything left over is needed with more data to make progress.
+func (d *Decoder) Decode(data []byte, body []byte) (int, []byte, error) {
+	totalBytesParsed := 0
+	for d.state != decoderStateDone {
+		n, newBody, err := d.decodeSingle(data[totalBytesParsed:], body)
+		if err != nil {
+			return 0, body, err
+		}
+		body = newBody
+		totalBytesParsed += n
+		if n == 0 {
+			break
+		}
+	}
+	return totalBytesParsed, body, nil
+}
+
+func (d *Decoder) decodeSingle(data []byte, body []byte) (int, []byte, error) {
+	switch d.state {
+	case decoderStateChunkSize:
+		idx := bytes.Index(data, []byte("\r\n"))
+		if idx == -1 {
+			return 0, body, nil
+		}
+		size, err := parseChunkSize(data[:idx])
+		if err != nil {
+			return 0, body, err
+		}
+		d.remaining = size
+		d.state = decoderStateChunkData
+		if size == 0 {
+			d.state = decoderStateTrailers
+		}
+		return idx + 2, body, nil
+	case decoderStateChunkData:
+		n := min(int64(len(data)), d.remaining)
+		body = append(body, data[:n]...)
+		d.remaining -= n
+		if d.remaining == 0 {
+			d.state = decoderStateChunkEnd
+		}
+		return int(n), body, nil
+	case decoderStateChunkEnd:
+		if len(data) < 2 {
+			return 0, body, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, body, errors.New("malformed chunk")
+		}
+		d.state = decoderStateChunkSize
+		return 2, body, nil
+	case decoderStateTrailers:
+		n, done, err := d.trailers.Parse(data)
+		if err != nil {
+			return 0, body, err
+		}
+		if done {
+			d.state = decoderStateDone
+		}
+		return n, body, nil
+	default:
+		return 0, body, errors.New("error: trying to decode data in a done state")
+	}
+}
+
+// parseChunkSize parses the hex digits of a chunk size line. Chunk
+// extensions are allowed after a semicolon, optionally preceded by
+// whitespace, and ignored.
+func parseChunkSize(line []byte) (int64, error) {
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		line = bytes.TrimRight(line[:i], " \t")
+	}
+	// ParseInt would also take a sign, which isn't a hex digit
+	if len(line) == 0 || strings.Trim(string(line), "0123456789abcdefABCDEF") != "" {
+		return 0, errors.New("malformed chunk size")
+	}
+	size, err := strconv.ParseInt(string(line), 16, 64)
+	if err != nil {
+		return 0, errors.New("chunk size too large")
+	}
+	return size, nil
+}
+
+// IsChunked reports whether chunked is the final coding in a
+// Transfer-Encoding value.
+func IsChunked(transferEncoding string) bool {
+	codings := strings.Split(transferEncoding, ",")
+	last := strings.TrimSpace(codings[len(codings)-1])
+	return strings.EqualFold(last, "chunked")
+}
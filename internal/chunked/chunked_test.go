@@ -0,0 +1,96 @@
+package chunked
+
+import (
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeAll feeds data to a new decoder numBytesPerRead bytes at a time,
+// keeping what wasn't consumed for the next call like the parsers do.
+func decodeAll(data string, numBytesPerRead int) (*Decoder, []byte, headers.Headers, error) {
+	trailers := headers.NewHeaders()
+	d := NewDecoder(trailers)
+	var body, pending []byte
+	for i := 0; i < len(data) && !d.Done(); i += numBytesPerRead {
+		pending = append(pending, data[i:min(i+numBytesPerRead, len(data))]...)
+		n, b, err := d.Decode(pending, body)
+		if err != nil {
+			return d, body, trailers, err
+		}
+		body = b
+		pending = pending[n:]
+	}
+	return d, body, trailers, nil
+}
+
+func TestDecoder(t *testing.T) {
+	// Test: Chunks read a few bytes at a time
+	d, body, _, err := decodeAll("5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", 3)
+	require.NoError(t, err)
+	assert.True(t, d.Done())
+	assert.Equal(t, "hello world", string(body))
+
+	// Test: Chunk extensions are ignored
+	d, body, _, err = decodeAll("5;name=value\r\nhello\r\n1 ; last\r\n!\r\n0;x\r\n\r\n", 4)
+	require.NoError(t, err)
+	assert.True(t, d.Done())
+	assert.Equal(t, "hello!", string(body))
+
+	// Test: Trailers
+	d, body, trailers, err := decodeAll("2\r\nhi\r\n0\r\nX-Checksum: abc\r\nX-Count: 1\r\n\r\n", 5)
+	require.NoError(t, err)
+	assert.True(t, d.Done())
+	assert.Equal(t, "hi", string(body))
+	assert.Equal(t, "abc", trailers["x-checksum"])
+	assert.Equal(t, "1", trailers["x-count"])
+
+	// Test: Upper and lower case hex
+	d, body, _, err = decodeAll("A\r\n0123456789\r\nb\r\nabcdefghijk\r\n0\r\n\r\n", 64)
+	require.NoError(t, err)
+	assert.True(t, d.Done())
+	assert.Equal(t, 21, len(body))
+
+	// Test: Nothing past the end of the body is consumed
+	d = NewDecoder(headers.NewHeaders())
+	n, body, err := d.Decode([]byte("1\r\na\r\n0\r\n\r\nGET / HTTP/1.1\r\n"), nil)
+	require.NoError(t, err)
+	assert.True(t, d.Done())
+	assert.Equal(t, 11, n)
+	assert.Equal(t, "a", string(body))
+
+	// Test: Truncated input waits for more
+	for _, data := range []string{"", "5", "5\r\nhel", "5\r\nhello", "5\r\nhello\r", "5\r\nhello\r\n0\r\n", "0\r\nX-Checksum: abc\r\n"} {
+		d, _, _, err = decodeAll(data, 1)
+		require.NoError(t, err, data)
+		assert.False(t, d.Done(), data)
+	}
+
+	// Test: Invalid chunk sizes
+	for _, data := range []string{"\r\n", "g\r\n", "-1\r\n", "+5\r\n", "0x5\r\n", " 5\r\n", "5 \r\n", ";ext\r\n"} {
+		_, _, _, err = decodeAll(data, 64)
+		assert.Error(t, err, data)
+	}
+
+	// Test: Sizes that don't fit in 63 bits
+	_, _, _, err = decodeAll("8000000000000000\r\n", 64)
+	assert.Error(t, err)
+	_, _, _, err = decodeAll("10000000000000000000\r\n", 64)
+	assert.Error(t, err)
+	d = NewDecoder(headers.NewHeaders())
+	_, _, err = d.Decode([]byte("7fffffffffffffff\r\n"), nil)
+	require.NoError(t, err)
+
+	// Test: Chunk data longer than its size
+	_, _, _, err = decodeAll("2\r\nhello\r\n0\r\n\r\n", 64)
+	assert.Error(t, err)
+}
+
+func TestIsChunked(t *testing.T) {
+	assert.True(t, IsChunked("chunked"))
+	assert.True(t, IsChunked("gzip, Chunked"))
+	assert.False(t, IsChunked("chunked, gzip"))
+	assert.False(t, IsChunked("gzip"))
+}
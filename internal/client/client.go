@@ -0,0 +1,403 @@
+// Package client is an HTTP/1.1 client built on the request serializer and
+// the response parser, with per-host keep-alive connection pools.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConnsPerHost = 2
+	defaultMaxRedirects        = 10
+)
+
+// ErrUseLastResponse can be returned by CheckRedirect to stop following
+// redirects and get the redirect response itself.
+var ErrUseLastResponse = errors.New("use last response")
+
+// Client sends requests over pooled connections. The zero value is ready to
+// use and a Client is safe for concurrent use.
+type Client struct {
+	// DialTimeout limits connecting, 30 seconds when zero
+	DialTimeout time.Duration
+	// TLSConfig is used for https, with ServerName filled in when empty
+	TLSConfig *tls.Config
+	// TLSHandshakeTimeout limits the TLS handshake, no limit when zero
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout limits the wait for the response headers after
+	// the request has been written, no limit when zero
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long an idle connection is kept, 90 seconds
+	// when zero
+	IdleConnTimeout time.Duration
+	// MaxIdleConns limits idle connections across all hosts, no limit
+	// when zero
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits idle connections per host, 2 when zero
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits all connections per host, no limit when zero.
+	// Requests over the limit wait for a connection to be released.
+	MaxConnsPerHost int
+	// CheckRedirect decides whether to follow a redirect to req, via
+	// holding the requests made so far. When nil up to 10 redirects are
+	// followed.
+	CheckRedirect func(req *request.Request, via []*request.Request) error
+
+	mu        sync.Mutex
+	pools     map[string]*hostPool
+	idleCount int
+}
+
+type Response struct {
+	StatusLine response.StatusLine
+	Headers    headers.Headers
+	// Trailers is filled in once Body has been read to the end
+	Trailers headers.Headers
+	// Body must be closed, which returns the connection to the pool when
+	// the body was read completely
+	Body io.ReadCloser
+	// Request is the request that produced this response, which differs
+	// from the original one after redirects
+	Request *request.Request
+}
+
+// Do sends req and returns the response, following redirects.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	return c.DoContext(context.Background(), req)
+}
+
+// DoContext is Do with a context that cancels the request, including the
+// reading of the response body.
+func (c *Client) DoContext(ctx context.Context, req *request.Request) (*Response, error) {
+	var via []*request.Request
+	for {
+		resp, err := c.roundTrip(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		location, err := resp.Headers.Get("Location")
+		if err != nil || !isRedirect(resp.StatusLine.StatusCode) {
+			return resp, nil
+		}
+		next, err := redirectRequest(req, resp.StatusLine.StatusCode, location)
+		if err != nil {
+			// Not followable, e.g. a streamed body can't be sent again
+			return resp, nil
+		}
+
+		via = append(via, req)
+		checkRedirect := c.CheckRedirect
+		if checkRedirect == nil {
+			checkRedirect = defaultCheckRedirect
+		}
+		if err := checkRedirect(next, via); err != nil {
+			if errors.Is(err, ErrUseLastResponse) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			return nil, err
+		}
+
+		// Drain a little so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// Get fetches rawURL.
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := request.NewBuilder("GET", rawURL).Build()
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func defaultCheckRedirect(req *request.Request, via []*request.Request) error {
+	if len(via) >= defaultMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", defaultMaxRedirects)
+	}
+	return nil
+}
+
+// roundTrip sends a single request without following redirects. A request
+// that fails on a reused connection before any response arrived is retried
+// once on a fresh connection if it can safely be sent again.
+func (c *Client) roundTrip(ctx context.Context, req *request.Request) (*Response, error) {
+	scheme, addr, out, err := destination(req)
+	if err != nil {
+		return nil, err
+	}
+	key := scheme + "://" + addr
+
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pc, err := c.getConn(ctx, key, scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.send(ctx, pc, out)
+		if err == nil {
+			resp.Request = req
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !pc.reused || attempt > 0 || !isReplayable(out) {
+			return nil, err
+		}
+	}
+}
+
+// send writes req on pc and reads the response headers. The connection is
+// closed on error.
+func (c *Client) send(ctx context.Context, pc *persistConn, req *request.Request) (*Response, error) {
+	// Cancelling the context unblocks any read or write on the connection
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	fail := func(err error) (*Response, error) {
+		stop()
+		c.closeConn(pc)
+		return nil, err
+	}
+
+	if _, err := req.WriteTo(pc.conn); err != nil {
+		return fail(err)
+	}
+
+	if c.ResponseHeaderTimeout > 0 {
+		pc.conn.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout))
+	}
+	var head *response.Response
+	for {
+		var err error
+		head, err = pc.parser.ReadResponseHead(req)
+		if err != nil {
+			return fail(err)
+		}
+		if !head.IsInterim() {
+			break
+		}
+		for !head.Done() {
+			if _, err := io.Copy(io.Discard, pc.parser.BodyReader(head)); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		pc.conn.SetReadDeadline(time.Time{})
+	}
+
+	b := &body{
+		client:   c,
+		pc:       pc,
+		reader:   pc.parser.BodyReader(head),
+		reusable: head.KeepAlive() && req.KeepAlive(),
+		stop:     stop,
+	}
+	if head.Done() && len(head.Body) == 0 {
+		b.finish(true)
+	}
+	return &Response{
+		StatusLine: head.StatusLine,
+		Headers:    head.Headers,
+		Trailers:   head.Trailers,
+		Body:       b,
+	}, nil
+}
+
+// destination works out where req goes and the request to send there, which
+// always uses an origin-form target and carries a Host header.
+func destination(req *request.Request) (scheme, addr string, out *request.Request, err error) {
+	target := req.RequestLine.RequestTarget
+	scheme = strings.ToLower(req.Scheme)
+	authority, _ := req.Headers.Get("Host")
+
+	if !strings.HasPrefix(target, "/") && target != "*" {
+		u, err := url.Parse(target)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return "", "", nil, fmt.Errorf("invalid request target %q", target)
+		}
+		scheme = strings.ToLower(u.Scheme)
+		authority = u.Host
+		target = u.RequestURI()
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return "", "", nil, fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	if authority == "" {
+		return "", "", nil, errors.New("request has no host")
+	}
+
+	host, port, err := request.SplitHostPort(authority)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+
+	copied := *req
+	out = &copied
+	out.RequestLine.RequestTarget = target
+	out.Headers = headers.NewHeaders()
+	for name, value := range req.Headers {
+		out.Headers.Overwrite(name, value)
+	}
+	out.Headers.Overwrite("Host", authority)
+	return scheme, net.JoinHostPort(host, port), out, nil
+}
+
+func isRedirect(code response.StatusCode) bool {
+	switch code {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectRequest builds the request that follows a redirect from req. 303,
+// and 301 or 302 after a POST, switch to a GET without a body; the others
+// repeat the request, which is only possible when the body is in memory.
+func redirectRequest(req *request.Request, code response.StatusCode, location string) (*request.Request, error) {
+	scheme, addr, out, err := destination(req)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(scheme + "://" + out.Headers["host"] + out.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	next, err := base.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if next.Scheme != "http" && next.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported redirect scheme %q", next.Scheme)
+	}
+
+	method := req.RequestLine.Method
+	dropBody := false
+	if (code == response.StatusSeeOther && method != "HEAD") ||
+		((code == response.StatusMovedPermanently || code == response.StatusFound) && method == "POST") {
+		method = "GET"
+		dropBody = true
+	}
+	if !dropBody && req.BodyReader != nil {
+		return nil, errors.New("request body can't be replayed")
+	}
+
+	redirected := *out
+	redirected.RequestLine.Method = method
+	redirected.RequestLine.RequestTarget = next.String()
+	redirected.Scheme = next.Scheme
+	redirected.Headers = headers.NewHeaders()
+	for name, value := range out.Headers {
+		redirected.Headers.Overwrite(name, value)
+	}
+	redirected.Headers.Delete("Host")
+	if dropBody {
+		redirected.Body = nil
+		redirected.BodyReader = nil
+		redirected.Headers.Delete("Content-Length")
+		redirected.Headers.Delete("Content-Type")
+		redirected.Headers.Delete("Transfer-Encoding")
+	}
+	// Credentials are only for the host they were meant for
+	if _, nextAddr, _, err := destination(&redirected); err != nil || nextAddr != addr {
+		redirected.Headers.Delete("Authorization")
+		redirected.Headers.Delete("Cookie")
+	}
+	return &redirected, nil
+}
+
+// isReplayable reports whether req can be sent again after a failure on a
+// stale connection.
+func isReplayable(req *request.Request) bool {
+	if req.BodyReader != nil {
+		return false
+	}
+	switch req.RequestLine.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// body releases the connection once the response body has been consumed.
+type body struct {
+	client   *Client
+	pc       *persistConn
+	reader   io.Reader
+	reusable bool
+	stop     func() bool
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.reader.Read(p)
+	if err == io.EOF {
+		b.finish(true)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Close releases the connection. A body that wasn't read to the end leaves
+// the connection in an unknown state, so it is closed rather than reused.
+func (b *body) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.done {
+		b.finish(false)
+	}
+	return nil
+}
+
+func (b *body) finish(complete bool) {
+	b.done = true
+	// stop returns false when the context was cancelled and the deadline
+	// has already been broken
+	if b.stop() && complete && b.reusable {
+		b.client.putIdle(b.pc)
+		return
+	}
+	b.client.closeConn(b.pc)
+}
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func readAll(t *testing.T, resp *Response) string {
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+func (c *Client) openConns() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, hp := range c.pools {
+		n += hp.conns
+	}
+	return n
+}
+
+func TestClientDo(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		rw := response.NewResponseWriter(w)
+		switch req.RequestLine.RequestTarget {
+		case "/stream":
+			w.WriteStatusLine(response.StatusOK)
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(nil)
+			for i := 0; i < 3; i++ {
+				w.WriteChunkedBody([]byte(fmt.Sprintf("part%d ", i)))
+			}
+			w.WriteChunkedBodyDone()
+			w.WriteTrailers(nil)
+		case "/echo":
+			rw.Header().Set("Content-Length", fmt.Sprint(len(req.Body)))
+			rw.Write(req.Body)
+		default:
+			rw.Header().Set("Content-Length", "5")
+			rw.Write([]byte("hello"))
+		}
+	})
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	// Test: Simple GET
+	resp, err := c.Get(base + "/")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "hello", readAll(t, resp))
+
+	// Test: Connection is reused for sequential requests
+	for i := 0; i < 3; i++ {
+		resp, err = c.Get(base + "/")
+		require.NoError(t, err)
+		assert.Equal(t, "hello", readAll(t, resp))
+	}
+	assert.Equal(t, 1, c.openConns())
+
+	// Test: Body is sent and echoed
+	req, err := request.NewBuilder("POST", base+"/echo").BodyBytes([]byte("ping")).Build()
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", readAll(t, resp))
+
+	// Test: Chunked response is decoded
+	resp, err = c.Get(base + "/stream")
+	require.NoError(t, err)
+	assert.Equal(t, "part0 part1 part2 ", readAll(t, resp))
+	assert.Equal(t, 1, c.openConns())
+
+	// Test: Closing an unread body discards the connection
+	resp, err = c.Get(base + "/stream")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, 0, c.openConns())
+
+	// Test: Request without a host
+	req, err = request.NewBuilder("GET", "/").Build()
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	require.Error(t, err)
+}
+
+func TestClientRedirects(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		mu.Lock()
+		auth, _ := req.Headers.Get("Authorization")
+		seen = append(seen, req.RequestLine.Method+" "+req.RequestLine.RequestTarget+" "+auth)
+		mu.Unlock()
+
+		rw := response.NewResponseWriter(w)
+		rw.Header().Set("Content-Length", "0")
+		switch req.RequestLine.RequestTarget {
+		case "/see-other":
+			rw.Header().Set("Location", "/done")
+			rw.WriteHeader(response.StatusSeeOther)
+		case "/temporary":
+			rw.Header().Set("Location", "/done")
+			rw.WriteHeader(response.StatusTemporaryRedirect)
+		case "/loop":
+			rw.Header().Set("Location", "/loop")
+			rw.WriteHeader(response.StatusFound)
+		default:
+			rw.WriteHeader(response.StatusOK)
+		}
+	})
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	// Test: 303 turns a POST into a GET without a body
+	req, err := request.NewBuilder("POST", base+"/see-other").
+		Header("Authorization", "secret").
+		BodyBytes([]byte("data")).
+		Build()
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	readAll(t, resp)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, base+"/done", resp.Request.RequestLine.RequestTarget)
+	assert.Equal(t, []string{"POST /see-other secret", "GET /done secret"}, seen)
+
+	// Test: 307 repeats the method
+	seen = nil
+	req, err = request.NewBuilder("PUT", base+"/temporary").BodyBytes([]byte("data")).Build()
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	readAll(t, resp)
+	assert.Equal(t, []string{"PUT /temporary ", "PUT /done "}, seen)
+
+	// Test: Redirect loops stop
+	_, err = c.Get(base + "/loop")
+	require.Error(t, err)
+
+	// Test: CheckRedirect can return the redirect itself
+	c.CheckRedirect = func(req *request.Request, via []*request.Request) error {
+		return ErrUseLastResponse
+	}
+	resp, err = c.Get(base + "/see-other")
+	require.NoError(t, err)
+	readAll(t, resp)
+	assert.Equal(t, response.StatusSeeOther, resp.StatusLine.StatusCode)
+}
+
+func TestClientLimits(t *testing.T) {
+	release := make(chan struct{})
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		rw := response.NewResponseWriter(w)
+		rw.Header().Set("Content-Length", "2")
+		rw.Write([]byte("ok"))
+	})
+
+	// Test: Context cancellation interrupts a request in flight
+	c := &Client{}
+	req, err := request.NewBuilder("GET", base+"/slow").Build()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.DoContext(ctx, req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, c.openConns())
+
+	// Test: ResponseHeaderTimeout
+	c = &Client{ResponseHeaderTimeout: 50 * time.Millisecond}
+	_, err = c.Do(req)
+	require.Error(t, err)
+
+	// Test: MaxConnsPerHost makes requests wait for a connection
+	c = &Client{MaxConnsPerHost: 1}
+	defer c.CloseIdleConnections()
+	done := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := c.Get(base + "/slow")
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			done <- string(body)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, c.openConns())
+	close(release)
+	assert.Equal(t, "ok", <-done)
+	assert.Equal(t, "ok", <-done)
+	assert.Equal(t, 1, c.openConns())
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// persistConn is a connection that can carry one request at a time and is
+// returned to the pool once its response has been read.
+type persistConn struct {
+	conn   net.Conn
+	parser *response.Parser
+	key    string
+	idleAt time.Time
+	reused bool
+}
+
+// hostPool tracks the connections to one scheme://host:port.
+type hostPool struct {
+	// idle is used as a stack so the most recently used conn is reused first
+	idle  []*persistConn
+	conns int
+	// wait is closed and replaced whenever a conn is released, waking up
+	// everyone waiting on MaxConnsPerHost
+	wait chan struct{}
+}
+
+func (c *Client) hostPool(key string) *hostPool {
+	if c.pools == nil {
+		c.pools = map[string]*hostPool{}
+	}
+	hp, ok := c.pools[key]
+	if !ok {
+		hp = &hostPool{}
+		c.pools[key] = hp
+	}
+	return hp
+}
+
+// getConn returns an idle connection to key or dials a new one, waiting for
+// a slot when MaxConnsPerHost connections are already open.
+func (c *Client) getConn(ctx context.Context, key, scheme, addr string) (*persistConn, error) {
+	c.mu.Lock()
+	for {
+		hp := c.hostPool(key)
+		for len(hp.idle) > 0 {
+			pc := hp.idle[len(hp.idle)-1]
+			hp.idle = hp.idle[:len(hp.idle)-1]
+			c.idleCount--
+			if c.idleConnTimeout() > 0 && time.Since(pc.idleAt) > c.idleConnTimeout() {
+				pc.conn.Close()
+				hp.conns--
+				continue
+			}
+			c.mu.Unlock()
+			pc.reused = true
+			return pc, nil
+		}
+
+		if c.MaxConnsPerHost <= 0 || hp.conns < c.MaxConnsPerHost {
+			hp.conns++
+			c.mu.Unlock()
+			pc, err := c.dial(ctx, key, scheme, addr)
+			if err != nil {
+				c.mu.Lock()
+				hp.conns--
+				hp.notify()
+				c.mu.Unlock()
+				return nil, err
+			}
+			return pc, nil
+		}
+
+		if hp.wait == nil {
+			hp.wait = make(chan struct{})
+		}
+		wait := hp.wait
+		c.mu.Unlock()
+		select {
+		case <-wait:
+			c.mu.Lock()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) dial(ctx context.Context, key, scheme, addr string) (*persistConn, error) {
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = defaultDialTimeout
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, _ := net.SplitHostPort(addr)
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		handshakeCtx := ctx
+		if c.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			handshakeCtx, cancel = context.WithTimeout(ctx, c.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return &persistConn{
+		conn:   conn,
+		parser: response.NewParser(conn),
+		key:    key,
+	}, nil
+}
+
+// putIdle returns pc to the pool, closing it instead when the idle limits
+// are reached.
+func (c *Client) putIdle(pc *persistConn) {
+	pc.conn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hp := c.hostPool(pc.key)
+	if len(hp.idle) >= c.maxIdleConnsPerHost() || pc.parser.Buffered() > 0 {
+		pc.conn.Close()
+		hp.conns--
+		hp.notify()
+		return
+	}
+
+	pc.idleAt = time.Now()
+	hp.idle = append(hp.idle, pc)
+	c.idleCount++
+	if c.MaxIdleConns > 0 && c.idleCount > c.MaxIdleConns {
+		c.evictOldestIdle()
+	}
+	hp.notify()
+}
+
+// closeConn closes a connection that can't be reused.
+func (c *Client) closeConn(pc *persistConn) {
+	pc.conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hp := c.hostPool(pc.key)
+	hp.conns--
+	hp.notify()
+}
+
+func (c *Client) evictOldestIdle() {
+	var oldest *hostPool
+	for _, hp := range c.pools {
+		if len(hp.idle) == 0 {
+			continue
+		}
+		if oldest == nil || hp.idle[0].idleAt.Before(oldest.idle[0].idleAt) {
+			oldest = hp
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	oldest.idle[0].conn.Close()
+	oldest.idle = oldest.idle[1:]
+	oldest.conns--
+	c.idleCount--
+	oldest.notify()
+}
+
+// CloseIdleConnections closes every idle connection in the pool.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, hp := range c.pools {
+		for _, pc := range hp.idle {
+			pc.conn.Close()
+			hp.conns--
+			c.idleCount--
+		}
+		hp.idle = nil
+		hp.notify()
+	}
+}
+
+func (hp *hostPool) notify() {
+	if hp.wait != nil {
+		close(hp.wait)
+		hp.wait = nil
+	}
+}
+
+func (c *Client) maxIdleConnsPerHost() int {
+	if c.MaxIdleConnsPerHost > 0 {
+		return c.MaxIdleConnsPerHost
+	}
+	return defaultMaxIdleConnsPerHost
+}
+
+func (c *Client) idleConnTimeout() time.Duration {
+	if c.IdleConnTimeout > 0 {
+		return c.IdleConnTimeout
+	}
+	return defaultIdleConnTimeout
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+)
+
+var _ http.RoundTripper = (*Client)(nil)
+
+// RoundTrip lets the Client serve as the Transport of an http.Client. It
+// sends a single request and, unlike Do, leaves redirects to the caller.
+func (c *Client) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	if r.URL == nil {
+		return nil, fmt.Errorf("request has no URL")
+	}
+
+	b := request.NewBuilder(r.Method, r.URL.String())
+	for name, value := range headers.FromHTTP(r.Header) {
+		b.Header(name, value)
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > 0 {
+			b.Header("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		}
+		b.Body(r.Body)
+	}
+	req, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	if r.Host != "" {
+		req.Headers.Overwrite("Host", r.Host)
+	}
+	if r.Close {
+		req.Headers.Overwrite("Connection", "close")
+	}
+
+	resp, err := c.roundTrip(r.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := "HTTP/" + resp.StatusLine.HttpVersion
+	major, minor, _ := http.ParseHTTPVersion(proto)
+	header := resp.Headers.HTTP()
+	httpResp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", resp.StatusLine.StatusCode, resp.StatusLine.ReasonPhrase),
+		StatusCode:    int(resp.StatusLine.StatusCode),
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		ContentLength: -1,
+		Request:       r,
+	}
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		httpResp.ContentLength = cl
+	}
+	if te := header.Get("Transfer-Encoding"); te != "" {
+		httpResp.TransferEncoding = []string{te}
+		header.Del("Transfer-Encoding")
+	}
+	if connection := header.Get("Connection"); strings.EqualFold(connection, "close") {
+		httpResp.Close = true
+	}
+	if trailer := header.Get("Trailer"); trailer != "" {
+		httpResp.Trailer = http.Header{}
+		for _, name := range strings.Split(trailer, ",") {
+			httpResp.Trailer[http.CanonicalHeaderKey(strings.TrimSpace(name))] = nil
+		}
+	}
+	httpResp.Body = &trailerBody{ReadCloser: resp.Body, resp: resp, httpResp: httpResp}
+	return httpResp, nil
+}
+
+// trailerBody copies the trailers into the http.Response once the body has
+// been read, which is when net/http callers expect them.
+type trailerBody struct {
+	io.ReadCloser
+	resp     *Response
+	httpResp *http.Response
+}
+
+func (tb *trailerBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err == io.EOF && len(tb.resp.Trailers) > 0 {
+		if tb.httpResp.Trailer == nil {
+			tb.httpResp.Trailer = http.Header{}
+		}
+		for name, value := range tb.resp.Trailers {
+			tb.httpResp.Trailer.Set(name, value)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/redirect":
+			w.WriteStatusLine(response.StatusFound)
+			h := response.GetDefaultHeaders(0)
+			h.Set("Location", "/echo")
+			w.WriteHeaders(h)
+		case "/trailers":
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Trailer", "X-Done")
+			w.WriteHeaders(h)
+			body, err := response.NewChunkedWriter(w)
+			if err != nil {
+				return
+			}
+			io.WriteString(body, "streamed")
+			body.Trailer().Set("X-Done", "yes")
+			body.Close()
+		default:
+			agent, _ := req.Headers.Get("User-Agent")
+			body := req.RequestLine.Method + " " + agent + " " + string(req.Body)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		}
+	})
+	c := &Client{}
+	defer c.CloseIdleConnections()
+	httpClient := &http.Client{Transport: c}
+
+	// Test: Request through an http.Client
+	req, err := http.NewRequest("PUT", base+"/echo", strings.NewReader("data"))
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "test")
+	resp, err := httpClient.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "200 OK", resp.Status)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.Equal(t, "PUT test data", string(body))
+
+	// Test: Redirects are followed by the http.Client, not RoundTrip
+	resp, err = c.RoundTrip(mustRequest(t, base+"/redirect"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	resp, err = httpClient.Get(base + "/redirect")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "GET  ", string(body))
+
+	// Test: Trailers appear once the body is read
+	req = mustRequest(t, base+"/trailers")
+	req.Header.Set("TE", "trailers")
+	resp, err = httpClient.Do(req)
+	require.NoError(t, err)
+	assert.Contains(t, resp.Trailer, "X-Done")
+	assert.Equal(t, "", resp.Trailer.Get("X-Done"))
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "streamed", string(body))
+	assert.Equal(t, "yes", resp.Trailer.Get("X-Done"))
+}
+
+func mustRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	return req
+}
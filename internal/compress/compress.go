@@ -0,0 +1,218 @@
+// Package compress compresses responses with gzip or deflate for clients
+// that accept it and decodes compressed request bodies.
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/negotiate"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+)
+
+const defaultMinSize = 1024
+
+// DefaultTypes are the media types compressed when Handler.Types is empty.
+// Images, video, archives and the like are left out since they are already
+// compressed.
+var DefaultTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xhtml+xml",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Handler compresses the responses of Next. Whether a response is
+// compressed is decided when its headers are written: it needs an eligible
+// Content-Type, no Content-Encoding or "Cache-Control: no-transform", and a
+// Content-Length of at least MinSize if it declares one. A compressed
+// response loses its Content-Length, so it is sent chunked, and its ETag is
+// weakened since the bytes differ from the uncompressed representation.
+type Handler struct {
+	Next server.Handler
+	// MinSize is the smallest declared Content-Length worth compressing,
+	// 1024 when zero. Bodies of unknown length are always compressed.
+	MinSize int64
+	// Level is a compress/flate level, the default compression when zero
+	Level int
+	// Types lists the media types to compress, either exactly or as
+	// "type/*". DefaultTypes is used when empty.
+	Types []string
+}
+
+func New(next server.Handler) *Handler {
+	return &Handler{Next: next}
+}
+
+func (c *Handler) Serve(w *response.Writer, req *request.Request) {
+	next := w.BodyEncoder()
+	w.SetBodyEncoder(func(statusCode response.StatusCode, h headers.Headers, dst io.Writer) io.WriteCloser {
+		encoded := c.encode(req, statusCode, h, dst)
+		if next == nil {
+			return encoded
+		}
+		// The encoder installed before this one sees the headers of the
+		// compressed response and gets the compressed body
+		out := next(statusCode, h, dst)
+		if encoded == nil {
+			return out
+		}
+		if out == nil {
+			return encoded
+		}
+		encoded.Reset(out)
+		return &chainedEncoder{encoder: encoded, out: out}
+	})
+	c.Next(w, req)
+	w.SetBodyEncoder(next)
+}
+
+// encoder is what gzip.Writer and zlib.Writer have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(dst io.Writer)
+}
+
+// chainedEncoder compresses into the writer of another BodyEncoder.
+type chainedEncoder struct {
+	encoder
+	out io.WriteCloser
+}
+
+func (e *chainedEncoder) Flush() error {
+	if err := e.encoder.Flush(); err != nil {
+		return err
+	}
+	if f, ok := e.out.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (e *chainedEncoder) Close() error {
+	err := e.encoder.Close()
+	if closeErr := e.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// encode decides whether the response is compressed and returns the
+// encoder writing to dst if it is, after updating the headers.
+func (c *Handler) encode(req *request.Request, statusCode response.StatusCode, h headers.Headers, dst io.Writer) encoder {
+	if !c.eligible(statusCode, h) {
+		return nil
+	}
+	// The response depends on Accept-Encoding even when it isn't compressed
+	addVary(h, "Accept-Encoding")
+
+	// Clients that don't send Accept-Encoding get identity even though RFC
+	// 9110 would allow anything, since most of them can't decode it
+	if _, err := req.Headers.Get("Accept-Encoding"); err != nil {
+		return nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var encoded encoder
+	var err error
+	coding := negotiate.Encoding(req.Headers, "gzip", "deflate", "identity")
+	switch coding {
+	case "gzip":
+		encoded, err = gzip.NewWriterLevel(dst, level)
+	case "deflate":
+		// The "deflate" coding is the zlib format (RFC 9110 section
+		// 8.4.1.2)
+		encoded, err = zlib.NewWriterLevel(dst, level)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+
+	h.Overwrite("Content-Encoding", coding)
+	h.Delete("Content-Length")
+	// Ranges of the uncompressed body don't apply to the compressed one
+	h.Delete("Accept-Ranges")
+	if etag, err := h.Get("ETag"); err == nil && !strings.HasPrefix(etag, "W/") {
+		h.Overwrite("ETag", "W/"+etag)
+	}
+	return encoded
+}
+
+func (c *Handler) eligible(statusCode response.StatusCode, h headers.Headers) bool {
+	if statusCode.IsInformational() || statusCode == response.StatusNoContent ||
+		statusCode == response.StatusNotModified || statusCode == response.StatusPartialContent {
+		return false
+	}
+	if _, err := h.Get("Content-Encoding"); err == nil {
+		return false
+	}
+	if cc, err := h.Get("Cache-Control"); err == nil && hasToken(cc, "no-transform") {
+		return false
+	}
+	if cl, err := h.Get("Content-Length"); err == nil {
+		minSize := c.MinSize
+		if minSize <= 0 {
+			minSize = defaultMinSize
+		}
+		if n, err := strconv.ParseInt(cl, 10, 64); err != nil || n < minSize {
+			return false
+		}
+	}
+	contentType, err := h.Get("Content-Type")
+	if err != nil {
+		return false
+	}
+	return c.compressible(contentType)
+}
+
+func (c *Handler) compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	types := c.Types
+	if len(types) == 0 {
+		types = DefaultTypes
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func addVary(h headers.Headers, name string) {
+	if vary, err := h.Get("Vary"); err == nil && (hasToken(vary, name) || hasToken(vary, "*")) {
+		return
+	}
+	h.Set("Vary", name)
+}
+
+func hasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var page = strings.Repeat("<p>Your request was an absolute banger.</p>\n", 50)
+
+func serve(t *testing.T, c *Handler, method, acceptEncoding string) (*response.Response, []byte) {
+	b := request.NewBuilder(method, "/")
+	if acceptEncoding != "" {
+		b.Header("Accept-Encoding", acceptEncoding)
+	}
+	req, err := b.Build()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	c.Serve(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	return resp, resp.Body
+}
+
+func staticHandler(contentType, body string, fields ...string) *Handler {
+	return New(func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Overwrite("Content-Type", contentType)
+		for i := 0; i+1 < len(fields); i += 2 {
+			h.Overwrite(fields[i], fields[i+1])
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	})
+}
+
+func gunzip(t *testing.T, body []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestCompress(t *testing.T) {
+	html := staticHandler("text/html; charset=utf-8", page, "ETag", `"v1"`, "Accept-Ranges", "bytes")
+
+	// Test: gzip when accepted
+	resp, body := serve(t, html, "GET", "gzip, deflate, br")
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	assert.Equal(t, "Accept-Encoding", resp.Headers["vary"])
+	assert.Equal(t, "chunked", resp.Headers["transfer-encoding"])
+	assert.Equal(t, `W/"v1"`, resp.Headers["etag"])
+	assert.NotContains(t, resp.Headers, "content-length")
+	assert.NotContains(t, resp.Headers, "accept-ranges")
+	assert.Less(t, len(body), len(page))
+	assert.Equal(t, page, gunzip(t, body))
+
+	// Test: deflate is the zlib format
+	resp, body = serve(t, html, "GET", "deflate")
+	assert.Equal(t, "deflate", resp.Headers["content-encoding"])
+	r, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(data))
+
+	// Test: HEAD gets the same headers without a body
+	resp, body = serve(t, html, "HEAD", "gzip")
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	assert.Empty(t, body)
+
+	// Test: Identity without Accept-Encoding or when nothing else is accepted
+	for _, ae := range []string{"", "br", "gzip;q=0"} {
+		resp, body = serve(t, html, "GET", ae)
+		assert.NotContains(t, resp.Headers, "content-encoding")
+		assert.Equal(t, "Accept-Encoding", resp.Headers["vary"])
+		assert.Equal(t, `"v1"`, resp.Headers["etag"])
+		assert.Equal(t, page, string(body))
+	}
+
+	// Test: Ineligible responses are left alone
+	ineligible := map[string]*Handler{
+		"small":        staticHandler("text/html", "<p>hi</p>"),
+		"video":        staticHandler("video/mp4", page),
+		"encoded":      staticHandler("text/html", page, "Content-Encoding", "br"),
+		"no-transform": staticHandler("text/html", page, "Cache-Control", "no-transform"),
+		"custom types": {Next: html.Next, Types: []string{"application/json"}},
+		"min size":     {Next: html.Next, MinSize: int64(len(page) + 1)},
+	}
+	for name, c := range ineligible {
+		resp, _ = serve(t, c, "GET", "gzip")
+		assert.NotEqual(t, "gzip", resp.Headers["content-encoding"], name)
+		assert.NotContains(t, resp.Headers, "vary", name)
+		assert.NotContains(t, resp.Headers, "transfer-encoding", name)
+	}
+}
+
+// countingEncoder is a BodyEncoder installed before the compression, which
+// records what reaches it.
+type countingEncoder struct {
+	dst     io.Writer
+	written bytes.Buffer
+	closed  bool
+}
+
+func (e *countingEncoder) Write(p []byte) (int, error) {
+	e.written.Write(p)
+	return e.dst.Write(p)
+}
+
+func (e *countingEncoder) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestCompressChaining(t *testing.T) {
+	// Test: An encoder installed before is kept and gets the compressed body
+	var outer *countingEncoder
+	var outerHeaders headers.Headers
+	c := staticHandler("text/html", page)
+	req, err := request.NewBuilder("GET", "/").Header("Accept-Encoding", "gzip").Build()
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	w.SetBodyEncoder(func(statusCode response.StatusCode, h headers.Headers, dst io.Writer) io.WriteCloser {
+		outerHeaders = h
+		outer = &countingEncoder{dst: dst}
+		return outer
+	})
+	c.Serve(w, req)
+	require.NoError(t, w.Finish())
+	require.NotNil(t, outer)
+	assert.Equal(t, "gzip", outerHeaders["content-encoding"])
+	assert.True(t, outer.closed)
+	assert.Equal(t, page, gunzip(t, outer.written.Bytes()))
+	assert.NotNil(t, w.BodyEncoder())
+}
+
+func TestCompressStreaming(t *testing.T) {
+	c := New(func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Overwrite("Content-Type", "text/event-stream")
+		h.Set("Trailer", "X-Done")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		body, err := response.NewChunkedWriter(w)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			io.WriteString(body, "data: tick\n\n")
+			require.NoError(t, body.Flush())
+		}
+		body.Trailer().Set("X-Done", "yes")
+		require.NoError(t, body.Close())
+	})
+
+	b := request.NewBuilder("GET", "/").Header("Accept-Encoding", "gzip").Header("TE", "trailers")
+	req, err := b.Build()
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	c.Serve(w, req)
+	require.NoError(t, w.Finish())
+
+	// Test: Bodies without a length are compressed and trailers survive
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	assert.Equal(t, strings.Repeat("data: tick\n\n", 3), gunzip(t, resp.Body))
+	assert.Equal(t, "yes", resp.Trailers["x-done"])
+}
@@ -0,0 +1,47 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+)
+
+const defaultMaxDecodedSize = 10 << 20
+
+// Decompress decodes gzip and deflate request bodies before they reach Next,
+// which sees the plain body without a Content-Encoding. Bodies with other
+// codings are answered with 415 and those decoding to more than MaxSize
+// bytes with 413.
+type Decompress struct {
+	Next server.Handler
+	// MaxSize limits the decoded body, 10 MiB when zero
+	MaxSize int64
+}
+
+func NewDecompress(next server.Handler) *Decompress {
+	return &Decompress{Next: next}
+}
+
+func (d *Decompress) Serve(w *response.Writer, req *request.Request) {
+	maxSize := d.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecodedSize
+	}
+	err := req.DecodeBody(maxSize)
+	switch {
+	case errors.Is(err, request.ErrUnsupportedEncoding):
+		// Accept-Encoding tells the client which codings would work (RFC
+		// 9110 section 15.5.16)
+		w.Header().Set("Accept-Encoding", "gzip, deflate")
+		response.WriteError(w, response.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported media type %v", err))
+	case errors.Is(err, request.ErrBodyTooLarge):
+		response.WriteError(w, response.StatusContentTooLarge, "Decoded body too large")
+	case err != nil:
+		response.WriteError(w, response.StatusBadRequest, fmt.Sprintf("Invalid body %v", err))
+	default:
+		d.Next(w, req)
+	}
+}
@@ -0,0 +1,68 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompress(t *testing.T) {
+	d := &Decompress{
+		Next: func(w *response.Writer, req *request.Request) {
+			body := req.Headers["content-encoding"] + "|" + string(req.Body)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		},
+		MaxSize: 64,
+	}
+	post := func(encoding string, body []byte) *response.Response {
+		b := request.NewBuilder("POST", "/batch").BodyBytes(body)
+		if encoding != "" {
+			b.Header("Content-Encoding", encoding)
+		}
+		req, err := b.Build()
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		w.SetRequest(req)
+		d.Serve(w, req)
+		require.NoError(t, w.Finish())
+		resp, err := response.ResponseFromReader(buf, req)
+		require.NoError(t, err)
+		return resp
+	}
+	gz := func(s string) []byte {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	// Test: Handlers see the decoded body
+	resp := post("gzip", gz(`{"id": 1}`))
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, `|{"id": 1}`, string(resp.Body))
+	resp = post("", []byte("plain"))
+	assert.Equal(t, "|plain", string(resp.Body))
+
+	// Test: Unknown codings are unsupported
+	resp = post("br", []byte("xyz"))
+	assert.Equal(t, response.StatusUnsupportedMediaType, resp.StatusLine.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Headers["accept-encoding"])
+
+	// Test: Too large once decoded
+	resp = post("gzip", gz(strings.Repeat("a", 65)))
+	assert.Equal(t, response.StatusContentTooLarge, resp.StatusLine.StatusCode)
+
+	// Test: Corrupt body
+	resp = post("gzip", []byte("garbage"))
+	assert.Equal(t, response.StatusBadRequest, resp.StatusLine.StatusCode)
+}
@@ -0,0 +1,290 @@
+package content
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+)
+
+const defaultMaxBufferSize = 256 << 10
+
+// ETag returns a strong entity tag derived from a hash of data.
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hashETag(sum[:])
+}
+
+// hashETag makes an entity tag out of a SHA-256 sum.
+func hashETag(sum []byte) string {
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+// WeakETag returns ETag(data) marked as weak, for representations whose
+// bytes may change without changing their meaning.
+func WeakETag(data []byte) string {
+	return "W/" + ETag(data)
+}
+
+// ServeBytes is Serve for content held in memory. Unless w.Header() already
+// has an ETag, a strong one is computed from data.
+func ServeBytes(w *response.Writer, req *request.Request, name string, modtime time.Time, data []byte) {
+	if _, err := w.Header().Get("ETag"); err != nil {
+		w.Header().Set("ETag", ETag(data))
+	}
+	Serve(w, req, name, modtime, bytes.NewReader(data))
+}
+
+// CheckPreconditions evaluates the conditional header fields of req against
+// the ETag set in w.Header() and modtime, the last modification of the
+// representation (zero when unknown). When they decide the outcome it writes
+// a 304 Not Modified or 412 Precondition Failed response and returns true,
+// and the handler must not write anything else.
+func CheckPreconditions(w *response.Writer, req *request.Request, modtime time.Time) bool {
+	switch checkPreconditions(req, w.Header()["etag"], modtime) {
+	case response.StatusNotModified:
+		writeNotModified(w, nil)
+	case response.StatusPreconditionFailed:
+		writePreconditionFailed(w)
+	default:
+		return false
+	}
+	return true
+}
+
+// checkPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since in the order of RFC 9110 section 13.2.2. It returns
+// the status to answer with, or zero when the request should be served as
+// usual.
+func checkPreconditions(req *request.Request, etag string, modtime time.Time) response.StatusCode {
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+	modtime = modtime.Truncate(time.Second)
+
+	if value, err := req.Headers.Get("If-Match"); err == nil {
+		if !matchETag(value, etag, true) {
+			return response.StatusPreconditionFailed
+		}
+	} else if value, err := req.Headers.Get("If-Unmodified-Since"); err == nil && knownTime(modtime) {
+		if date, err := http.ParseTime(strings.TrimSpace(value)); err == nil && modtime.After(date) {
+			return response.StatusPreconditionFailed
+		}
+	}
+
+	if value, err := req.Headers.Get("If-None-Match"); err == nil {
+		if matchETag(value, etag, false) {
+			if safe {
+				return response.StatusNotModified
+			}
+			return response.StatusPreconditionFailed
+		}
+	} else if value, err := req.Headers.Get("If-Modified-Since"); err == nil && safe && knownTime(modtime) {
+		if date, err := http.ParseTime(strings.TrimSpace(value)); err == nil && !modtime.After(date) {
+			return response.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// matchETag reports whether the entity tag list of an If-Match or
+// If-None-Match field matches etag, using the strong or the weak comparison
+// of RFC 9110 section 8.8.3.2. "*" matches any current representation. A
+// malformed list matches nothing past the point where it breaks.
+func matchETag(list, etag string, strong bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" || (strong && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		weak := strings.HasPrefix(list, "W/")
+		list = strings.TrimPrefix(list, "W/")
+		if !strings.HasPrefix(list, `"`) {
+			return false
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return false
+		}
+		tag := list[:end+2]
+		list = list[end+2:]
+		if tag == opaque && !(strong && weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownTime reports whether t is an actual modification time rather than a
+// zero value or the Unix epoch, which file systems report when they don't
+// know.
+func knownTime(t time.Time) bool {
+	return !t.IsZero() && t.Unix() != 0
+}
+
+// representationFields describe the body, which a 304 response doesn't
+// have (RFC 9110 section 15.4.5).
+var representationFields = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Range",
+	"Transfer-Encoding",
+	"Trailer",
+}
+
+// writeNotModified answers with 304, keeping the fields of h and w.Header()
+// other than those describing the body, e.g. ETag, Cache-Control and Vary.
+func writeNotModified(w *response.Writer, h headers.Headers) {
+	for _, name := range representationFields {
+		h.Delete(name)
+		w.Header().Delete(name)
+	}
+	w.WriteStatusLine(response.StatusNotModified)
+	w.WriteHeaders(h)
+}
+
+func writePreconditionFailed(w *response.Writer) {
+	for _, name := range []string{"ETag", "Last-Modified", "Accept-Ranges", "Content-Range"} {
+		w.Header().Delete(name)
+	}
+	response.WriteError(w, response.StatusPreconditionFailed, "Precondition failed")
+}
+
+// Conditional makes conditional requests work for handlers that don't
+// evaluate them themselves. A 200 response to GET or HEAD with a
+// Content-Length of at most MaxSize is held back until it is complete, given
+// an ETag computed from its body if it has none, and then sent as it is or
+// replaced by a 304 or 412 depending on the preconditions of the request.
+// Larger and streamed responses pass through, their handlers can use
+// CheckPreconditions.
+type Conditional struct {
+	Next server.Handler
+	// MaxSize is the largest body that is buffered, 256 KiB when zero
+	MaxSize int64
+	// Weak makes the computed entity tags weak
+	Weak bool
+}
+
+func NewConditional(next server.Handler) *Conditional {
+	return &Conditional{Next: next}
+}
+
+func (c *Conditional) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		c.Next(w, req)
+		return
+	}
+
+	next := w.BodyEncoder()
+	var held *heldResponse
+	w.SetBodyEncoder(func(statusCode response.StatusCode, h headers.Headers, dst io.Writer) io.WriteCloser {
+		if held = c.hold(statusCode, h, dst); held != nil {
+			return held
+		}
+		if next != nil {
+			return next(statusCode, h, dst)
+		}
+		return nil
+	})
+	c.Next(w, req)
+	w.SetBodyEncoder(next)
+
+	// Once the headers have gone out the held body is sent unchanged when
+	// the response is finished
+	if held == nil || w.Reset() != nil {
+		return
+	}
+	c.release(w, req, held)
+}
+
+func (c *Conditional) hold(statusCode response.StatusCode, h headers.Headers, dst io.Writer) *heldResponse {
+	if statusCode != response.StatusOK {
+		return nil
+	}
+	if _, err := h.Get("Transfer-Encoding"); err == nil {
+		return nil
+	}
+	cl, err := h.Get("Content-Length")
+	if err != nil {
+		return nil
+	}
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxBufferSize
+	}
+	length, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || length < 0 || length > maxSize {
+		return nil
+	}
+	return &heldResponse{statusCode: statusCode, header: maps.Clone(h), length: length, dst: dst}
+}
+
+// release sends the held response again, or the 304 or 412 replacing it.
+func (c *Conditional) release(w *response.Writer, req *request.Request, held *heldResponse) {
+	h := held.header
+	body := held.body.Bytes()
+	etag := h["etag"]
+	// A HEAD handler may leave out the body, which then can't be hashed
+	if etag == "" && int64(len(body)) == held.length {
+		if c.Weak {
+			etag = WeakETag(body)
+		} else {
+			etag = ETag(body)
+		}
+		h.Set("ETag", etag)
+	}
+	modtime, _ := http.ParseTime(h["last-modified"])
+
+	if etag != "" || knownTime(modtime) {
+		switch checkPreconditions(req, etag, modtime) {
+		case response.StatusNotModified:
+			writeNotModified(w, h)
+			return
+		case response.StatusPreconditionFailed:
+			writePreconditionFailed(w)
+			return
+		}
+	}
+	w.WriteStatusLine(held.statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// heldResponse is the body encoder keeping a response back for Conditional.
+// If the response can't be reset after all, closing it writes the body out.
+type heldResponse struct {
+	statusCode response.StatusCode
+	header     headers.Headers
+	length     int64
+	body       bytes.Buffer
+	dst        io.Writer
+}
+
+func (r *heldResponse) Write(p []byte) (int, error) {
+	if int64(r.body.Len()+len(p)) > r.length {
+		return 0, response.ErrContentLength
+	}
+	return r.body.Write(p)
+}
+
+func (r *heldResponse) Close() error {
+	_, err := r.dst.Write(r.body.Bytes())
+	return err
+}
@@ -0,0 +1,218 @@
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/compress"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETag(t *testing.T) {
+	etag := ETag([]byte(alphabet))
+	assert.True(t, strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`))
+	assert.Equal(t, etag, ETag([]byte(alphabet)))
+	assert.NotEqual(t, etag, ETag([]byte(alphabet[1:])))
+	assert.Equal(t, "W/"+etag, WeakETag([]byte(alphabet)))
+}
+
+func TestMatchETag(t *testing.T) {
+	assert.True(t, matchETag(`"a", "b"`, `"b"`, true))
+	assert.True(t, matchETag(`*`, `"b"`, true))
+	assert.True(t, matchETag(`W/"b"`, `"b"`, false))
+	assert.True(t, matchETag(`"b"`, `W/"b"`, false))
+	assert.False(t, matchETag(`W/"b"`, `"b"`, true))
+	assert.False(t, matchETag(`"b"`, `W/"b"`, true))
+	assert.True(t, matchETag(`"a,b", "c"`, `"c"`, false))
+	assert.False(t, matchETag(`"a,b"`, `"a"`, false))
+	assert.False(t, matchETag(`"a`, `"a"`, false))
+	assert.False(t, matchETag(`"a"`, ``, false))
+}
+
+func TestServePreconditions(t *testing.T) {
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	before := "Wed, 01 May 2024 11:00:00 GMT"
+	same := "Wed, 01 May 2024 12:00:00 GMT"
+
+	tests := []struct {
+		name   string
+		method string
+		fields []string
+		status response.StatusCode
+	}{
+		{"If-None-Match match", "GET", []string{"If-None-Match", `"v0", "v1"`}, response.StatusNotModified},
+		{"If-None-Match weak match", "HEAD", []string{"If-None-Match", `W/"v1"`}, response.StatusNotModified},
+		{"If-None-Match star", "GET", []string{"If-None-Match", "*"}, response.StatusNotModified},
+		{"If-None-Match no match", "GET", []string{"If-None-Match", `"v0"`}, response.StatusOK},
+		{"If-None-Match unsafe method", "DELETE", []string{"If-None-Match", `"v1"`}, response.StatusPreconditionFailed},
+		{"If-Modified-Since unchanged", "GET", []string{"If-Modified-Since", same}, response.StatusNotModified},
+		{"If-Modified-Since changed", "GET", []string{"If-Modified-Since", before}, response.StatusOK},
+		{"If-Modified-Since invalid", "GET", []string{"If-Modified-Since", "yesterday"}, response.StatusOK},
+		{"If-None-Match wins over If-Modified-Since", "GET", []string{"If-None-Match", `"v0"`, "If-Modified-Since", same}, response.StatusOK},
+		{"If-Match match", "GET", []string{"If-Match", `"v1"`}, response.StatusOK},
+		{"If-Match no match", "GET", []string{"If-Match", `"v0"`}, response.StatusPreconditionFailed},
+		{"If-Match weak", "GET", []string{"If-Match", `W/"v1"`}, response.StatusPreconditionFailed},
+		{"If-Unmodified-Since changed", "GET", []string{"If-Unmodified-Since", before}, response.StatusPreconditionFailed},
+		{"If-Unmodified-Since unchanged", "GET", []string{"If-Unmodified-Since", same}, response.StatusOK},
+		{"If-Match wins over If-Unmodified-Since", "GET", []string{"If-Match", `"v1"`, "If-Unmodified-Since", before}, response.StatusOK},
+		{"If-Match before If-None-Match", "GET", []string{"If-Match", `"v0"`, "If-None-Match", `"v1"`}, response.StatusPreconditionFailed},
+		{"Preconditions before Range", "GET", []string{"If-None-Match", `"v1"`, "Range", "bytes=0-1"}, response.StatusNotModified},
+	}
+	for _, tt := range tests {
+		resp := serveContent(t, tt.method, "letters.txt", modtime, alphabet, tt.fields...)
+		assert.Equal(t, tt.status, resp.StatusLine.StatusCode, tt.name)
+		switch tt.status {
+		case response.StatusNotModified:
+			assert.Equal(t, `"v1"`, resp.Headers["etag"], tt.name)
+			assert.Equal(t, same, resp.Headers["last-modified"], tt.name)
+			assert.NotContains(t, resp.Headers, "content-type", tt.name)
+			assert.NotContains(t, resp.Headers, "content-length", tt.name)
+			assert.Empty(t, resp.Body, tt.name)
+		case response.StatusPreconditionFailed:
+			assert.NotContains(t, resp.Headers, "etag", tt.name)
+		}
+	}
+
+	// Test: ServeBytes computes a strong ETag
+	req, err := request.NewBuilder("GET", "/letters.txt").Build()
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	ServeBytes(w, req, "letters.txt", modtime, []byte(alphabet))
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	assert.Equal(t, ETag([]byte(alphabet)), resp.Headers["etag"])
+	assert.Equal(t, alphabet, string(resp.Body))
+}
+
+func pageHandler(statusCode response.StatusCode, body string, fields ...string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Overwrite("Content-Type", "text/html")
+		for i := 0; i+1 < len(fields); i += 2 {
+			h.Overwrite(fields[i], fields[i+1])
+		}
+		w.WriteStatusLine(statusCode)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func serveHandler(t *testing.T, handler server.Handler, method string, fields ...string) *response.Response {
+	b := request.NewBuilder(method, "/")
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.Header(fields[i], fields[i+1])
+	}
+	req, err := b.Build()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestConditional(t *testing.T) {
+	page := "<h1>Success!</h1>"
+	etag := ETag([]byte(page))
+	c := NewConditional(pageHandler(response.StatusOK, page))
+
+	// Test: The ETag is computed from the body
+	resp := serveHandler(t, c.Serve, "GET")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, etag, resp.Headers["etag"])
+	assert.Equal(t, strconv.Itoa(len(page)), resp.Headers["content-length"])
+	assert.Equal(t, page, string(resp.Body))
+
+	// Test: And validated
+	resp = serveHandler(t, c.Serve, "GET", "If-None-Match", etag)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	assert.Equal(t, etag, resp.Headers["etag"])
+	assert.NotContains(t, resp.Headers, "content-length")
+	assert.Empty(t, resp.Body)
+	resp = serveHandler(t, c.Serve, "HEAD", "If-None-Match", etag)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	resp = serveHandler(t, c.Serve, "GET", "If-Match", `"stale"`)
+	assert.Equal(t, response.StatusPreconditionFailed, resp.StatusLine.StatusCode)
+
+	// Test: Weak tags
+	c.Weak = true
+	resp = serveHandler(t, c.Serve, "GET", "If-None-Match", etag)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	assert.Equal(t, "W/"+etag, resp.Headers["etag"])
+	c.Weak = false
+
+	// Test: Validators set by the handler are used
+	lastModified := "Wed, 01 May 2024 12:00:00 GMT"
+	c.Next = pageHandler(response.StatusOK, page, "ETag", `"v1"`, "Last-Modified", lastModified)
+	resp = serveHandler(t, c.Serve, "GET", "If-None-Match", `"v1"`)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	resp = serveHandler(t, c.Serve, "GET", "If-Modified-Since", lastModified)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+
+	// Test: Responses that aren't held back pass through
+	passThrough := map[string]*Conditional{
+		"too large": {Next: pageHandler(response.StatusOK, page), MaxSize: int64(len(page) - 1)},
+		"not found": NewConditional(pageHandler(response.StatusNotFound, page)),
+		"streamed": NewConditional(func(w *response.Writer, req *request.Request) {
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(page))
+		}),
+	}
+	for name, c := range passThrough {
+		resp = serveHandler(t, c.Serve, "GET", "If-None-Match", etag)
+		assert.NotEqual(t, response.StatusNotModified, resp.StatusLine.StatusCode, name)
+		assert.NotContains(t, resp.Headers, "etag", name)
+		assert.Equal(t, page, string(resp.Body), name)
+	}
+	resp = serveHandler(t, c.Serve, "POST", "If-None-Match", `"v1"`)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+
+	// Test: A response flushed by the handler is sent unchanged
+	c.Next = func(w *response.Writer, req *request.Request) {
+		pageHandler(response.StatusOK, page)(w, req)
+		w.Flush()
+	}
+	resp = serveHandler(t, c.Serve, "GET", "If-None-Match", etag)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, page, string(resp.Body))
+}
+
+func TestConditionalCompressed(t *testing.T) {
+	page := strings.Repeat("<p>Your request was an absolute banger.</p>\n", 50)
+	handler := compress.New(NewConditional(pageHandler(response.StatusOK, page)).Serve).Serve
+	etag := ETag([]byte(page))
+
+	// Test: The ETag of the uncompressed body is weakened by compression
+	resp := serveHandler(t, handler, "GET", "Accept-Encoding", "gzip")
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	assert.Equal(t, "W/"+etag, resp.Headers["etag"])
+	r, err := gzip.NewReader(bytes.NewReader(resp.Body))
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(data))
+
+	// Test: And still matches
+	resp = serveHandler(t, handler, "GET", "Accept-Encoding", "gzip", "If-None-Match", "W/"+etag)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	assert.Empty(t, resp.Body)
+}
@@ -0,0 +1,328 @@
+package content
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/negotiate"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+const indexPage = "index.html"
+
+// Dir is the file system rooted at a directory of the host. Unlike
+// os.DirFS it refuses to open files through symbolic links that lead outside
+// of the directory.
+type Dir string
+
+func (d Dir) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.Abs(string(d))
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	if !within(root, resolved) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !sameFile(f, root, resolved) {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f, nil
+}
+
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// sameFile reports whether f, opened at resolved, is the file resolved still
+// leads to inside root. A symbolic link swapped into the path between
+// resolving and opening it could have led the open outside of root.
+func sameFile(f *os.File, root, resolved string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	again, err := filepath.EvalSymlinks(resolved)
+	if err != nil || !within(root, again) {
+		return false
+	}
+	current, err := os.Stat(again)
+	return err == nil && os.SameFile(opened, current)
+}
+
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// FileServer serves the files of Root. The request path, less Prefix, is
+// cleaned before it is looked up, so it can't climb out of Root, and paths
+// with a segment starting with a dot are not found unless Dotfiles is set.
+// A directory is served through its index.html or, with Listing, as a list
+// of its entries. When the client accepts gzip and a file has a "name.gz"
+// sibling, that is sent instead with Content-Encoding: gzip. Files are
+// served with Serve, so Range and the preconditions of the request are
+// honoured, with an ETag derived from the modification time and size or,
+// where the file system has no modification times, from the content.
+type FileServer struct {
+	Root fs.FS
+	// Prefix is removed from the request path, e.g. "/assets" when the
+	// server handles the paths below it
+	Prefix string
+	// Listing renders directories without an index.html as HTML lists
+	Listing bool
+	// Dotfiles makes files and directories starting with a dot visible
+	Dotfiles bool
+}
+
+func NewFileServer(root fs.FS) *FileServer {
+	return &FileServer{Root: root}
+}
+
+func (s *FileServer) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		response.WriteError(w, response.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	urlPath, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	urlPath, err := url.PathUnescape(urlPath)
+	if err != nil || !strings.HasPrefix(urlPath, "/") || strings.ContainsAny(urlPath, "\x00\\") {
+		response.WriteError(w, response.StatusBadRequest, "Invalid path")
+		return
+	}
+	urlPath, ok := strings.CutPrefix(urlPath, s.Prefix)
+	if !ok || (urlPath != "" && !strings.HasPrefix(urlPath, "/")) {
+		response.WriteError(w, response.StatusNotFound, "Not found")
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	if !s.Dotfiles && hasDotSegment(name) {
+		response.WriteError(w, response.StatusNotFound, "Not found")
+		return
+	}
+
+	file, err := s.Root.Open(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+
+	// Relative links in a directory page only work below a trailing slash,
+	// and a file is only found without one
+	if info.IsDir() != strings.HasSuffix(urlPath, "/") {
+		// Built from the cleaned path, so "//host" can't turn into a
+		// redirect to another site
+		target := path.Join("/", s.Prefix, name)
+		if info.IsDir() && target != "/" {
+			target += "/"
+		}
+		target = (&url.URL{Path: target}).EscapedPath()
+		if query != "" {
+			target += "?" + query
+		}
+		w.Header().Set("Location", target)
+		response.WriteError(w, response.StatusMovedPermanently, "Moved permanently")
+		return
+	}
+
+	if info.IsDir() {
+		index, err := s.Root.Open(path.Join(name, indexPage))
+		if err != nil {
+			s.serveDir(w, req, name, file, info)
+			return
+		}
+		defer index.Close()
+		file, name = index, path.Join(name, indexPage)
+		if info, err = index.Stat(); err != nil || info.IsDir() {
+			response.WriteError(w, response.StatusForbidden, "Forbidden")
+			return
+		}
+	}
+	if !info.Mode().IsRegular() {
+		response.WriteError(w, response.StatusForbidden, "Forbidden")
+		return
+	}
+	s.serveFile(w, req, name, file, info)
+}
+
+// serveFile serves a regular file, or its precompressed sibling.
+func (s *FileServer) serveFile(w *response.Writer, req *request.Request, name string, file fs.File, info fs.FileInfo) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType != "" {
+		gz, gzInfo := s.openGzip(name)
+		if gz != nil {
+			defer gz.Close()
+			// The response depends on Accept-Encoding from now on, even when
+			// the gzip file isn't used
+			w.Header().Set("Vary", "Accept-Encoding")
+			if _, err := req.Headers.Get("Accept-Encoding"); err == nil && negotiate.Encoding(req.Headers, "gzip", "identity") == "gzip" {
+				w.Header().Set("Content-Encoding", "gzip")
+				file, info = gz, gzInfo
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	content, err := readSeeker(file)
+	if err != nil {
+		response.WriteError(w, response.StatusInternalServerError, "Can't read file")
+		return
+	}
+	etag, err := fileETag(info, content)
+	if err != nil {
+		response.WriteError(w, response.StatusInternalServerError, "Can't read file")
+		return
+	}
+	w.Header().Set("ETag", etag)
+	Serve(w, req, name, info.ModTime(), content)
+}
+
+// openGzip opens the "name.gz" sibling of name, if it is a regular file.
+func (s *FileServer) openGzip(name string) (fs.File, fs.FileInfo) {
+	gz, err := s.Root.Open(name + ".gz")
+	if err != nil {
+		return nil, nil
+	}
+	info, err := gz.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		gz.Close()
+		return nil, nil
+	}
+	return gz, info
+}
+
+// serveDir answers with a listing of dir, or 403 without Listing.
+func (s *FileServer) serveDir(w *response.Writer, req *request.Request, name string, dir fs.File, info fs.FileInfo) {
+	rd, ok := dir.(fs.ReadDirFile)
+	if !s.Listing || !ok {
+		response.WriteError(w, response.StatusForbidden, "Forbidden")
+		return
+	}
+	entries, err := rd.ReadDir(-1)
+	if err != nil {
+		response.WriteError(w, response.StatusInternalServerError, "Can't read directory")
+		return
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	title := html.EscapeString("/" + strings.TrimPrefix(path.Join(strings.TrimPrefix(s.Prefix, "/"), name), "."))
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Index of %s</title>\n</head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	if name != "." {
+		buf.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if !s.Dotfiles && strings.HasPrefix(entryName, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		if strings.Contains(entryName, ":") {
+			// Keep a name like "a:b" from being read as a scheme
+			href = "./" + href
+		}
+		fmt.Fprintf(buf, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	buf.WriteString("</ul>\n</body>\n</html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ServeBytes(w, req, "", info.ModTime(), buf.Bytes())
+}
+
+// fileETag derives an entity tag from the modification time and size of a
+// file, or hashes its content when the modification time isn't known, as
+// for an embed.FS.
+func fileETag(info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if knownTime(info.ModTime()) {
+		return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36) + `"`, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hashETag(hash.Sum(nil)), nil
+}
+
+// readSeeker returns file as an io.ReadSeeker, reading it into memory if the
+// file system doesn't provide one.
+func readSeeker(file fs.File) (io.ReadSeeker, error) {
+	if rs, ok := file.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFSError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		response.WriteError(w, response.StatusNotFound, "Not found")
+	case errors.Is(err, fs.ErrPermission):
+		response.WriteError(w, response.StatusForbidden, "Forbidden")
+	default:
+		response.WriteError(w, response.StatusInternalServerError, "Can't open file")
+	}
+}
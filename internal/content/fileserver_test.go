@@ -0,0 +1,192 @@
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func serveTarget(t *testing.T, s *FileServer, method, target string, fields ...string) *response.Response {
+	b := request.NewBuilder(method, target)
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.Header(fields[i], fields[i+1])
+	}
+	req, err := b.Build()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	s.Serve(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestFileServer(t *testing.T) {
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	root := fstest.MapFS{
+		"index.html":     {Data: []byte("<h1>home</h1>"), ModTime: modtime},
+		"letters.txt":    {Data: []byte(alphabet), ModTime: modtime},
+		"letters.txt.gz": {Data: gzipped(t, alphabet), ModTime: modtime},
+		"docs/a & b.txt": {Data: []byte("a and b")},
+		"docs/notes":     {Data: []byte("<!DOCTYPE html><p>notes</p>")},
+		"docs/.secret":   {Data: []byte("hunter2")},
+		".git/config":    {Data: []byte("[core]")},
+		"empty/.keep":    {Data: []byte{}},
+	}
+	s := NewFileServer(root)
+
+	// Test: Files with their type, validators and ranges
+	resp := serveTarget(t, s, "GET", "/")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", string(resp.Body))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["content-type"])
+	resp = serveTarget(t, s, "GET", "/letters.txt")
+	assert.Equal(t, alphabet, string(resp.Body))
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Headers["last-modified"])
+	assert.Contains(t, resp.Headers, "etag")
+	assert.Equal(t, "Accept-Encoding", resp.Headers["vary"])
+	etag := resp.Headers["etag"]
+	resp = serveTarget(t, s, "GET", "/letters.txt", "If-None-Match", etag)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	resp = serveTarget(t, s, "GET", "/letters.txt", "Range", "bytes=0-2")
+	assert.Equal(t, response.StatusPartialContent, resp.StatusLine.StatusCode)
+	assert.Equal(t, "abc", string(resp.Body))
+
+	// Test: Content is sniffed without a known extension, and hashed for
+	// the ETag without a modification time
+	resp = serveTarget(t, s, "GET", "/docs/notes")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["content-type"])
+	assert.Equal(t, ETag([]byte("<!DOCTYPE html><p>notes</p>")), resp.Headers["etag"])
+	resp = serveTarget(t, s, "GET", "/docs/a%20&%20b.txt")
+	assert.Equal(t, "a and b", string(resp.Body))
+
+	// Test: The precompressed file when gzip is accepted
+	resp = serveTarget(t, s, "GET", "/letters.txt", "Accept-Encoding", "gzip")
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Headers["content-type"])
+	assert.NotEqual(t, etag, resp.Headers["etag"])
+	assert.Equal(t, gzipped(t, alphabet), resp.Body)
+	resp = serveTarget(t, s, "GET", "/letters.txt", "Accept-Encoding", "gzip;q=0")
+	assert.NotContains(t, resp.Headers, "content-encoding")
+
+	// Test: Traversal, dotfiles and missing files
+	for _, target := range []string{"/docs/../../etc/passwd", "/%2e%2e/%2e%2e/etc/passwd", "/..%2f..%2fetc/passwd"} {
+		resp = serveTarget(t, s, "GET", target)
+		assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode, target)
+	}
+	for _, target := range []string{"/../letters.txt", "/docs/../letters.txt", "//letters.txt"} {
+		resp = serveTarget(t, s, "GET", target)
+		assert.Equal(t, alphabet, string(resp.Body), target)
+	}
+	for _, target := range []string{"/.git/config", "/docs/.secret", "/missing.txt"} {
+		resp = serveTarget(t, s, "GET", target)
+		assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode, target)
+	}
+	resp = serveTarget(t, s, "GET", "/a\\b")
+	assert.Equal(t, response.StatusBadRequest, resp.StatusLine.StatusCode)
+
+	// Test: Redirects to and from the trailing slash
+	resp = serveTarget(t, s, "GET", "/docs?sort=name")
+	assert.Equal(t, response.StatusMovedPermanently, resp.StatusLine.StatusCode)
+	assert.Equal(t, "/docs/?sort=name", resp.Headers["location"])
+	resp = serveTarget(t, s, "GET", "/letters.txt/")
+	assert.Equal(t, "/letters.txt", resp.Headers["location"])
+	resp = serveTarget(t, s, "GET", "//docs")
+	assert.Equal(t, "/docs/", resp.Headers["location"])
+
+	// Test: Directories without an index
+	resp = serveTarget(t, s, "GET", "/docs/")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+	s.Listing = true
+	resp = serveTarget(t, s, "GET", "/docs/")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["content-type"])
+	assert.Contains(t, string(resp.Body), `<a href="a%20&amp;%20b.txt">a &amp; b.txt</a>`)
+	assert.Contains(t, string(resp.Body), `<a href="notes">notes</a>`)
+	assert.NotContains(t, string(resp.Body), ".secret")
+	s.Dotfiles = true
+	resp = serveTarget(t, s, "GET", "/docs/.secret")
+	assert.Equal(t, "hunter2", string(resp.Body))
+
+	// Test: Only GET and HEAD
+	resp = serveTarget(t, s, "POST", "/letters.txt")
+	assert.Equal(t, response.StatusMethodNotAllowed, resp.StatusLine.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Headers["allow"])
+	resp = serveTarget(t, s, "HEAD", "/letters.txt")
+	assert.Equal(t, "26", resp.Headers["content-length"])
+	assert.Empty(t, resp.Body)
+
+	// Test: Prefix
+	s = &FileServer{Root: root, Prefix: "/assets"}
+	resp = serveTarget(t, s, "GET", "/assets/letters.txt")
+	assert.Equal(t, alphabet, string(resp.Body))
+	resp = serveTarget(t, s, "GET", "/assets")
+	assert.Equal(t, "/assets/", resp.Headers["location"])
+	resp = serveTarget(t, s, "GET", "/assetsletters.txt")
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+}
+
+func TestDir(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sub", "inside.txt"), []byte("inside"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "outside.txt"), []byte("outside"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(root, "sub", "inside.txt"), filepath.Join(root, "link.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(tmp, "outside.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink(tmp, filepath.Join(root, "up")))
+	s := NewFileServer(Dir(root))
+
+	// Test: Symbolic links are followed inside the root only
+	resp := serveTarget(t, s, "GET", "/link.txt")
+	assert.Equal(t, "inside", string(resp.Body))
+	for _, target := range []string{"/escape.txt", "/up/outside.txt"} {
+		resp = serveTarget(t, s, "GET", target)
+		assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode, target)
+		assert.False(t, strings.Contains(string(resp.Body), "outside"), target)
+	}
+	resp = serveTarget(t, s, "GET", "/sub/inside.txt")
+	assert.Equal(t, "inside", string(resp.Body))
+	resp = serveTarget(t, s, "GET", "/nothing")
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+
+	// Test: A link swapped into the path while it's opened is noticed
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "elsewhere"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "elsewhere", "inside.txt"), []byte("outside"), 0o644))
+	resolved := filepath.Join(root, "sub", "inside.txt")
+	f, err := os.Open(resolved)
+	require.NoError(t, err)
+	assert.True(t, sameFile(f, root, resolved))
+	f.Close()
+	require.NoError(t, os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "real")))
+	require.NoError(t, os.Symlink(filepath.Join(tmp, "elsewhere"), filepath.Join(root, "sub")))
+	f, err = os.Open(resolved)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.False(t, sameFile(f, root, resolved))
+	require.NoError(t, os.Remove(filepath.Join(root, "sub")))
+	require.NoError(t, os.Rename(filepath.Join(root, "real"), filepath.Join(root, "sub")))
+	assert.False(t, sameFile(f, root, resolved))
+}
@@ -0,0 +1,101 @@
+package content
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidRange       = errors.New("invalid range")
+	ErrUnsatisfiableRange = errors.New("no satisfiable range")
+)
+
+// ByteRange is a part of a representation, Length bytes from Start.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats the range for a Content-Range header.
+func (r ByteRange) ContentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(r.Start, 10) + "-" + strconv.FormatInt(r.Start+r.Length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// ParseRange parses a Range header (RFC 9110 section 14.1.2) for a
+// representation of size bytes. It handles lists of first-last, first- and
+// -suffix ranges, clamping them to the representation, and drops the ones
+// starting past its end. ErrInvalidRange means the header should be ignored
+// and ErrUnsatisfiableRange that none of the ranges can be served.
+func ParseRange(header string, size int64) ([]ByteRange, error) {
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, ErrInvalidRange
+	}
+	var ranges []ByteRange
+	empty := true
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		empty = false
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, ErrInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r ByteRange
+		if first == "" {
+			// A suffix range is the last bytes of the representation
+			suffix, err := parsePos(last)
+			if err != nil {
+				return nil, err
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			suffix = min(suffix, size)
+			r = ByteRange{Start: size - suffix, Length: suffix}
+		} else {
+			start, err := parsePos(first)
+			if err != nil {
+				return nil, err
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = parsePos(last); err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, ErrInvalidRange
+				}
+			}
+			if start >= size {
+				continue
+			}
+			end = min(end, size-1)
+			r = ByteRange{Start: start, Length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if empty {
+		return nil, ErrInvalidRange
+	}
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+func parsePos(s string) (int64, error) {
+	if s == "" || strings.ContainsAny(s, "+-") {
+		return 0, ErrInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidRange
+	}
+	return n, nil
+}
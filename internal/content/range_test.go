@@ -0,0 +1,46 @@
+package content
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	// Test: Single and multiple ranges
+	ranges, err := ParseRange("bytes=0-499", 10000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{Start: 0, Length: 500}}, ranges)
+	ranges, err = ParseRange("bytes=0-0, 500-999 ,9500-", 10000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{0, 1}, {500, 500}, {9500, 500}}, ranges)
+
+	// Test: Suffix ranges
+	ranges, err = ParseRange("bytes=-500", 10000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{9500, 500}}, ranges)
+	ranges, err = ParseRange("bytes=-20000", 10000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{0, 10000}}, ranges)
+
+	// Test: Ranges are clamped and ones past the end dropped
+	ranges, err = ParseRange("bytes=9000-20000, 10000-10500", 10000)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{9000, 1000}}, ranges)
+	assert.Equal(t, "bytes 9000-9999/10000", ranges[0].ContentRange(10000))
+
+	// Test: Unsatisfiable
+	for _, header := range []string{"bytes=10000-", "bytes=-0", "bytes=20000-30000, 10000-"} {
+		_, err = ParseRange(header, 10000)
+		assert.ErrorIs(t, err, ErrUnsatisfiableRange, header)
+	}
+	_, err = ParseRange("bytes=0-", 0)
+	assert.ErrorIs(t, err, ErrUnsatisfiableRange)
+
+	// Test: Invalid
+	for _, header := range []string{"bytes=", "items=0-5", "bytes=5-1", "bytes=a-b", "bytes=0", "bytes=+1-2", "bytes=--5", "0-5"} {
+		_, err = ParseRange(header, 10000)
+		assert.ErrorIs(t, err, ErrInvalidRange, header)
+	}
+}
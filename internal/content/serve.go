@@ -0,0 +1,221 @@
+// Package content serves representations backed by an io.ReadSeeker, with
+// support for range and conditional requests.
+package content
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// sniffLen is how much of the content http.DetectContentType looks at.
+const sniffLen = 512
+
+// Serve answers req with content, honouring the preconditions of the
+// request (see CheckPreconditions) as well as Range and If-Range. Fields
+// already set in w.Header() are kept, so a caller can set Content-Type or
+// ETag itself; otherwise the Content-Type is derived from the extension of
+// name or sniffed from the content. A non-zero modtime is sent as
+// Last-Modified.
+//
+// Ranges are only served for GET and HEAD. A single range is answered with
+// 206 and Content-Range, several with a multipart/byteranges body, and a
+// Range none of whose ranges is satisfiable with 416. When the ranges add up
+// to more than the whole representation the full content is sent instead.
+func Serve(w *response.Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		response.WriteError(w, response.StatusInternalServerError, "Can't read content")
+		return
+	}
+
+	h := w.Header()
+	if _, err := h.Get("Content-Type"); err != nil {
+		contentType, err := detectContentType(name, content)
+		if err != nil {
+			response.WriteError(w, response.StatusInternalServerError, "Can't read content")
+			return
+		}
+		h.Set("Content-Type", contentType)
+	}
+	if knownTime(modtime) {
+		h.Overwrite("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	h.Overwrite("Accept-Ranges", "bytes")
+	if CheckPreconditions(w, req, modtime) {
+		return
+	}
+
+	ranges, err := requestedRanges(req, h, modtime, size)
+	if errors.Is(err, ErrUnsatisfiableRange) {
+		h.Overwrite("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		response.WriteError(w, response.StatusRangeNotSatisfiable, "Range not satisfiable")
+		return
+	}
+
+	headOnly := req.RequestLine.Method == "HEAD"
+	switch len(ranges) {
+	case 0:
+		h.Overwrite("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(nil)
+		if !headOnly {
+			copyRange(w, content, ByteRange{Start: 0, Length: size})
+		}
+	case 1:
+		h.Overwrite("Content-Range", ranges[0].ContentRange(size))
+		h.Overwrite("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		w.WriteStatusLine(response.StatusPartialContent)
+		w.WriteHeaders(nil)
+		if !headOnly {
+			copyRange(w, content, ranges[0])
+		}
+	default:
+		serveMultipart(w, content, ranges, size, headOnly)
+	}
+}
+
+// requestedRanges returns the ranges to serve, none meaning the whole
+// content.
+func requestedRanges(req *request.Request, h headers.Headers, modtime time.Time, size int64) ([]ByteRange, error) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		return nil, nil
+	}
+	header, err := req.Headers.Get("Range")
+	if err != nil || !ifRangeMatches(req, h["etag"], modtime) {
+		return nil, nil
+	}
+	ranges, err := ParseRange(header, size)
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableRange) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches evaluates If-Range (RFC 9110 section 13.1.5), which only
+// lets the Range through while the representation is unchanged. An entity
+// tag must match strongly and a date exactly.
+func ifRangeMatches(req *request.Request, etag string, modtime time.Time) bool {
+	value, err := req.Headers.Get("If-Range")
+	if err != nil {
+		return true
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && value == etag
+	}
+	date, err := http.ParseTime(value)
+	return err == nil && !modtime.IsZero() && modtime.Truncate(time.Second).Equal(date)
+}
+
+func serveMultipart(w *response.Writer, content io.ReadSeeker, ranges []ByteRange, size int64, headOnly bool) {
+	h := w.Header()
+	contentType := h["content-type"]
+	partHeader := func(r ByteRange) textproto.MIMEHeader {
+		part := textproto.MIMEHeader{}
+		if contentType != "" {
+			part.Set("Content-Type", contentType)
+		}
+		part.Set("Content-Range", r.ContentRange(size))
+		return part
+	}
+
+	// The length is known up front by laying out the parts without their
+	// data
+	counter := &countingWriter{}
+	mw := multipart.NewWriter(counter)
+	for _, r := range ranges {
+		mw.CreatePart(partHeader(r))
+		counter.n += r.Length
+	}
+	mw.Close()
+
+	h.Overwrite("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	h.Overwrite("Content-Length", strconv.FormatInt(counter.n, 10))
+	w.WriteStatusLine(response.StatusPartialContent)
+	w.WriteHeaders(nil)
+	if headOnly {
+		return
+	}
+
+	body := multipart.NewWriter(response.NewResponseWriter(w))
+	body.SetBoundary(mw.Boundary())
+	for _, r := range ranges {
+		part, err := body.CreatePart(partHeader(r))
+		if err == nil {
+			err = copyPart(part, content, r)
+		}
+		if err != nil {
+			w.Abort()
+			return
+		}
+	}
+	if err := body.Close(); err != nil {
+		w.Abort()
+	}
+}
+
+// copyRange writes r of content as the body of w, aborting the response
+// when that fails part way.
+func copyRange(w *response.Writer, content io.ReadSeeker, r ByteRange) {
+	if err := copyPart(response.NewResponseWriter(w), content, r); err != nil {
+		w.Abort()
+	}
+}
+
+func copyPart(dst io.Writer, content io.ReadSeeker, r ByteRange) error {
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, content, r.Length)
+	return err
+}
+
+func detectContentType(name string, content io.ReadSeeker) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,121 @@
+package content
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alphabet = "abcdefghijklmnopqrstuvwxyz"
+
+func serveContent(t *testing.T, method, name string, modtime time.Time, content string, fields ...string) *response.Response {
+	b := request.NewBuilder(method, "/"+name)
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.Header(fields[i], fields[i+1])
+	}
+	req, err := b.Build()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	w.Header().Set("ETag", `"v1"`)
+	Serve(w, req, name, modtime, strings.NewReader(content))
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestServe(t *testing.T) {
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Test: Full content
+	resp := serveContent(t, "GET", "letters.txt", modtime, alphabet)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, alphabet, string(resp.Body))
+	assert.Equal(t, "bytes", resp.Headers["accept-ranges"])
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Headers["last-modified"])
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Headers["content-type"])
+
+	// Test: Content type is sniffed without a known extension
+	resp = serveContent(t, "GET", "page", modtime, "<!DOCTYPE html><html></html>")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["content-type"])
+	assert.Equal(t, "<!DOCTYPE html><html></html>", string(resp.Body))
+
+	// Test: A single range
+	resp = serveContent(t, "GET", "letters.txt", modtime, alphabet, "Range", "bytes=2-4")
+	assert.Equal(t, response.StatusPartialContent, resp.StatusLine.StatusCode)
+	assert.Equal(t, "bytes 2-4/26", resp.Headers["content-range"])
+	assert.Equal(t, "3", resp.Headers["content-length"])
+	assert.Equal(t, "cde", string(resp.Body))
+	resp = serveContent(t, "GET", "letters.txt", modtime, alphabet, "Range", "bytes=-3")
+	assert.Equal(t, "xyz", string(resp.Body))
+
+	// Test: HEAD gets the headers of the range
+	resp = serveContent(t, "HEAD", "letters.txt", modtime, alphabet, "Range", "bytes=2-4")
+	assert.Equal(t, response.StatusPartialContent, resp.StatusLine.StatusCode)
+	assert.Equal(t, "3", resp.Headers["content-length"])
+	assert.Empty(t, resp.Body)
+
+	// Test: Several ranges are sent as multipart/byteranges
+	resp = serveContent(t, "GET", "letters.txt", modtime, alphabet, "Range", "bytes=0-1, 24-")
+	assert.Equal(t, response.StatusPartialContent, resp.StatusLine.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Headers["content-type"])
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	assert.Equal(t, strconv.Itoa(len(resp.Body)), resp.Headers["content-length"])
+	mr := multipart.NewReader(bytes.NewReader(resp.Body), params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+	}
+	assert.Equal(t, []string{"bytes 0-1/26 ab", "bytes 24-25/26 yz"}, parts)
+
+	// Test: Unsatisfiable ranges
+	resp = serveContent(t, "GET", "letters.txt", modtime, alphabet, "Range", "bytes=30-")
+	assert.Equal(t, response.StatusRangeNotSatisfiable, resp.StatusLine.StatusCode)
+	assert.Equal(t, "bytes */26", resp.Headers["content-range"])
+
+	// Test: Invalid and overlapping ranges get the whole content
+	for _, header := range []string{"bytes=z-", "bytes=0-20, 5-25"} {
+		resp = serveContent(t, "GET", "letters.txt", modtime, alphabet, "Range", header)
+		assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode, header)
+		assert.Equal(t, alphabet, string(resp.Body), header)
+	}
+
+	// Test: Ranges are ignored for other methods
+	resp = serveContent(t, "POST", "letters.txt", modtime, alphabet, "Range", "bytes=0-1")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+
+	// Test: If-Range only lets the range through for the current version
+	ifRange := map[string]response.StatusCode{
+		`"v1"`:                          response.StatusPartialContent,
+		`"v0"`:                          response.StatusOK,
+		`W/"v1"`:                        response.StatusOK,
+		"Wed, 01 May 2024 12:00:00 GMT": response.StatusPartialContent,
+		"Wed, 01 May 2024 11:00:00 GMT": response.StatusOK,
+	}
+	for value, status := range ifRange {
+		resp = serveContent(t, "GET", "letters.txt", modtime, alphabet, "Range", "bytes=0-1", "If-Range", value)
+		assert.Equal(t, status, resp.StatusLine.StatusCode, value)
+	}
+}
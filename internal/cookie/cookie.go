@@ -0,0 +1,222 @@
+// Package cookie parses the Cookie header of requests and builds Set-Cookie
+// headers for responses (RFC 6265).
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+)
+
+// SameSite is the SameSite attribute of a cookie.
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out, letting the browser decide
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+var (
+	ErrInvalidName  = errors.New("invalid cookie name")
+	ErrInvalidValue = errors.New("invalid cookie value")
+)
+
+// Cookie is a cookie as sent in a Cookie header, where only Name and Value
+// are set, or in a Set-Cookie header.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path   string
+	Domain string
+	// Expires is left out when zero
+	Expires time.Time
+	// MaxAge is left out when zero. A negative MaxAge is sent as Max-Age=0,
+	// which makes the browser delete the cookie right away.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parse splits the value of a Cookie header into its name-value pairs.
+// Pairs whose name or value isn't valid are skipped, and double quotes around
+// a value are removed.
+func Parse(header string) []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(header, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !validName(name) || !validValue(value) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// Valid checks that the cookie can be sent in a Set-Cookie header and that
+// its attributes are consistent: SameSite=None and Partitioned need Secure,
+// and so do the "__Secure-" and "__Host-" name prefixes, the latter also
+// requiring Path=/ and no Domain.
+func (c *Cookie) Valid() error {
+	if !validName(c.Name) {
+		return fmt.Errorf("%w %q", ErrInvalidName, c.Name)
+	}
+	if !validValue(c.Value) {
+		return fmt.Errorf("%w for %s", ErrInvalidValue, c.Name)
+	}
+	if !validPath(c.Path) {
+		return fmt.Errorf("invalid path %q for cookie %s", c.Path, c.Name)
+	}
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return fmt.Errorf("invalid domain %q for cookie %s", c.Domain, c.Name)
+	}
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return fmt.Errorf("invalid expiry for cookie %s", c.Name)
+	}
+	if c.SameSite < SameSiteDefault || c.SameSite > SameSiteNone {
+		return fmt.Errorf("invalid SameSite for cookie %s", c.Name)
+	}
+	switch {
+	case c.SameSite == SameSiteNone && !c.Secure:
+		return fmt.Errorf("cookie %s with SameSite=None must be Secure", c.Name)
+	case c.Partitioned && !c.Secure:
+		return fmt.Errorf("partitioned cookie %s must be Secure", c.Name)
+	case strings.HasPrefix(c.Name, "__Secure-") && !c.Secure:
+		return fmt.Errorf("cookie %s must be Secure", c.Name)
+	case strings.HasPrefix(c.Name, "__Host-") && (!c.Secure || c.Path != "/" || c.Domain != ""):
+		return fmt.Errorf("cookie %s must be Secure, with Path=/ and no Domain", c.Name)
+	}
+	return nil
+}
+
+// String serialises the cookie for a Set-Cookie header. It doesn't check
+// the cookie, see Valid.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	b.WriteString(c.Value)
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=")
+		b.WriteString(strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=")
+		b.WriteString(c.Expires.UTC().Format(http.TimeFormat))
+	}
+	if c.MaxAge != 0 {
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(max(c.MaxAge, 0)))
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=")
+		b.WriteString(c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// Set validates c and adds it to h as a Set-Cookie field of its own.
+func Set(h headers.Headers, c *Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	h.Set("Set-Cookie", c.String())
+	return nil
+}
+
+// validName reports whether name is a token (RFC 6265 section 4.1.1).
+func validName(name string) bool {
+	return headers.IsValidFieldName(name)
+}
+
+// validValue reports whether value is made of cookie-octets: visible ASCII
+// other than double quotes, commas, semicolons and backslashes.
+func validValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// validPath reports whether path is made of av-octets: any character other
+// than controls and semicolons.
+func validPath(path string) bool {
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c < ' ' || c == 0x7f || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// validDomain accepts a host name, optionally with the leading dot of older
+// cookie specifications, or an IP address.
+func validDomain(domain string) bool {
+	if net.ParseIP(domain) != nil {
+		return true
+	}
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
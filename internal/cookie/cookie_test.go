@@ -0,0 +1,97 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Pairs of a Cookie header
+	cookies := Parse(`session=abc123; theme="dark"; lang=en-US`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, &Cookie{Name: "session", Value: "abc123"}, cookies[0])
+	assert.Equal(t, &Cookie{Name: "theme", Value: "dark"}, cookies[1])
+	assert.Equal(t, &Cookie{Name: "lang", Value: "en-US"}, cookies[2])
+
+	// Test: Empty values, stray separators and invalid pairs
+	cookies = Parse(`empty=; ;novalue; bad name=1; bad=a,b; ok=1`)
+	require.Len(t, cookies, 2)
+	assert.Equal(t, "empty", cookies[0].Name)
+	assert.Equal(t, "", cookies[0].Value)
+	assert.Equal(t, "ok", cookies[1].Name)
+	assert.Empty(t, Parse(""))
+}
+
+func TestString(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+
+	// Test: All attributes
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     expires,
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Wed, 02 Jan 2030 02:04:05 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Just a pair, and deletion
+	assert.Equal(t, "a=b", (&Cookie{Name: "a", Value: "b"}).String())
+	assert.Equal(t, "a=; Max-Age=0", (&Cookie{Name: "a", MaxAge: -1}).String())
+	assert.Equal(t, "a=b; SameSite=Lax", (&Cookie{Name: "a", Value: "b", SameSite: SameSiteLax}).String())
+}
+
+func TestValid(t *testing.T) {
+	valid := []*Cookie{
+		{Name: "a", Value: ""},
+		{Name: "a", Value: "!#$%&'()*+-./:<=>?@[]^_`{|}~"},
+		{Name: "a", Value: "b", Domain: "127.0.0.1"},
+		{Name: "a", Value: "b", SameSite: SameSiteStrict},
+		{Name: "__Secure-a", Value: "b", Secure: true},
+		{Name: "__Host-a", Value: "b", Secure: true, Path: "/"},
+	}
+	for _, c := range valid {
+		assert.NoError(t, c.Valid(), c.String())
+	}
+
+	invalid := []*Cookie{
+		{Name: "", Value: "b"},
+		{Name: "a b", Value: "c"},
+		{Name: "a;", Value: "c"},
+		{Name: "a", Value: "b c"},
+		{Name: "a", Value: `"b"`},
+		{Name: "a", Value: "b;c"},
+		{Name: "a", Value: "b\r\nSet-Cookie: evil=1"},
+		{Name: "a", Value: "b", Path: "/;evil"},
+		{Name: "a", Value: "b", Domain: "exa mple.com"},
+		{Name: "a", Value: "b", Domain: "-example.com"},
+		{Name: "a", Value: "b", Expires: time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "a", Value: "b", SameSite: SameSiteNone},
+		{Name: "a", Value: "b", Partitioned: true},
+		{Name: "a", Value: "b", SameSite: SameSite(7)},
+		{Name: "__Secure-a", Value: "b"},
+		{Name: "__Host-a", Value: "b", Secure: true},
+		{Name: "__Host-a", Value: "b", Secure: true, Path: "/", Domain: "example.com"},
+	}
+	for _, c := range invalid {
+		assert.Error(t, c.Valid(), c.String())
+	}
+
+	// Test: Set adds a line per cookie and refuses invalid ones
+	h := headers.NewHeaders()
+	require.NoError(t, Set(h, &Cookie{Name: "a", Value: "1"}))
+	require.NoError(t, Set(h, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	assert.Equal(t, []string{"a=1", "b=2; HttpOnly"}, h.Values("Set-Cookie"))
+	assert.ErrorIs(t, Set(h, &Cookie{Name: "c", Value: "x y"}), ErrInvalidValue)
+	assert.Len(t, h.Values("Set-Cookie"), 2)
+}
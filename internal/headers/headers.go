@@ -50,6 +50,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
   }
 
   parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+  if len(parts) != 2 {
+    return 0, false, errors.New("malformed header line")
+  }
   fieldName := string(parts[0])
 
   if fieldName != strings.TrimRight(fieldName, " ") {
@@ -74,16 +77,44 @@ func (h Headers) Overwrite(fieldName, fieldValue string) {
 }
 
 
+// Set adds a field, combining it with an existing one as a comma separated
+// list. Set-Cookie can't be combined that way (RFC 9110 section 5.3), so its
+// values are kept on separate lines, see Values, and Cookie fields are
+// joined with "; " like the cookie-string of RFC 6265.
 func (h Headers) Set(fieldName, fieldValue string) {
   loweredName := strings.ToLower(fieldName)
   name, exists := h[loweredName]
   if exists {
-    h[loweredName] = name + ", " + fieldValue
+    h[loweredName] = name + separator(loweredName) + fieldValue
     return
   }
   h[loweredName] = fieldValue
 }
 
+func separator(loweredName string) string {
+  switch loweredName {
+  case "set-cookie":
+    return "\n"
+  case "cookie":
+    return "; "
+  }
+  return ", "
+}
+
+// Values returns the field lines of key: one per Set-Cookie field, and the
+// combined value of any other field.
+func (h Headers) Values(key string) []string {
+  key = strings.ToLower(key)
+  value, exists := h[key]
+  if !exists {
+    return nil
+  }
+  if key == "set-cookie" {
+    return strings.Split(value, "\n")
+  }
+  return []string{value}
+}
+
 func (h Headers) Get(key string) (string, error) {
   key = strings.ToLower(key)
   value, exists := h[key]
@@ -107,3 +138,14 @@ func isValidTChar(tChar string) bool {
   }
   return true
 }
+
+// IsValidFieldName reports whether name is a non-empty token.
+func IsValidFieldName(name string) bool {
+  return name != "" && isValidTChar(name)
+}
+
+// IsValidFieldValue reports whether value can be sent without breaking the
+// message framing, i.e. holds no CR, LF or NUL.
+func IsValidFieldValue(value string) bool {
+  return !strings.ContainsAny(value, "\r\n\x00")
+}
@@ -82,6 +82,12 @@ func TestHeaderPar(t *testing.T) {
   _, _, err = headers.Parse(data)
   require.Error(t, err)
 
+  // Test: Header line without a colon
+  headers = NewHeaders()
+  data = []byte("just some text\r\n\r\n")
+  _, _, err = headers.Parse(data)
+  require.Error(t, err)
+
   // Test: Valid and invalid field names
   headers = NewHeaders()
   data = []byte("host: localhost:41209\r\n Content-T¢pe: application/json\r\n\r\n")
@@ -126,3 +132,26 @@ func TestHeaderPar(t *testing.T) {
   assert.Equal(t, "localhost:41209", headers["host"])
   assert.Equal(t, "Eli, Vika", headers["set-person"])
 }
+
+func TestHeaderSetCookie(t *testing.T) {
+  // Test: Set-Cookie fields stay separate lines
+  headers := NewHeaders()
+  _, _, err := headers.Parse([]byte("Set-Cookie: a=1; Expires=Wed, 02 Jan 2030 02:04:05 GMT\r\n"))
+  require.NoError(t, err)
+  _, _, err = headers.Parse([]byte("Set-Cookie: b=2\r\n"))
+  require.NoError(t, err)
+  assert.Equal(t, []string{"a=1; Expires=Wed, 02 Jan 2030 02:04:05 GMT", "b=2"}, headers.Values("set-cookie"))
+  assert.Equal(t, []string{"a=1; Expires=Wed, 02 Jan 2030 02:04:05 GMT", "b=2"}, headers.HTTP()["Set-Cookie"])
+  assert.Equal(t, headers, FromHTTP(headers.HTTP()))
+
+  // Test: Cookie fields are joined like a single cookie-string
+  headers.Set("Cookie", "a=1")
+  headers.Set("Cookie", "b=2")
+  assert.Equal(t, "a=1; b=2", headers["cookie"])
+
+  // Test: Other fields have a single combined value
+  headers.Set("Accept", "text/html")
+  headers.Set("Accept", "*/*")
+  assert.Equal(t, []string{"text/html, */*"}, headers.Values("Accept"))
+  assert.Nil(t, headers.Values("Missing"))
+}
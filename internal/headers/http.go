@@ -0,0 +1,26 @@
+package headers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// FromHTTP converts a net/http header map, combining repeated fields into a
+// single value like Set does.
+func FromHTTP(h http.Header) Headers {
+	converted := NewHeaders()
+	for name, values := range h {
+		name = strings.ToLower(name)
+		converted.Overwrite(name, strings.Join(values, separator(name)))
+	}
+	return converted
+}
+
+// HTTP converts h to a net/http header map with canonical field names.
+func (h Headers) HTTP() http.Header {
+	converted := make(http.Header, len(h))
+	for name := range h {
+		converted[http.CanonicalHeaderKey(name)] = h.Values(name)
+	}
+	return converted
+}
@@ -0,0 +1,284 @@
+// Package negotiate implements proactive content negotiation (RFC 9110
+// section 12): choosing among the representations a server can produce
+// based on the Accept, Accept-Encoding and Accept-Language headers.
+package negotiate
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// Spec is one element of an Accept-style header.
+type Spec struct {
+	// Value is the media range, coding or language range, lowercased
+	Value string
+	// Params holds the media type parameters before the weight, with
+	// lowercased names
+	Params map[string]string
+	// Q is the weight between 0 and 1, 1 when not given
+	Q float64
+}
+
+// ParseAccept parses a comma separated list of values with optional
+// parameters and q weights. Elements with an invalid weight are dropped.
+func ParseAccept(value string) []Spec {
+	var specs []Spec
+	for _, element := range splitQuoted(value, ',') {
+		parts := splitQuoted(element, ';')
+		spec := Spec{Value: strings.ToLower(strings.TrimSpace(parts[0])), Q: 1}
+		if spec.Value == "" {
+			continue
+		}
+		valid := true
+		for _, param := range parts[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			value = strings.TrimSpace(value)
+			if name == "q" {
+				q, ok := parseQ(value)
+				if !ok {
+					valid = false
+				}
+				spec.Q = q
+				// Anything after the weight is an accept-ext, not a media
+				// type parameter
+				break
+			}
+			if spec.Params == nil {
+				spec.Params = map[string]string{}
+			}
+			spec.Params[name] = unquote(value)
+		}
+		if valid {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// parseQ parses qvalue = ( "0" [ "." 0*3DIGIT ] ) / ( "1" [ "." 0*3("0") ] ).
+func parseQ(s string) (float64, bool) {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if (whole != "0" && whole != "1") || len(frac) > 3 {
+		return 0, false
+	}
+	for i := 0; i < len(frac); i++ {
+		if frac[i] < '0' || frac[i] > '9' || (whole == "1" && frac[i] != '0') {
+			return 0, false
+		}
+	}
+	if hasFrac && frac == "" {
+		frac = "0"
+	}
+	q, err := strconv.ParseFloat(whole+"."+frac, 64)
+	return q, err == nil
+}
+
+// splitQuoted splits s at sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// MediaType returns the offer the Accept header of h prefers, or "" when
+// none is acceptable. Offers are media types like "application/json" and
+// ties go to the earlier offer. Each offer is weighted by the most specific
+// media range matching it, so "text/*;q=0.5, text/html" ranks text/html
+// over text/plain.
+func MediaType(h headers.Headers, offers ...string) string {
+	value, err := h.Get("Accept")
+	if err != nil {
+		return first(offers)
+	}
+	specs := ParseAccept(value)
+	return best(offers, func(offer string) float64 {
+		offerType, offerParams := parseMediaType(offer)
+		q, specificity := 0.0, -1
+		for _, spec := range specs {
+			if s := matchMediaRange(spec, offerType, offerParams); s > specificity {
+				q, specificity = spec.Q, s
+			}
+		}
+		return q
+	})
+}
+
+// matchMediaRange returns how specific spec is when it matches the media
+// type, or -1 when it doesn't.
+func matchMediaRange(spec Spec, mediaType string, params map[string]string) int {
+	rangeType, rangeSubtype, _ := strings.Cut(spec.Value, "/")
+	offerType, _, _ := strings.Cut(mediaType, "/")
+	switch {
+	case spec.Value == "*/*":
+		return 0
+	case rangeSubtype == "*" && rangeType == offerType:
+		return 1
+	case spec.Value != mediaType:
+		return -1
+	}
+	for name, value := range spec.Params {
+		if !strings.EqualFold(params[name], value) {
+			return -1
+		}
+	}
+	return 2 + len(spec.Params)
+}
+
+func parseMediaType(s string) (string, map[string]string) {
+	parts := strings.Split(s, ";")
+	params := map[string]string{}
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		params[strings.ToLower(strings.TrimSpace(name))] = unquote(strings.TrimSpace(value))
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])), params
+}
+
+// Encoding returns the content coding the Accept-Encoding header of h
+// prefers among offers, or "" when none is acceptable. "identity" is
+// acceptable unless it is excluded explicitly or by "*;q=0" (RFC 9110
+// section 12.5.3), so offering it guarantees an answer for most clients.
+func Encoding(h headers.Headers, offers ...string) string {
+	value, err := h.Get("Accept-Encoding")
+	if err != nil {
+		return first(offers)
+	}
+	specs := ParseAccept(value)
+	return best(offers, func(offer string) float64 {
+		offer = strings.ToLower(offer)
+		wildcard := -1.0
+		for _, spec := range specs {
+			switch spec.Value {
+			case offer:
+				return spec.Q
+			case "*":
+				wildcard = spec.Q
+			}
+		}
+		if wildcard >= 0 {
+			return wildcard
+		}
+		if offer == "identity" {
+			// Below any coding the client listed
+			return 0.001
+		}
+		return 0
+	})
+}
+
+// Language returns the language tag the Accept-Language header of h prefers
+// among offers, or "" when none is acceptable. Ranges match with the basic
+// filtering of RFC 4647, so "en" matches "en-GB", and the longest matching
+// range decides the weight of an offer.
+func Language(h headers.Headers, offers ...string) string {
+	value, err := h.Get("Accept-Language")
+	if err != nil {
+		return first(offers)
+	}
+	specs := ParseAccept(value)
+	return best(offers, func(offer string) float64 {
+		tag := strings.ToLower(offer)
+		q, specificity := 0.0, -1
+		for _, spec := range specs {
+			s := -1
+			switch {
+			case spec.Value == "*":
+				s = 0
+			case spec.Value == tag || strings.HasPrefix(tag, spec.Value+"-"):
+				s = len(spec.Value)
+			}
+			if s > specificity {
+				q, specificity = spec.Q, s
+			}
+		}
+		return q
+	})
+}
+
+// best returns the offer with the highest weight above zero, the earliest
+// one on ties.
+func best(offers []string, weight func(string) float64) string {
+	bestOffer, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := weight(offer); q > bestQ {
+			bestOffer, bestQ = offer, q
+		}
+	}
+	return bestOffer
+}
+
+func first(offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	return offers[0]
+}
+
+// Negotiate picks the best of offers for req according to header, which is
+// "Accept", "Accept-Encoding" or "Accept-Language". The header is added to
+// the Vary header of w since the response depends on it. When nothing is
+// acceptable it answers 406 Not Acceptable, listing the offers, and returns
+// false.
+func Negotiate(w *response.Writer, req *request.Request, header string, offers ...string) (string, bool) {
+	var choice string
+	switch strings.ToLower(header) {
+	case "accept-encoding":
+		choice = Encoding(req.Headers, offers...)
+	case "accept-language":
+		choice = Language(req.Headers, offers...)
+	default:
+		choice = MediaType(req.Headers, offers...)
+	}
+	addVary(w.Header(), header)
+	if choice != "" {
+		return choice, true
+	}
+
+	response.WriteError(w, response.StatusNotAcceptable, "Not Acceptable, available: "+strings.Join(offers, ", ")+"\n")
+	return "", false
+}
+
+func addVary(h headers.Headers, name string) {
+	value, err := h.Get("Vary")
+	if err != nil {
+		h.Set("Vary", name)
+		return
+	}
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), name) {
+			return
+		}
+	}
+	h.Set("Vary", name)
+}
@@ -0,0 +1,115 @@
+package negotiate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccept(t *testing.T) {
+	// Test: Weights, parameters and accept-ext
+	specs := ParseAccept(`text/html, application/json;q=0.8, text/plain; charset="utf-8, really"; q=0.5; ext=1, */*;q=0`)
+	require.Len(t, specs, 4)
+	assert.Equal(t, Spec{Value: "text/html", Q: 1}, specs[0])
+	assert.Equal(t, Spec{Value: "application/json", Q: 0.8}, specs[1])
+	assert.Equal(t, Spec{Value: "text/plain", Params: map[string]string{"charset": "utf-8, really"}, Q: 0.5}, specs[2])
+	assert.Equal(t, Spec{Value: "*/*", Q: 0}, specs[3])
+
+	// Test: Invalid weights and empty elements are dropped
+	specs = ParseAccept("gzip;q=2, , br;q=0.5555, deflate;q=1.000, zstd;q=0.")
+	require.Len(t, specs, 2)
+	assert.Equal(t, Spec{Value: "deflate", Q: 1}, specs[0])
+	assert.Equal(t, Spec{Value: "zstd", Q: 0}, specs[1])
+}
+
+func TestMediaType(t *testing.T) {
+	accept := func(value string) headers.Headers {
+		return headers.Headers{"accept": value}
+	}
+
+	// Test: No Accept header accepts anything
+	assert.Equal(t, "text/html", MediaType(headers.Headers{}, "text/html", "application/json"))
+
+	// Test: Browsers get HTML and scripts JSON
+	browser := accept("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.Equal(t, "text/html", MediaType(browser, "application/json", "text/html"))
+	assert.Equal(t, "application/json", MediaType(accept("application/json"), "text/html", "application/json"))
+	assert.Equal(t, "text/html", MediaType(accept("*/*"), "text/html", "application/json"))
+
+	// Test: The most specific range decides the weight
+	assert.Equal(t, "text/html", MediaType(accept("text/*;q=0.5, text/html"), "text/plain", "text/html"))
+	assert.Equal(t, "text/plain", MediaType(accept("text/*, text/html;q=0.1"), "text/html", "text/plain"))
+	assert.Equal(t, "application/json", MediaType(accept("*/*, text/html;q=0"), "text/html", "application/json"))
+
+	// Test: Range parameters must match
+	assert.Equal(t, "text/plain;charset=utf-8", MediaType(accept("text/plain;charset=UTF-8"), "text/plain;charset=utf-8"))
+	assert.Equal(t, "", MediaType(accept("text/plain;format=flowed"), "text/plain"))
+
+	// Test: Nothing acceptable
+	assert.Equal(t, "", MediaType(accept("image/png"), "text/html", "application/json"))
+}
+
+func TestEncoding(t *testing.T) {
+	ae := func(value string) headers.Headers {
+		return headers.Headers{"accept-encoding": value}
+	}
+	assert.Equal(t, "gzip", Encoding(headers.Headers{}, "gzip", "identity"))
+	assert.Equal(t, "br", Encoding(ae("gzip;q=0.5, br"), "gzip", "br", "identity"))
+	assert.Equal(t, "gzip", Encoding(ae("gzip"), "br", "gzip", "identity"))
+
+	// Test: identity is acceptable unless excluded
+	assert.Equal(t, "identity", Encoding(ae(""), "gzip", "identity"))
+	assert.Equal(t, "identity", Encoding(ae("br"), "gzip", "identity"))
+	assert.Equal(t, "", Encoding(ae("identity;q=0"), "identity"))
+	assert.Equal(t, "", Encoding(ae("*;q=0"), "identity"))
+	assert.Equal(t, "gzip", Encoding(ae("*"), "gzip", "identity"))
+}
+
+func TestLanguage(t *testing.T) {
+	al := func(value string) headers.Headers {
+		return headers.Headers{"accept-language": value}
+	}
+	assert.Equal(t, "en", Language(headers.Headers{}, "en", "de"))
+	assert.Equal(t, "de", Language(al("de-CH, de;q=0.9, en;q=0.8"), "en", "de"))
+	assert.Equal(t, "en-GB", Language(al("en"), "de", "en-GB"))
+	assert.Equal(t, "en-US", Language(al("en-GB;q=0.5, en;q=0.8"), "en-GB", "en-US"))
+	assert.Equal(t, "fr", Language(al("*;q=0.1, de;q=0"), "de", "fr"))
+	assert.Equal(t, "", Language(al("ja"), "en", "de"))
+}
+
+func TestNegotiate(t *testing.T) {
+	serve := func(header, value string, offers ...string) (string, bool, *response.Response) {
+		req, err := request.NewBuilder("GET", "/").Header(header, value).Build()
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		w.SetRequest(req)
+		choice, ok := Negotiate(w, req, header, offers...)
+		if ok {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		}
+		require.NoError(t, w.Finish())
+		resp, err := response.ResponseFromReader(buf, req)
+		require.NoError(t, err)
+		return choice, ok, resp
+	}
+
+	// Test: The choice is returned and the header added to Vary
+	choice, ok, resp := serve("Accept", "application/json", "text/html", "application/json")
+	assert.True(t, ok)
+	assert.Equal(t, "application/json", choice)
+	assert.Equal(t, "Accept", resp.Headers["vary"])
+
+	// Test: 406 when nothing matches
+	_, ok, resp = serve("Accept-Language", "ja", "en", "de")
+	assert.False(t, ok)
+	assert.Equal(t, response.StatusNotAcceptable, resp.StatusLine.StatusCode)
+	assert.Equal(t, "Accept-Language", resp.Headers["vary"])
+	assert.Equal(t, "Not Acceptable, available: en, de\n", string(resp.Body))
+}
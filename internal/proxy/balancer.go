@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/client"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// Strategy decides which upstream a request goes to.
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	// LeastConnections picks the upstream with the fewest requests in flight
+	LeastConnections
+	// Weighted spreads requests in proportion to Upstream.Weight
+	Weighted
+	// ConsistentHash keeps requests with the same key on the same upstream
+	// while the set of available upstreams doesn't change
+	ConsistentHash
+)
+
+const (
+	defaultMaxFails      = 3
+	defaultEjectDuration = 30 * time.Second
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	hashReplicas         = 100
+)
+
+var errNoUpstream = errors.New("no upstream available")
+
+// Upstream is one server of a Balancer.
+type Upstream struct {
+	URL *url.URL
+	// Weight is used by the Weighted and ConsistentHash strategies, 1 when
+	// zero
+	Weight int
+
+	active atomic.Int64
+	// unhealthy is set by the active health check
+	unhealthy atomic.Bool
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	// current is the running weight of smooth weighted round-robin
+	current int
+}
+
+// Healthy reports whether the upstream can take requests, i.e. it passed its
+// last health check and isn't ejected after failing requests.
+func (u *Upstream) Healthy() bool {
+	if u.unhealthy.Load() {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().After(u.ejectedUntil)
+}
+
+// ActiveRequests returns the number of requests currently forwarded to u.
+func (u *Upstream) ActiveRequests() int {
+	return int(u.active.Load())
+}
+
+func (u *Upstream) weight() int {
+	if u.Weight > 0 {
+		return u.Weight
+	}
+	return 1
+}
+
+// HealthCheck configures the active health checks of a Balancer.
+type HealthCheck struct {
+	// Path is requested on every upstream, a 2xx or 3xx answer meaning
+	// healthy. Active checks are off when empty.
+	Path string
+	// Interval between checks, 10 seconds when zero
+	Interval time.Duration
+	// Timeout of a single check, 2 seconds when zero
+	Timeout time.Duration
+}
+
+// Balancer is a reverse proxy to a pool of upstreams.
+type Balancer struct {
+	Upstreams []*Upstream
+	Strategy  Strategy
+	// HashHeader names the header whose value is the ConsistentHash key. The
+	// client IP is used when it is empty or the header is missing.
+	HashHeader  string
+	HealthCheck HealthCheck
+	// MaxFails consecutive failed requests eject an upstream for
+	// EjectDuration. The defaults are 3 and 30 seconds.
+	MaxFails      int
+	EjectDuration time.Duration
+	// Retries is how many other upstreams an idempotent request is tried on
+	// when its upstream can't be reached
+	Retries int
+
+	// Rewrite, PreserveHost, Timeout, Client and Cache work like they do on
+	// ReverseProxy
+	Rewrite      func(target string) string
+	PreserveHost bool
+	Timeout      time.Duration
+	Client       *client.Client
+	Cache        *Cache
+
+	next     atomic.Uint64
+	ringOnce sync.Once
+	ring     []ringEntry
+	weightMu sync.Mutex
+	// stop is made by NewBalancer so that Start and Stop never race on it
+	stop      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+type ringEntry struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// NewBalancer returns a Balancer over the upstream base URLs.
+func NewBalancer(strategy Strategy, upstreams ...string) (*Balancer, error) {
+	b := &Balancer{Strategy: strategy, stop: make(chan struct{})}
+	for _, upstream := range upstreams {
+		p, err := NewReverseProxy(upstream)
+		if err != nil {
+			return nil, err
+		}
+		b.Upstreams = append(b.Upstreams, &Upstream{URL: p.Upstream})
+	}
+	if len(b.Upstreams) == 0 {
+		return nil, fmt.Errorf("balancer needs at least one upstream")
+	}
+	return b, nil
+}
+
+func (b *Balancer) Serve(w *response.Writer, req *request.Request) {
+	serve(w, req, b.Cache, b.fetch)
+}
+
+// fetch forwards req to an upstream, trying others for idempotent requests
+// when the upstream can't be reached.
+func (b *Balancer) fetch(req *request.Request) (*client.Response, func(), error) {
+	p := &ReverseProxy{
+		Rewrite:      b.Rewrite,
+		PreserveHost: b.PreserveHost,
+		Timeout:      b.Timeout,
+		Client:       b.Client,
+	}
+
+	tried := map[*Upstream]bool{}
+	for {
+		upstream := b.pick(req, tried)
+		if upstream == nil {
+			return nil, nil, errNoUpstream
+		}
+		tried[upstream] = true
+
+		upstream.active.Add(1)
+		resp, release, err := p.forward(req, upstream.URL)
+		if err != nil {
+			upstream.active.Add(-1)
+			if _, badRequest := err.(errBadRequest); !badRequest {
+				b.fail(upstream)
+				if isIdempotent(req.RequestLine.Method) && len(tried) <= b.Retries {
+					continue
+				}
+			}
+			return nil, nil, err
+		}
+
+		b.succeed(upstream)
+		return resp, func() {
+			release()
+			upstream.active.Add(-1)
+		}, nil
+	}
+}
+
+// pick chooses an available upstream that hasn't been tried yet.
+func (b *Balancer) pick(req *request.Request, tried map[*Upstream]bool) *Upstream {
+	var candidates []*Upstream
+	for _, u := range b.Upstreams {
+		if !tried[u] && u.Healthy() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch b.Strategy {
+	case LeastConnections:
+		// Start at a rotating offset so ties are spread evenly
+		offset := int(b.next.Add(1))
+		best := candidates[offset%len(candidates)]
+		for i := range candidates {
+			u := candidates[(offset+i)%len(candidates)]
+			if u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+	case Weighted:
+		return b.pickWeighted(candidates)
+	case ConsistentHash:
+		return b.pickHashed(b.hashKey(req), tried)
+	default:
+		return candidates[int(b.next.Add(1)-1)%len(candidates)]
+	}
+}
+
+// pickWeighted is the smooth weighted round-robin of nginx, which interleaves
+// the upstreams instead of sending runs of requests to the heaviest one.
+func (b *Balancer) pickWeighted(candidates []*Upstream) *Upstream {
+	b.weightMu.Lock()
+	defer b.weightMu.Unlock()
+	total := 0
+	var best *Upstream
+	for _, u := range candidates {
+		u.current += u.weight()
+		total += u.weight()
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (b *Balancer) hashKey(req *request.Request) string {
+	if b.HashHeader != "" {
+		if value, err := req.Headers.Get(b.HashHeader); err == nil {
+			return value
+		}
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// pickHashed walks the hash ring from key to the first available upstream,
+// so only the keys of an unavailable upstream move elsewhere.
+func (b *Balancer) pickHashed(key string, tried map[*Upstream]bool) *Upstream {
+	b.ringOnce.Do(b.buildRing)
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	for i := range b.ring {
+		u := b.ring[(start+i)%len(b.ring)].upstream
+		if !tried[u] && u.Healthy() {
+			return u
+		}
+	}
+	return nil
+}
+
+func (b *Balancer) buildRing() {
+	for _, u := range b.Upstreams {
+		for i := 0; i < hashReplicas*u.weight(); i++ {
+			hash := crc32.ChecksumIEEE([]byte(u.URL.String() + "#" + strconv.Itoa(i)))
+			b.ring = append(b.ring, ringEntry{hash: hash, upstream: u})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+// fail records a request the upstream couldn't answer and ejects it after
+// MaxFails in a row.
+func (b *Balancer) fail(u *Upstream) {
+	maxFails := b.MaxFails
+	if maxFails <= 0 {
+		maxFails = defaultMaxFails
+	}
+	eject := b.EjectDuration
+	if eject <= 0 {
+		eject = defaultEjectDuration
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	if u.failures >= maxFails {
+		u.failures = 0
+		u.ejectedUntil = time.Now().Add(eject)
+	}
+}
+
+func (b *Balancer) succeed(u *Upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+}
+
+// Start runs the active health checks in the background until Stop. It does
+// nothing when no HealthCheck.Path is configured, after Stop or when the
+// checks already run.
+func (b *Balancer) Start() {
+	if b.HealthCheck.Path == "" {
+		return
+	}
+	b.startOnce.Do(func() {
+		interval := b.HealthCheck.Interval
+		if interval <= 0 {
+			interval = defaultCheckInterval
+		}
+		go b.runChecks(interval)
+	})
+}
+
+func (b *Balancer) runChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		b.checkAll()
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Balancer) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+}
+
+func (b *Balancer) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range b.Upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.unhealthy.Store(!b.check(u))
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *Balancer) check(u *Upstream) bool {
+	timeout := b.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	target := *u.URL
+	target.Path = joinPath(target.Path, b.HealthCheck.Path)
+	req, err := request.NewBuilder("GET", target.String()).Build()
+	if err != nil {
+		return false
+	}
+	c := b.Client
+	if c == nil {
+		c = defaultClient
+	}
+	resp, err := c.DoContext(ctx, req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	code := resp.StatusLine.StatusCode
+	return code.IsSuccess() || code.IsRedirect()
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func namedUpstream(t *testing.T, name string) string {
+	return startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/health" && name == "sick" {
+			w.WriteStatusLine(response.StatusServiceUnavailable)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			return
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		w.WriteBody([]byte(name))
+	})
+}
+
+func deadUpstream(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener.Close()
+	return "http://" + listener.Addr().String()
+}
+
+func serveBalancer(t *testing.T, b *Balancer, method string, hashKey string) *response.Response {
+	builder := request.NewBuilder(method, "http://balancer.test/")
+	if hashKey != "" {
+		builder.Header("X-User", hashKey)
+	}
+	req, err := builder.Build()
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:5000"
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	b.Serve(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	a, bb, c := namedUpstream(t, "a"), namedUpstream(t, "b"), namedUpstream(t, "c")
+
+	// Test: Round-robin visits every upstream in turn
+	b, err := NewBalancer(RoundRobin, a, bb, c)
+	require.NoError(t, err)
+	var got string
+	for i := 0; i < 6; i++ {
+		got += string(serveBalancer(t, b, "GET", "").Body)
+	}
+	assert.Equal(t, "abcabc", got)
+
+	// Test: Weighted interleaves in proportion to the weights
+	b, err = NewBalancer(Weighted, a, bb)
+	require.NoError(t, err)
+	b.Upstreams[0].Weight = 3
+	got = ""
+	for i := 0; i < 8; i++ {
+		got += string(serveBalancer(t, b, "GET", "").Body)
+	}
+	assert.Equal(t, "aabaaaba", got)
+
+	// Test: Consistent hashing keeps a key on one upstream
+	b, err = NewBalancer(ConsistentHash, a, bb, c)
+	require.NoError(t, err)
+	b.HashHeader = "X-User"
+	seen := map[string]bool{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		first := string(serveBalancer(t, b, "GET", user).Body)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, first, string(serveBalancer(t, b, "GET", user).Body))
+		}
+		seen[first] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	// Test: Only the keys of an unavailable upstream move
+	before := map[string]string{}
+	users := []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8", "u9", "u10"}
+	for _, user := range users {
+		before[user] = string(serveBalancer(t, b, "GET", user).Body)
+	}
+	b.Upstreams[2].unhealthy.Store(true)
+	for _, user := range users {
+		after := string(serveBalancer(t, b, "GET", user).Body)
+		if before[user] != "c" {
+			assert.Equal(t, before[user], after)
+		} else {
+			assert.NotEqual(t, "c", after)
+		}
+	}
+
+	// Test: Least connections avoids busy upstreams
+	b, err = NewBalancer(LeastConnections, a, bb, c)
+	require.NoError(t, err)
+	b.Upstreams[0].active.Store(2)
+	b.Upstreams[2].active.Store(1)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "b", string(serveBalancer(t, b, "GET", "").Body))
+	}
+}
+
+func TestBalancerFailures(t *testing.T) {
+	a := namedUpstream(t, "a")
+	dead := deadUpstream(t)
+
+	// Test: Idempotent requests are retried on another upstream
+	b, err := NewBalancer(RoundRobin, dead, a)
+	require.NoError(t, err)
+	b.Retries = 1
+	b.MaxFails = 2
+	for i := 0; i < 4; i++ {
+		resp := serveBalancer(t, b, "GET", "")
+		assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+		assert.Equal(t, "a", string(resp.Body))
+	}
+
+	// Test: Consecutive failures eject the upstream
+	assert.False(t, b.Upstreams[0].Healthy())
+	assert.True(t, b.Upstreams[1].Healthy())
+
+	// Test: Non-idempotent requests aren't retried
+	b, err = NewBalancer(RoundRobin, dead, a)
+	require.NoError(t, err)
+	b.Retries = 1
+	resp := serveBalancer(t, b, "POST", "")
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: No upstream left
+	b, err = NewBalancer(RoundRobin, dead)
+	require.NoError(t, err)
+	b.MaxFails = 1
+	serveBalancer(t, b, "GET", "")
+	resp = serveBalancer(t, b, "GET", "")
+	assert.Equal(t, response.StatusServiceUnavailable, resp.StatusLine.StatusCode)
+
+	// Test: Active health checks mark failing upstreams
+	b, err = NewBalancer(RoundRobin, a, namedUpstream(t, "sick"), dead)
+	require.NoError(t, err)
+	b.HealthCheck = HealthCheck{Path: "/health", Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond}
+	b.Start()
+	defer b.Stop()
+	assert.Eventually(t, func() bool {
+		return b.Upstreams[0].Healthy() && !b.Upstreams[1].Healthy() && !b.Upstreams[2].Healthy()
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "a", string(serveBalancer(t, b, "GET", "").Body))
+	}
+
+	// Test: Start and Stop may run concurrently, and Stop without Start
+	b, err = NewBalancer(RoundRobin, a)
+	require.NoError(t, err)
+	b.HealthCheck = HealthCheck{Path: "/health", Interval: 10 * time.Millisecond}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			b.Start()
+		}()
+		go func() {
+			defer wg.Done()
+			b.Stop()
+		}()
+	}
+	wg.Wait()
+	b, err = NewBalancer(RoundRobin, a)
+	require.NoError(t, err)
+	b.Stop()
+	b.Stop()
+}
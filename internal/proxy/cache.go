@@ -0,0 +1,618 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/client"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+const (
+	defaultMaxEntrySize = 10 << 20
+	// maxHeuristicLifetime caps the freshness guessed from Last-Modified
+	maxHeuristicLifetime = 24 * time.Hour
+	// maxCollapseWait bounds how long a miss waits for another request to
+	// the same URL before going upstream itself
+	maxCollapseWait = 10 * time.Second
+)
+
+// Cache is a shared HTTP cache (RFC 9111) for a ReverseProxy or Balancer.
+// Fresh responses are served from the store, stale ones are revalidated
+// with the upstream when they carry a validator, and concurrent misses for
+// the same URL wait for a single upstream request, until it turns out not
+// to be storable or has been stored. Responses from the store are a 304
+// when the validators of the request match. Every response gets a
+// Cache-Status header (RFC 9211) and those from the store an Age header.
+type Cache struct {
+	store Store
+	// MaxEntrySize is the largest body that is stored, 10 MiB when zero
+	MaxEntrySize int64
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+	now      func() time.Time
+}
+
+func NewCache(store Store) *Cache {
+	return &Cache{
+		store:    store,
+		inflight: map[string]chan struct{}{},
+		now:      time.Now,
+	}
+}
+
+func (c *Cache) serve(w *response.Writer, req *request.Request, fetch fetchFunc) {
+	key := cacheKey(req)
+	method := req.RequestLine.Method
+	reqCC := requestCacheControl(req.Headers)
+
+	if (method != "GET" && method != "HEAD") || reqCC.has("no-store") {
+		resp, release, err := fetch(req)
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+		defer release()
+		// A successful unsafe request makes what is stored for the URL
+		// outdated (RFC 9111 section 4.4)
+		if !isSafe(method) && resp.StatusLine.StatusCode < 400 {
+			c.invalidate(key)
+		}
+		c.forwardResponse(w, resp, "fwd=bypass")
+		return
+	}
+
+	collapsed := false
+	for {
+		entry := c.lookup(key, req)
+		if entry != nil {
+			age := c.age(entry, c.now())
+			if c.fresh(entry, age, reqCC) {
+				status := "hit"
+				if collapsed {
+					status += "; collapsed"
+				}
+				c.writeEntry(w, req, entry, age, status)
+				return
+			}
+		}
+		if reqCC.has("only-if-cached") {
+			response.WriteError(w, response.StatusGatewayTimeout, "Not in cache")
+			return
+		}
+
+		// HEAD can use a stored GET response but never fills the cache
+		if method == "HEAD" {
+			resp, release, err := fetch(req)
+			if err != nil {
+				writeUpstreamError(w, err)
+				return
+			}
+			defer release()
+			c.forwardResponse(w, resp, "fwd=miss")
+			return
+		}
+
+		c.mu.Lock()
+		if wait, ok := c.inflight[key]; ok && !collapsed {
+			c.mu.Unlock()
+			timer := time.NewTimer(maxCollapseWait)
+			select {
+			case <-wait:
+			case <-timer.C:
+			}
+			timer.Stop()
+			collapsed = true
+			continue
+		}
+		done := make(chan struct{})
+		c.inflight[key] = done
+		c.mu.Unlock()
+		var once sync.Once
+		unblock := func() {
+			once.Do(func() {
+				c.mu.Lock()
+				if c.inflight[key] == done {
+					delete(c.inflight, key)
+				}
+				c.mu.Unlock()
+				close(done)
+			})
+		}
+		defer unblock()
+
+		c.fill(w, req, key, entry, reqCC, fetch, unblock)
+		return
+	}
+}
+
+// fill fetches req from the upstream, revalidating entry when it has a
+// validator, and stores the response if it may be. unblock lets the
+// requests waiting for the same URL go on, which fill calls as soon as they
+// have an entry to use or know there won't be one, before the response is
+// written to the client.
+func (c *Cache) fill(w *response.Writer, req *request.Request, key string, entry *Entry, reqCC cacheControl, fetch fetchFunc, unblock func()) {
+	out := req
+	fwd := "fwd=miss"
+	if entry != nil {
+		fwd = "fwd=stale"
+		if conditional := conditionalRequest(req, entry); conditional != nil {
+			out = conditional
+		}
+	}
+
+	requestTime := c.now()
+	resp, release, err := fetch(out)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer release()
+	responseTime := c.now()
+
+	if entry != nil && out != req && resp.StatusLine.StatusCode == response.StatusNotModified {
+		updated := *entry
+		updated.Headers = headers.NewHeaders()
+		for name, value := range entry.Headers {
+			updated.Headers.Overwrite(name, value)
+		}
+		for name, value := range resp.Headers {
+			switch name {
+			case "content-length", "transfer-encoding", "trailer", "set-cookie":
+				continue
+			}
+			updated.Headers.Overwrite(name, value)
+		}
+		removeHopHeaders(updated.Headers)
+		updated.RequestTime = requestTime
+		updated.ResponseTime = responseTime
+		c.storeEntry(key, &updated)
+		unblock()
+		// A cookie set with the 304 is for this client only
+		sent := &updated
+		if cookie, ok := resp.Headers["set-cookie"]; ok {
+			withCookie := updated
+			withCookie.Headers = headers.NewHeaders()
+			for name, value := range updated.Headers {
+				withCookie.Headers.Overwrite(name, value)
+			}
+			withCookie.Headers.Overwrite("Set-Cookie", cookie)
+			sent = &withCookie
+		}
+		c.writeEntry(w, req, sent, c.age(sent, responseTime), fwd+"; fwd-status=304")
+		return
+	}
+
+	fwd += "; fwd-status=" + strconv.Itoa(int(resp.StatusLine.StatusCode))
+	if !storable(req, reqCC, resp) {
+		unblock()
+		c.forwardResponse(w, resp, fwd)
+		return
+	}
+
+	maxSize := c.MaxEntrySize
+	if maxSize <= 0 {
+		maxSize = defaultMaxEntrySize
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if int64(len(body)) > maxSize {
+		// Too big to keep, send what was read and stream the rest
+		unblock()
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		c.forwardResponse(w, resp, fwd)
+		return
+	}
+
+	h := headers.NewHeaders()
+	for name, value := range resp.Headers {
+		h.Overwrite(name, value)
+	}
+	removeHopHeaders(h)
+	h.Delete("Trailer")
+	h.Set("Via", via(resp.StatusLine.HttpVersion))
+	entry = &Entry{
+		StatusCode:   resp.StatusLine.StatusCode,
+		ReasonPhrase: resp.StatusLine.ReasonPhrase,
+		Headers:      h,
+		Body:         body,
+		Vary:         varyValues(req, resp.Headers),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	c.storeEntry(key, entry)
+	unblock()
+	c.writeEntry(w, req, entry, c.age(entry, responseTime), fwd+"; stored")
+}
+
+// lookup returns the stored variant matching req, if any.
+func (c *Cache) lookup(key string, req *request.Request) *Entry {
+	var best *Entry
+	for _, e := range c.store.Get(key) {
+		if !varyMatches(e, req) {
+			continue
+		}
+		if best == nil || e.ResponseTime.After(best.ResponseTime) {
+			best = e
+		}
+	}
+	return best
+}
+
+// storeEntry adds entry to the variants of key, replacing one for the same
+// request header values.
+func (c *Cache) storeEntry(key string, entry *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []*Entry{entry}
+	for _, e := range c.store.Get(key) {
+		if !sameVary(e.Vary, entry.Vary) {
+			entries = append(entries, e)
+		}
+	}
+	c.store.Set(key, entries)
+}
+
+// invalidate drops the variants of key. Like storeEntry it holds c.mu, so a
+// response stored at the same time can't bring back what was dropped.
+func (c *Cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store.Set(key, nil)
+}
+
+// age is the current_age of RFC 9111 section 4.2.3.
+func (c *Cache) age(e *Entry, now time.Time) time.Duration {
+	date := e.ResponseTime
+	if value, err := e.Headers.Get("Date"); err == nil {
+		if t, err := http.ParseTime(value); err == nil {
+			date = t
+		}
+	}
+	var ageValue time.Duration
+	if value, err := e.Headers.Get("Age"); err == nil {
+		if seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil && seconds >= 0 {
+			ageValue = time.Duration(seconds) * time.Second
+		}
+	}
+	apparentAge := max(0, e.ResponseTime.Sub(date))
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+// fresh reports whether e can be served without contacting the upstream,
+// taking the request's Cache-Control into account.
+func (c *Cache) fresh(e *Entry, age time.Duration, reqCC cacheControl) bool {
+	respCC := parseCacheControl(e.Headers["cache-control"])
+	if respCC.has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+	lifetime := freshnessLifetime(e, respCC)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if lifetime > age {
+		return true
+	}
+	if !reqCC.has("max-stale") || respCC.has("must-revalidate") || respCC.has("proxy-revalidate") {
+		return false
+	}
+	maxStale, ok := reqCC.seconds("max-stale")
+	return !ok || age-lifetime <= maxStale
+}
+
+// freshnessLifetime follows RFC 9111 section 4.2.1, with the heuristic of
+// section 4.2.2 for responses without explicit freshness.
+func freshnessLifetime(e *Entry, respCC cacheControl) time.Duration {
+	if sMaxAge, ok := respCC.seconds("s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := respCC.seconds("max-age"); ok {
+		return maxAge
+	}
+
+	date := e.ResponseTime
+	if value, err := e.Headers.Get("Date"); err == nil {
+		if t, err := http.ParseTime(value); err == nil {
+			date = t
+		}
+	}
+	if value, err := e.Headers.Get("Expires"); err == nil {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			// An invalid Expires means already expired
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	if value, err := e.Headers.Get("Last-Modified"); err == nil && heuristicallyCacheable(e.StatusCode) {
+		if lastModified, err := http.ParseTime(value); err == nil && lastModified.Before(date) {
+			return min(date.Sub(lastModified)/10, maxHeuristicLifetime)
+		}
+	}
+	return 0
+}
+
+// storable implements the rules of RFC 9111 section 3 for a shared cache.
+func storable(req *request.Request, reqCC cacheControl, resp *client.Response) bool {
+	if req.RequestLine.Method != "GET" || reqCC.has("no-store") {
+		return false
+	}
+	respCC := parseCacheControl(resp.Headers["cache-control"])
+	if respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	// A cookie is meant for one client, so only a response marked public may
+	// be shared with it
+	if _, ok := resp.Headers["set-cookie"]; ok && !respCC.has("public") {
+		return false
+	}
+	if _, err := req.Headers.Get("Authorization"); err == nil &&
+		!respCC.has("public") && !respCC.has("must-revalidate") && !respCC.has("s-maxage") {
+		return false
+	}
+	if vary, err := resp.Headers.Get("Vary"); err == nil && strings.TrimSpace(vary) == "*" {
+		return false
+	}
+
+	code := resp.StatusLine.StatusCode
+	if code == response.StatusPartialContent || code == response.StatusNotModified || code.IsInformational() {
+		return false
+	}
+	_, hasExpires := resp.Headers["expires"]
+	return heuristicallyCacheable(code) || hasExpires || respCC.has("max-age") ||
+		respCC.has("s-maxage") || respCC.has("public")
+}
+
+// heuristicallyCacheable lists the status codes of RFC 9110 section 15.1
+// that may be stored without explicit freshness information.
+func heuristicallyCacheable(code response.StatusCode) bool {
+	switch code {
+	case response.StatusOK, response.StatusNonAuthoritativeInfo, response.StatusNoContent,
+		response.StatusMultipleChoices, response.StatusMovedPermanently, response.StatusPermanentRedirect,
+		response.StatusNotFound, response.StatusMethodNotAllowed, response.StatusGone,
+		response.StatusURITooLong, response.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// conditionalRequest returns a copy of req that asks the upstream whether
+// entry is still current, or nil when entry has no validator.
+func conditionalRequest(req *request.Request, e *Entry) *request.Request {
+	etag, etagErr := e.Headers.Get("ETag")
+	lastModified, lmErr := e.Headers.Get("Last-Modified")
+	if etagErr != nil && lmErr != nil {
+		return nil
+	}
+	out := *req
+	out.Headers = headers.NewHeaders()
+	for name, value := range req.Headers {
+		out.Headers.Overwrite(name, value)
+	}
+	out.Headers.Delete("If-None-Match")
+	out.Headers.Delete("If-Modified-Since")
+	if etagErr == nil {
+		out.Headers.Overwrite("If-None-Match", etag)
+	}
+	if lmErr == nil {
+		out.Headers.Overwrite("If-Modified-Since", lastModified)
+	}
+	return &out
+}
+
+// notModified reports whether the validators of a GET or HEAD request
+// match e, so that the client's copy is current and a 304 answers it (RFC
+// 9111 section 4.3.2). If-None-Match uses the weak comparison and takes
+// precedence over If-Modified-Since, which is compared with Last-Modified,
+// or the Date of the response without one.
+func notModified(req *request.Request, e *Entry) bool {
+	if e.StatusCode != response.StatusOK {
+		return false
+	}
+	if list, err := req.Headers.Get("If-None-Match"); err == nil {
+		etag, err := e.Headers.Get("ETag")
+		return err == nil && etagListContains(list, etag)
+	}
+	value, err := req.Headers.Get("If-Modified-Since")
+	if err != nil {
+		return false
+	}
+	since, err := http.ParseTime(strings.TrimSpace(value))
+	if err != nil {
+		return false
+	}
+	modified := e.ResponseTime
+	if value, err := e.Headers.Get("Last-Modified"); err == nil {
+		if t, err := http.ParseTime(value); err == nil {
+			modified = t
+		}
+	} else if value, err := e.Headers.Get("Date"); err == nil {
+		if t, err := http.ParseTime(value); err == nil {
+			modified = t
+		}
+	}
+	return !modified.After(since)
+}
+
+// etagListContains reports whether an If-None-Match list holds etag, "*"
+// matching any. Weak and strong tags are the same here.
+func etagListContains(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEntry answers from the store, with a 304 when the client already
+// has the entry. The fields describing the body are left out of that (RFC
+// 9110 section 15.4.5).
+func (c *Cache) writeEntry(w *response.Writer, req *request.Request, e *Entry, age time.Duration, status string) {
+	h := headers.NewHeaders()
+	for name, value := range e.Headers {
+		h.Overwrite(name, value)
+	}
+	h.Overwrite("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Overwrite("Cache-Status", pseudonym+"; "+status)
+
+	if notModified(req, e) {
+		for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Language", "Content-Range"} {
+			h.Delete(name)
+		}
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+	h.Overwrite("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteStatusLineReason(e.StatusCode, e.ReasonPhrase)
+	w.WriteHeaders(h)
+	w.WriteBody(e.Body)
+}
+
+// forwardResponse streams an upstream response that isn't served from the
+// store.
+func (c *Cache) forwardResponse(w *response.Writer, resp *client.Response, status string) {
+	resp.Headers.Overwrite("Cache-Status", pseudonym+"; "+status)
+	copyResponse(w, resp)
+}
+
+func cacheKey(req *request.Request) string {
+	target := req.RequestLine.RequestTarget
+	if !strings.HasPrefix(target, "/") {
+		return target
+	}
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.Headers["host"]
+	}
+	return scheme + "://" + strings.ToLower(host) + target
+}
+
+// varyValues records the request header values named by the Vary header.
+func varyValues(req *request.Request, h headers.Headers) map[string]string {
+	vary, err := h.Get("Vary")
+	if err != nil {
+		return nil
+	}
+	values := map[string]string{}
+	for _, name := range strings.Split(vary, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			values[name] = normalizeVaryValue(req.Headers[name])
+		}
+	}
+	return values
+}
+
+func varyMatches(e *Entry, req *request.Request) bool {
+	for name, value := range e.Vary {
+		if normalizeVaryValue(req.Headers[name]) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeVaryValue drops the whitespace around list members so that
+// equivalent values match.
+func normalizeVaryValue(value string) string {
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+func isSafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// cacheControl holds the directives of a Cache-Control header, lowercased,
+// with their unquoted arguments.
+type cacheControl map[string]string
+
+func parseCacheControl(value string) cacheControl {
+	cc := cacheControl{}
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+// requestCacheControl also honours the HTTP/1.0 Pragma: no-cache when the
+// request has no Cache-Control.
+func requestCacheControl(h headers.Headers) cacheControl {
+	if value, err := h.Get("Cache-Control"); err == nil {
+		return parseCacheControl(value)
+	}
+	cc := cacheControl{}
+	if pragma, err := h.Get("Pragma"); err == nil && hasToken(pragma, "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok || arg == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/client"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestCache(t *testing.T) {
+	var hits sync.Map
+	count := func(path string) int {
+		n, _ := hits.LoadOrStore(path, new(atomic.Int64))
+		return int(n.(*atomic.Int64).Load())
+	}
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		path := req.RequestLine.RequestTarget
+		n, _ := hits.LoadOrStore(path, new(atomic.Int64))
+		version := n.(*atomic.Int64).Add(1)
+
+		h := headers.NewHeaders()
+		body := "v" + strconv.FormatInt(version, 10)
+		switch path {
+		case "/fresh":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("ETag", `"abc"`)
+			if inm, _ := req.Headers.Get("If-None-Match"); inm == `"abc"` {
+				w.WriteStatusLine(response.StatusNotModified)
+				w.WriteHeaders(h)
+				return
+			}
+		case "/private":
+			h.Set("Cache-Control", "private, max-age=60")
+		case "/cookie":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("Set-Cookie", "id="+body)
+		case "/public-cookie":
+			h.Set("Cache-Control", "public, max-age=60")
+			h.Set("Set-Cookie", "id="+body)
+		case "/revalidate-cookie":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("ETag", `"abc"`)
+			if inm, _ := req.Headers.Get("If-None-Match"); inm == `"abc"` {
+				h.Set("Set-Cookie", "id="+body)
+				w.WriteStatusLine(response.StatusNotModified)
+				w.WriteHeaders(h)
+				return
+			}
+		case "/vary":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("Vary", "Accept-Language")
+			lang, _ := req.Headers.Get("Accept-Language")
+			body += " " + lang
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			h.Set("Cache-Control", "max-age=60")
+		case "/large":
+			h.Set("Cache-Control", "max-age=60")
+			body = "0123456789abcdef"
+		}
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	})
+
+	upstreamURL, err := url.Parse(upstream)
+	require.NoError(t, err)
+	clock := &fakeClock{now: time.Now()}
+	cache := NewCache(NewMemoryStore(1 << 20))
+	cache.now = clock.Now
+	cache.MaxEntrySize = 10
+	base := startServer(t, (&ReverseProxy{Upstream: upstreamURL, Cache: cache}).Serve)
+
+	get := func(path string, h ...string) (*response.StatusLine, headers.Headers, string) {
+		b := request.NewBuilder("GET", base+path)
+		for i := 0; i+1 < len(h); i += 2 {
+			b.Header(h[i], h[i+1])
+		}
+		req, err := b.Build()
+		require.NoError(t, err)
+		resp, body := fetch(t, req)
+		return &resp.StatusLine, resp.Headers, body
+	}
+
+	// Test: A miss is stored and then served fresh
+	_, h, body := get("/fresh")
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "httpfromtcp; fwd=miss; fwd-status=200; stored", h["cache-status"])
+	clock.Advance(10 * time.Second)
+	_, h, body = get("/fresh")
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "httpfromtcp; hit", h["cache-status"])
+	assert.Equal(t, "10", h["age"])
+	assert.Equal(t, 1, count("/fresh"))
+
+	// Test: A stale entry is revalidated
+	clock.Advance(time.Minute)
+	_, h, body = get("/fresh")
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", h["cache-status"])
+	assert.Equal(t, "0", h["age"])
+	assert.Equal(t, 2, count("/fresh"))
+	_, h, _ = get("/fresh")
+	assert.Equal(t, "httpfromtcp; hit", h["cache-status"])
+	assert.Equal(t, 2, count("/fresh"))
+
+	// Test: A fresh hit whose validators match is a 304
+	status, h, body := get("/fresh", "If-None-Match", `"xyz", W/"abc"`)
+	assert.Equal(t, response.StatusNotModified, status.StatusCode)
+	assert.Equal(t, "", body)
+	assert.Equal(t, `"abc"`, h["etag"])
+	assert.Equal(t, "max-age=60", h["cache-control"])
+	assert.Equal(t, "httpfromtcp; hit", h["cache-status"])
+	status, _, body = get("/fresh", "If-None-Match", `"xyz"`)
+	assert.Equal(t, response.StatusOK, status.StatusCode)
+	assert.Equal(t, "v1", body)
+	status, _, _ = get("/fresh", "If-Modified-Since", clock.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, response.StatusNotModified, status.StatusCode)
+	status, _, _ = get("/fresh", "If-Modified-Since", clock.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, response.StatusOK, status.StatusCode)
+	assert.Equal(t, 2, count("/fresh"))
+
+	// Test: Request directives
+	_, h, _ = get("/fresh", "Cache-Control", "no-cache")
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", h["cache-status"])
+	_, h, _ = get("/fresh", "Cache-Control", "no-store")
+	assert.Equal(t, "httpfromtcp; fwd=bypass", h["cache-status"])
+	clock.Advance(time.Second)
+	_, h, _ = get("/fresh", "Cache-Control", "max-age=0")
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", h["cache-status"])
+	status, _, _ = get("/missing", "Cache-Control", "only-if-cached")
+	assert.Equal(t, response.StatusGatewayTimeout, status.StatusCode)
+
+	// Test: Private responses aren't stored by a shared cache
+	get("/private")
+	_, h, body = get("/private")
+	assert.Equal(t, "v2", body)
+	assert.Equal(t, "httpfromtcp; fwd=miss; fwd-status=200", h["cache-status"])
+
+	// Test: Responses setting a cookie are only stored when public
+	get("/cookie")
+	_, h, body = get("/cookie")
+	assert.Equal(t, "v2", body)
+	assert.Equal(t, "id=v2", h["set-cookie"])
+	assert.Equal(t, "httpfromtcp; fwd=miss; fwd-status=200", h["cache-status"])
+	get("/public-cookie")
+	_, h, body = get("/public-cookie")
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "httpfromtcp; hit", h["cache-status"])
+
+	// Test: A cookie set with a 304 goes to that client but isn't stored
+	get("/revalidate-cookie")
+	clock.Advance(2 * time.Minute)
+	_, h, _ = get("/revalidate-cookie")
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", h["cache-status"])
+	assert.Equal(t, "id=v2", h["set-cookie"])
+	_, h, _ = get("/revalidate-cookie")
+	assert.Equal(t, "httpfromtcp; hit", h["cache-status"])
+	assert.NotContains(t, h, "set-cookie")
+
+	// Test: Vary keeps a variant per header value
+	_, _, body = get("/vary", "Accept-Language", "en")
+	assert.Equal(t, "v1 en", body)
+	_, _, body = get("/vary", "Accept-Language", "de")
+	assert.Equal(t, "v2 de", body)
+	_, h, body = get("/vary", "Accept-Language", "en")
+	assert.Equal(t, "v1 en", body)
+	assert.Equal(t, "httpfromtcp; hit", h["cache-status"])
+	assert.Equal(t, 2, count("/vary"))
+
+	// Test: Unsafe methods invalidate the URL
+	req, err := request.NewBuilder("POST", base+"/vary").BodyBytes([]byte("x")).Build()
+	require.NoError(t, err)
+	fetch(t, req)
+	_, h, _ = get("/vary", "Accept-Language", "en")
+	assert.Equal(t, "httpfromtcp; fwd=miss; fwd-status=200; stored", h["cache-status"])
+
+	// Test: Bodies over MaxEntrySize pass through without being stored
+	_, h, body = get("/large")
+	assert.Equal(t, "0123456789abcdef", body)
+	get("/large")
+	assert.Equal(t, 2, count("/large"))
+
+	// Test: Concurrent misses are collapsed into one upstream request
+	var wg sync.WaitGroup
+	statuses := make([]string, 5)
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := request.NewBuilder("GET", base+"/slow").Build()
+			resp, _ := fetch(t, req)
+			statuses[i] = resp.Headers["cache-status"]
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, count("/slow"))
+	assert.Contains(t, statuses, "httpfromtcp; hit; collapsed")
+}
+
+func TestCacheCollapseRelease(t *testing.T) {
+	var fetches atomic.Int64
+	fetched := make(chan struct{}, 2)
+	fetchFrom := func(cacheControl string) fetchFunc {
+		return func(req *request.Request) (*client.Response, func(), error) {
+			fetches.Add(1)
+			fetched <- struct{}{}
+			h := headers.NewHeaders()
+			h.Set("Cache-Control", cacheControl)
+			h.Set("Content-Length", "5")
+			return &client.Response{
+				StatusLine: response.StatusLine{HttpVersion: "1.1", StatusCode: response.StatusOK, ReasonPhrase: "OK"},
+				Headers:    h,
+				Body:       io.NopCloser(strings.NewReader("hello")),
+			}, func() {}, nil
+		}
+	}
+	// stuck starts a request whose client doesn't read the response
+	stuck := func(c *Cache, fetch fetchFunc) *io.PipeReader {
+		pr, pw := io.Pipe()
+		req, err := request.NewBuilder("GET", "http://upstream.test/resource").Build()
+		require.NoError(t, err)
+		go c.serve(response.NewWriterSize(pw, 16), req, fetch)
+		<-fetched
+		return pr
+	}
+	// serve makes a second request for the same URL, which mustn't be held
+	// up by that client
+	serve := func(c *Cache, fetch fetchFunc) string {
+		req, err := request.NewBuilder("GET", "http://upstream.test/resource").Build()
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		finished := make(chan struct{})
+		go func() {
+			c.serve(w, req, fetch)
+			w.Finish()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(2 * time.Second):
+			t.Fatal("request waited for the slow client")
+		}
+		return buf.String()
+	}
+
+	// Test: Not storable, the waiting request goes upstream itself
+	cache := NewCache(NewMemoryStore(1 << 20))
+	fetch := fetchFrom("private")
+	pr := stuck(cache, fetch)
+	defer pr.Close()
+	out := serve(cache, fetch)
+	assert.True(t, strings.HasSuffix(out, "hello"))
+	assert.Contains(t, out, "fwd=miss")
+	assert.Equal(t, int64(2), fetches.Load())
+
+	// Test: Stored, the waiting request is served from the store
+	fetches.Store(0)
+	fetched = make(chan struct{}, 2)
+	cache = NewCache(NewMemoryStore(1 << 20))
+	fetch = fetchFrom("max-age=60")
+	pr = stuck(cache, fetch)
+	defer pr.Close()
+	out = serve(cache, fetch)
+	assert.True(t, strings.HasSuffix(out, "hello"))
+	assert.Contains(t, out, "httpfromtcp; hit")
+	assert.Equal(t, int64(1), fetches.Load())
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(fields ...string) *Entry {
+		h := headers.NewHeaders()
+		for i := 0; i+1 < len(fields); i += 2 {
+			h.Set(fields[i], fields[i+1])
+		}
+		return &Entry{StatusCode: response.StatusOK, Headers: h, RequestTime: now.Add(-2 * time.Second), ResponseTime: now}
+	}
+	c := NewCache(NewMemoryStore(1 << 20))
+
+	// Test: Age includes the Age header and the response delay
+	e := entry("Age", "30", "Date", now.Format(http.TimeFormat))
+	assert.Equal(t, 32*time.Second, c.age(e, now))
+	assert.Equal(t, 42*time.Second, c.age(e, now.Add(10*time.Second)))
+
+	// Test: Lifetime sources in order of precedence
+	e = entry("Cache-Control", "max-age=10, s-maxage=20", "Expires", now.Add(time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, 20*time.Second, freshnessLifetime(e, parseCacheControl(e.Headers["cache-control"])))
+	e = entry("Date", now.Format(http.TimeFormat), "Expires", now.Add(time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, time.Hour, freshnessLifetime(e, cacheControl{}))
+	e = entry("Expires", "0")
+	assert.Equal(t, time.Duration(0), freshnessLifetime(e, cacheControl{}))
+	e = entry("Date", now.Format(http.TimeFormat), "Last-Modified", now.Add(-100*time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, 10*time.Hour, freshnessLifetime(e, cacheControl{}))
+
+	// Test: max-stale allows stale entries unless they must be revalidated
+	e = entry("Cache-Control", "max-age=10")
+	assert.False(t, c.fresh(e, 20*time.Second, cacheControl{}))
+	assert.True(t, c.fresh(e, 20*time.Second, parseCacheControl("max-stale")))
+	assert.True(t, c.fresh(e, 20*time.Second, parseCacheControl("max-stale=15")))
+	assert.False(t, c.fresh(e, 20*time.Second, parseCacheControl("max-stale=5")))
+	e = entry("Cache-Control", "max-age=10, must-revalidate")
+	assert.False(t, c.fresh(e, 20*time.Second, parseCacheControl("max-stale")))
+	assert.False(t, c.fresh(entry("Cache-Control", "max-age=10"), 5*time.Second, parseCacheControl("min-fresh=6")))
+}
+
+func TestCacheStores(t *testing.T) {
+	e := &Entry{StatusCode: response.StatusOK, Headers: headers.Headers{"etag": `"x"`}, Body: []byte("0123456789")}
+
+	// Test: Memory store evicts the least recently used key
+	m := NewMemoryStore(40)
+	m.Set("a", []*Entry{e})
+	m.Set("b", []*Entry{e})
+	m.Get("a")
+	m.Set("c", []*Entry{e})
+	assert.NotNil(t, m.Get("a"))
+	assert.Nil(t, m.Get("b"))
+	assert.NotNil(t, m.Get("c"))
+	m.Set("a", nil)
+	assert.Nil(t, m.Get("a"))
+
+	// Test: Disk store persists across instances
+	dir := t.TempDir()
+	d, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	d.Set("http://example.test/", []*Entry{e})
+	d2, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	got := d2.Get("http://example.test/")
+	require.Len(t, got, 1)
+	assert.Equal(t, e.Body, got[0].Body)
+	assert.Equal(t, `"x"`, got[0].Headers["etag"])
+	d2.Set("http://example.test/", nil)
+	assert.Nil(t, d.Get("http://example.test/"))
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// Entry is a stored response.
+type Entry struct {
+	StatusCode   response.StatusCode
+	ReasonPhrase string
+	Headers      headers.Headers
+	Body         []byte
+	// Vary holds the values of the request headers named by Vary, which a
+	// request must match to be served this entry
+	Vary map[string]string
+	// RequestTime and ResponseTime bracket the exchange the entry came from,
+	// for the age calculation of RFC 9111 section 4.2.3
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for name, value := range e.Headers {
+		n += int64(len(name) + len(value))
+	}
+	return n
+}
+
+// Store keeps the variants of a response under its cache key.
+type Store interface {
+	Get(key string) []*Entry
+	// Set replaces the variants of key, removing it when entries is empty
+	Set(key string, entries []*Entry)
+}
+
+// MemoryStore is a Store that evicts the least recently used keys once it
+// holds more than its size limit.
+type MemoryStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	key     string
+	entries []*Entry
+	size    int64
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryStore) Get(key string) []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entries
+}
+
+func (s *MemoryStore) Set(key string, entries []*Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.remove(elem)
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	item := &memoryItem{key: key, entries: entries}
+	for _, e := range entries {
+		item.size += e.size()
+	}
+	if item.size > s.maxBytes {
+		return
+	}
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *MemoryStore) remove(elem *list.Element) {
+	item := s.lru.Remove(elem).(*memoryItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
+
+// DiskStore is a Store keeping one JSON file per key in a directory, so the
+// cache survives restarts. It has no size limit.
+type DiskStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *DiskStore) Get(key string) []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil
+	}
+	return entries
+}
+
+func (s *DiskStore) Set(key string, entries []*Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(key)
+	if len(entries) == 0 {
+		os.Remove(path)
+		return
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	// Write and rename so a reader never sees a partial file
+	tmp, err := os.CreateTemp(s.dir, "entry-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	os.Rename(tmp.Name(), path)
+}
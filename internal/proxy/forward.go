@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/client"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+const defaultTunnelDialTimeout = 30 * time.Second
+
+// ForwardProxy is an explicit proxy: clients send it absolute-form requests
+// such as GET http://example.test/ HTTP/1.1, which are forwarded, and
+// CONNECT example.test:443 requests, which open a tunnel to the target.
+type ForwardProxy struct {
+	// Allow lists the destinations requests may go to, each either a host or
+	// host:port. A host of "*" matches any host and "*.example.test" any
+	// subdomain of example.test, and without a port every port is allowed.
+	// Nothing is allowed when empty, so "*" is needed for an open proxy.
+	Allow []string
+	// Username and Password require clients to send matching Basic
+	// Proxy-Authorization credentials when Username is set
+	Username string
+	Password string
+	// Timeout limits forwarded exchanges like ReverseProxy.Timeout does. It
+	// doesn't apply to tunnels, which stay open until either side closes.
+	Timeout time.Duration
+	// DialTimeout limits connecting to a CONNECT target, 30 seconds when
+	// zero
+	DialTimeout time.Duration
+	// Client sends forwarded requests, like ReverseProxy.Client
+	Client *client.Client
+}
+
+var errNotAllowed = errors.New("destination not allowed")
+
+func (p *ForwardProxy) Serve(w *response.Writer, req *request.Request) {
+	if !p.authorized(req) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+pseudonym+`"`)
+		response.WriteError(w, response.StatusProxyAuthRequired, "Proxy authentication required")
+		return
+	}
+	if req.RequestLine.Method == "CONNECT" {
+		p.tunnel(w, req)
+		return
+	}
+
+	// A request that already went through this proxy was sent back to it,
+	// by a client or by forwarding to our own address
+	if viaUs(req) {
+		response.WriteError(w, response.StatusLoopDetected, "Request loops back to this proxy")
+		return
+	}
+
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		response.WriteError(w, response.StatusBadRequest, "Proxy requests need an absolute http or https target")
+		return
+	}
+	host, port, err := request.SplitHostPort(target.Host)
+	if err != nil {
+		response.WriteError(w, response.StatusBadRequest, "Invalid target host")
+		return
+	}
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !p.allowed(host, port) {
+		response.WriteError(w, response.StatusForbidden, errNotAllowed.Error())
+		return
+	}
+
+	upstream := &url.URL{Scheme: target.Scheme, Host: target.Host}
+	rp := &ReverseProxy{Upstream: upstream, Timeout: p.Timeout, Client: p.Client}
+	serve(w, req, nil, func(req *request.Request) (*client.Response, func(), error) {
+		return rp.forward(req, upstream)
+	})
+}
+
+// tunnel answers CONNECT host:port by connecting to the target and copying
+// bytes in both directions until either side closes (RFC 9110 section
+// 9.3.6).
+func (p *ForwardProxy) tunnel(w *response.Writer, req *request.Request) {
+	authority := req.RequestLine.RequestTarget
+	host, port, err := request.SplitHostPort(authority)
+	if err != nil || port == "" {
+		response.WriteError(w, response.StatusBadRequest, "CONNECT needs a host:port target")
+		return
+	}
+	if !p.allowed(host, port) {
+		response.WriteError(w, response.StatusForbidden, errNotAllowed.Error())
+		return
+	}
+
+	timeout := p.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultTunnelDialTimeout
+	}
+	target, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	conn, rw, err := w.Hijack()
+	if err != nil {
+		target.Close()
+		response.WriteError(w, response.StatusInternalServerError, "Tunnels aren't supported on this connection")
+		return
+	}
+	defer conn.Close()
+	defer target.Close()
+
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	// rw.Reader holds whatever the client sent right after the CONNECT
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, rw.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	// Closing both connections once either side is finished stops the other
+	// copy
+	<-done
+	conn.Close()
+	target.Close()
+	<-done
+}
+
+// authorized checks the Basic credentials of Proxy-Authorization (RFC 9110
+// section 11.7.2).
+func (p *ForwardProxy) authorized(req *request.Request) bool {
+	if p.Username == "" {
+		return true
+	}
+	value, err := req.Headers.Get("Proxy-Authorization")
+	if err != nil {
+		return false
+	}
+	scheme, encoded, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	// Both comparisons always run so the timing doesn't reveal which failed
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(p.Username))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(p.Password))
+	return userOK&passwordOK == 1
+}
+
+func (p *ForwardProxy) allowed(host, port string) bool {
+	for _, entry := range p.Allow {
+		allowHost, allowPort, err := request.SplitHostPort(entry)
+		if err != nil || (allowPort != "" && allowPort != port) {
+			continue
+		}
+		switch {
+		case allowHost == "*", allowHost == host:
+			return true
+		case strings.HasPrefix(allowHost, "*.") && strings.HasSuffix(host, allowHost[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// viaUs reports whether the Via header of req lists this proxy.
+func viaUs(req *request.Request) bool {
+	value, err := req.Headers.Get("Via")
+	if err != nil {
+		return false
+	}
+	for _, hop := range strings.Split(value, ",") {
+		fields := strings.Fields(hop)
+		if len(fields) >= 2 && fields[1] == pseudonym {
+			return true
+		}
+	}
+	return false
+}
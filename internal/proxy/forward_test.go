@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyExchange sends a raw request to the proxy at addr and parses the
+// response.
+func proxyExchange(t *testing.T, addr, raw string) *response.Response {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	req, err := request.NewBuilder("GET", "/").Build()
+	require.NoError(t, err)
+	resp, err := response.ResponseFromReader(conn, req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestForwardProxy(t *testing.T) {
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		auth := req.Headers["proxy-authorization"]
+		body := fmt.Sprintf("%s %s host=%s auth=%s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.Headers["host"], auth)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	})
+	upstreamAddr := strings.TrimPrefix(upstream, "http://")
+	_, upstreamPort, _ := net.SplitHostPort(upstreamAddr)
+
+	p := &ForwardProxy{
+		Allow:    []string{"127.0.0.1:" + upstreamPort, "*.example.test"},
+		Username: "dev",
+		Password: "secret",
+	}
+	proxyAddr := strings.TrimPrefix(startServer(t, p.Serve), "http://")
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("dev:secret")) + "\r\n"
+
+	// Test: Absolute-form requests are forwarded without the credentials
+	resp := proxyExchange(t, proxyAddr, "GET "+upstream+"/hello?x=1 HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n"+auth+"\r\n")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "GET /hello?x=1 host="+upstreamAddr+" auth=", string(resp.Body))
+
+	// Test: Missing or wrong credentials
+	resp = proxyExchange(t, proxyAddr, "GET "+upstream+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n\r\n")
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+	assert.Equal(t, `Basic realm="httpfromtcp"`, resp.Headers["proxy-authenticate"])
+	wrong := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("dev:nope")) + "\r\n"
+	resp = proxyExchange(t, proxyAddr, "GET "+upstream+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n"+wrong+"\r\n")
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+
+	// Test: Destinations outside the allow-list are refused
+	resp = proxyExchange(t, proxyAddr, "GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n"+auth+"\r\n")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+	resp = proxyExchange(t, proxyAddr, "CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n"+auth+"\r\n")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+
+	// Test: Origin-form requests aren't proxy requests
+	resp = proxyExchange(t, proxyAddr, "GET /hello HTTP/1.1\r\nHost: "+proxyAddr+"\r\n"+auth+"\r\n")
+	assert.Equal(t, response.StatusBadRequest, resp.StatusLine.StatusCode)
+
+	// Test: CONNECT opens a tunnel to the target
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+upstreamAddr+" HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n"+auth+"\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = io.WriteString(conn, "GET /tunnelled HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n\r\n")
+	require.NoError(t, err)
+	req, err := request.NewBuilder("GET", "/tunnelled").Build()
+	require.NoError(t, err)
+	resp, err = response.ResponseFromReader(reader, req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /tunnelled host="+upstreamAddr+" auth=", string(resp.Body))
+
+	// Test: The tunnel closes once the target does
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestForwardProxyAllow(t *testing.T) {
+	p := &ForwardProxy{Allow: []string{"localhost", "api.test:8080", "*.example.test:443", "[::1]:9000"}}
+	assert.True(t, p.allowed("localhost", "80"))
+	assert.True(t, p.allowed("localhost", "3000"))
+	assert.True(t, p.allowed("api.test", "8080"))
+	assert.False(t, p.allowed("api.test", "80"))
+	assert.True(t, p.allowed("www.example.test", "443"))
+	assert.False(t, p.allowed("example.test", "443"))
+	assert.False(t, p.allowed("www.example.test", "80"))
+	assert.True(t, p.allowed("::1", "9000"))
+	assert.False(t, p.allowed("evil.test", "443"))
+	assert.True(t, (&ForwardProxy{Allow: []string{"*"}}).allowed("evil.test", "443"))
+}
+
+func TestForwardProxyDefaultDeny(t *testing.T) {
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		response.WriteError(w, response.StatusOK, "reached")
+	})
+	upstreamAddr := strings.TrimPrefix(upstream, "http://")
+
+	// Test: Without an allow-list nothing is forwarded or tunnelled
+	p := &ForwardProxy{}
+	assert.False(t, p.allowed("127.0.0.1", "80"))
+	proxyAddr := strings.TrimPrefix(startServer(t, p.Serve), "http://")
+	resp := proxyExchange(t, proxyAddr, "GET "+upstream+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n\r\n")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+	resp = proxyExchange(t, proxyAddr, "CONNECT "+upstreamAddr+" HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n\r\n")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+
+	// Test: A request forwarded back to the proxy isn't forwarded again
+	p = &ForwardProxy{Allow: []string{"*"}}
+	proxyURL := startServer(t, p.Serve)
+	proxyAddr = strings.TrimPrefix(proxyURL, "http://")
+	resp = proxyExchange(t, proxyAddr, "GET "+proxyURL+"/ HTTP/1.1\r\nHost: "+proxyAddr+"\r\n\r\n")
+	assert.Equal(t, response.StatusLoopDetected, resp.StatusLine.StatusCode)
+	resp = proxyExchange(t, proxyAddr, "GET "+upstream+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n\r\n")
+	assert.Equal(t, "reached", string(resp.Body))
+}
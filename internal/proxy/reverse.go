@@ -0,0 +1,337 @@
+// Package proxy forwards requests to other servers.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/client"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// pseudonym identifies the proxy in Via headers.
+const pseudonym = "httpfromtcp"
+
+// hopHeaders only apply to a single connection and are never forwarded
+// (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ReverseProxy is a handler that forwards requests to an upstream server and
+// streams the response back.
+type ReverseProxy struct {
+	// Upstream is the base URL requests are sent to. Its path is prefixed to
+	// the request path.
+	Upstream *url.URL
+	// Rewrite maps the incoming origin-form target to the one sent upstream,
+	// before the upstream path is prefixed
+	Rewrite func(target string) string
+	// PreserveHost forwards the incoming Host header instead of the
+	// upstream's
+	PreserveHost bool
+	// Timeout limits the whole exchange with the upstream, answering 504 when
+	// it expires. No limit when zero.
+	Timeout time.Duration
+	// Client sends the upstream requests. It must not follow redirects since
+	// those are for the downstream client to see; the default doesn't.
+	Client *client.Client
+	// Cache stores cacheable responses when set
+	Cache *Cache
+}
+
+var defaultClient = &client.Client{
+	CheckRedirect: func(*request.Request, []*request.Request) error {
+		return client.ErrUseLastResponse
+	},
+}
+
+// NewReverseProxy returns a proxy to the upstream base URL.
+func NewReverseProxy(upstream string) (*ReverseProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q", upstream)
+	}
+	return &ReverseProxy{Upstream: u}, nil
+}
+
+// StripPrefix returns a Rewrite function that removes prefix from the path.
+func StripPrefix(prefix string) func(string) string {
+	return func(target string) string {
+		target = strings.TrimPrefix(target, prefix)
+		if !strings.HasPrefix(target, "/") {
+			target = "/" + target
+		}
+		return target
+	}
+}
+
+func (p *ReverseProxy) Serve(w *response.Writer, req *request.Request) {
+	serve(w, req, p.Cache, func(req *request.Request) (*client.Response, func(), error) {
+		return p.forward(req, p.Upstream)
+	})
+}
+
+// fetchFunc gets the upstream response for req. release must be called once
+// the response body is no longer needed.
+type fetchFunc func(req *request.Request) (resp *client.Response, release func(), err error)
+
+// serve answers req with the response from fetch, going through cache when
+// there is one.
+func serve(w *response.Writer, req *request.Request, cache *Cache, fetch fetchFunc) {
+	if cache != nil {
+		cache.serve(w, req, fetch)
+		return
+	}
+	resp, release, err := fetch(req)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer release()
+	copyResponse(w, resp)
+}
+
+// forward sends req to upstream and returns the response headers.
+func (p *ReverseProxy) forward(req *request.Request, upstream *url.URL) (*client.Response, func(), error) {
+	out, err := p.outgoing(req, upstream)
+	if err != nil {
+		return nil, nil, errBadRequest{err}
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if p.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+	}
+	c := p.Client
+	if c == nil {
+		c = defaultClient
+	}
+	resp, err := c.DoContext(ctx, out)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	release := func() {
+		resp.Body.Close()
+		cancel()
+	}
+	return resp, release, nil
+}
+
+// errBadRequest is a request that can't be forwarded at all.
+type errBadRequest struct {
+	err error
+}
+
+func (e errBadRequest) Error() string {
+	return e.err.Error()
+}
+
+// writeUpstreamError answers for an upstream that couldn't be reached or
+// didn't answer in time.
+func writeUpstreamError(w *response.Writer, err error) {
+	var badRequest errBadRequest
+	switch {
+	case errors.As(err, &badRequest):
+		response.WriteError(w, response.StatusBadRequest, fmt.Sprintf("Invalid request %v", err))
+	case errors.Is(err, errNoUpstream):
+		response.WriteError(w, response.StatusServiceUnavailable, "No upstream available")
+	case isTimeout(err):
+		response.WriteError(w, response.StatusGatewayTimeout, "Upstream timed out")
+	default:
+		response.WriteError(w, response.StatusBadGateway, fmt.Sprintf("Upstream failed %v", err))
+	}
+}
+
+// outgoing builds the request to send to upstream from req.
+func (p *ReverseProxy) outgoing(req *request.Request, upstream *url.URL) (*request.Request, error) {
+	target := req.RequestLine.RequestTarget
+	if !strings.HasPrefix(target, "/") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		target = u.RequestURI()
+	}
+	if p.Rewrite != nil {
+		target = p.Rewrite(target)
+	}
+	rewritten, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, err
+	}
+	u := *upstream
+	u.RawPath = joinPath(u.EscapedPath(), rewritten.EscapedPath())
+	u.Path = joinPath(u.Path, rewritten.Path)
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = rewritten.RawQuery
+	case rewritten.RawQuery != "":
+		u.RawQuery += "&" + rewritten.RawQuery
+	}
+
+	// A body the client holds back for 100 Continue is asked for here
+	if err := req.ReadBody(); err != nil {
+		return nil, err
+	}
+	b := request.NewBuilder(req.RequestLine.Method, u.String())
+	out, err := b.BodyBytes(req.Body).Build()
+	if err != nil {
+		return nil, err
+	}
+	upstreamHost := out.Headers["host"]
+	for name, value := range req.Headers {
+		out.Headers.Overwrite(name, value)
+	}
+	removeHopHeaders(out.Headers)
+	// The body is sent with a Content-Length computed from it when written,
+	// and it is already here, so there is nothing to expect
+	out.Headers.Delete("Content-Length")
+	out.Headers.Delete("Expect")
+	out.Headers.Delete("Trailer")
+	if !p.PreserveHost {
+		out.Headers.Overwrite("Host", upstreamHost)
+	}
+	if te, err := req.Headers.Get("TE"); err == nil && hasToken(te, "trailers") {
+		out.Headers.Overwrite("TE", "trailers")
+	}
+	addForwarded(out.Headers, req)
+	return out, nil
+}
+
+// addForwarded records the hop through this proxy in the X-Forwarded-* and
+// Via headers.
+func addForwarded(h headers.Headers, req *request.Request) {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		h.Set("X-Forwarded-For", ip)
+	}
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	h.Overwrite("X-Forwarded-Proto", scheme)
+	if host, err := req.Headers.Get("Host"); err == nil {
+		h.Overwrite("X-Forwarded-Host", host)
+	}
+	h.Set("Via", via(req.RequestLine.HttpVersion))
+}
+
+func via(version string) string {
+	if version == "" {
+		version = "1.1"
+	}
+	return version + " " + pseudonym
+}
+
+// copyResponse streams resp to w, passing through the status, the end to end
+// headers, the body and the trailers.
+func copyResponse(w *response.Writer, resp *client.Response) {
+	h := headers.NewHeaders()
+	for name, value := range resp.Headers {
+		h.Overwrite(name, value)
+	}
+	removeHopHeaders(h)
+	h.Set("Via", via(resp.StatusLine.HttpVersion))
+
+	w.WriteStatusLineReason(resp.StatusLine.StatusCode, resp.StatusLine.ReasonPhrase)
+	if err := w.WriteHeaders(h); err != nil {
+		w.Abort()
+		return
+	}
+
+	chunkedBody, err := response.NewChunkedWriter(w)
+	if err != nil {
+		// A body with a length goes straight to the connection, which keeps
+		// a streamed upstream response streamed as well
+		if _, err := w.ReadFrom(resp.Body); err != nil {
+			w.Abort()
+		}
+		return
+	}
+
+	// Each read is flushed so streamed upstream responses stay streamed
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := chunkedBody.Write(buf[:n]); err != nil {
+				w.Abort()
+				return
+			}
+			chunkedBody.Flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.Abort()
+			return
+		}
+	}
+
+	for name, value := range resp.Trailers {
+		chunkedBody.Trailer().Set(name, value)
+	}
+	chunkedBody.Close()
+}
+
+func removeHopHeaders(h headers.Headers) {
+	// Fields listed in Connection are hop-by-hop as well
+	if connection, err := h.Get("Connection"); err == nil {
+		for _, name := range strings.Split(connection, ",") {
+			h.Delete(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Delete(name)
+	}
+}
+
+func hasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		v, _, _ = strings.Cut(v, ";")
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPath(base, path string) string {
+	switch {
+	case base == "" || base == "/":
+		return path
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+	return base + path
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
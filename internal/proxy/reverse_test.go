@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/client"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func fetch(t *testing.T, req *request.Request) (*client.Response, string) {
+	c := &client.Client{CheckRedirect: func(*request.Request, []*request.Request) error {
+		return client.ErrUseLastResponse
+	}}
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		switch {
+		case strings.HasPrefix(req.RequestLine.RequestTarget, "/api/stream"):
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Delete("Connection")
+			h.Set("Trailer", "X-Checksum")
+			w.WriteHeaders(h)
+			body, err := response.NewChunkedWriter(w)
+			if err != nil {
+				return
+			}
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(body, "event %d\n", i)
+				body.Flush()
+			}
+			body.Trailer().Set("X-Checksum", "abc")
+			body.Close()
+		case strings.HasPrefix(req.RequestLine.RequestTarget, "/api/missing"):
+			h := response.GetDefaultHeaders(0)
+			h.Set("X-Upstream", "yes")
+			h.Set("Keep-Alive", "timeout=5")
+			w.WriteStatusLineReason(response.StatusNotFound, "Nope")
+			w.WriteHeaders(h)
+		case strings.HasPrefix(req.RequestLine.RequestTarget, "/api/slow"):
+			time.Sleep(200 * time.Millisecond)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		default:
+			var lines []string
+			for _, name := range []string{"host", "x-custom", "x-forwarded-for", "x-forwarded-proto", "x-forwarded-host", "via", "x-hop", "connection", "content-length"} {
+				lines = append(lines, name+"="+req.Headers[name])
+			}
+			lines = append(lines, req.RequestLine.Method+" "+req.RequestLine.RequestTarget, string(req.Body))
+			body := strings.Join(lines, "\n")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		}
+	})
+	upstreamURL, err := url.Parse(upstream + "/api")
+	require.NoError(t, err)
+	p := &ReverseProxy{
+		Upstream: upstreamURL,
+		Rewrite:  StripPrefix("/proxy"),
+		Timeout:  100 * time.Millisecond,
+	}
+	base := startServer(t, p.Serve)
+
+	// Test: Method, path, query, headers and body are forwarded
+	req, err := request.NewBuilder("POST", base+"/proxy/echo%20this?q=1").
+		Header("X-Custom", "kept").
+		Header("Connection", "X-Hop").
+		Header("X-Hop", "dropped").
+		BodyBytes([]byte("payload")).
+		Build()
+	require.NoError(t, err)
+	resp, body := fetch(t, req)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, strings.Join([]string{
+		"host=" + upstreamURL.Host,
+		"x-custom=kept",
+		"x-forwarded-for=127.0.0.1",
+		"x-forwarded-proto=http",
+		"x-forwarded-host=" + base[len("http://"):],
+		"via=1.1 httpfromtcp",
+		"x-hop=",
+		"connection=",
+		"content-length=7",
+		"POST /api/echo%20this?q=1",
+		"payload",
+	}, "\n"), body)
+	assert.Equal(t, "1.1 httpfromtcp", resp.Headers["via"])
+
+	// Test: Upstream status, reason and headers pass through
+	req, err = request.NewBuilder("GET", base+"/proxy/missing").Build()
+	require.NoError(t, err)
+	resp, _ = fetch(t, req)
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+	assert.Equal(t, "Nope", resp.StatusLine.ReasonPhrase)
+	assert.Equal(t, "yes", resp.Headers["x-upstream"])
+	assert.NotContains(t, resp.Headers, "keep-alive")
+
+	// Test: Streamed body and trailers
+	req, err = request.NewBuilder("GET", base+"/proxy/stream").Header("TE", "trailers").Build()
+	require.NoError(t, err)
+	resp, body = fetch(t, req)
+	assert.Equal(t, "event 0\nevent 1\nevent 2\n", body)
+	assert.Equal(t, "chunked", resp.Headers["transfer-encoding"])
+	assert.Equal(t, "abc", resp.Trailers["x-checksum"])
+
+	// Test: Slow upstream
+	req, err = request.NewBuilder("GET", base+"/proxy/slow").Build()
+	require.NoError(t, err)
+	resp, _ = fetch(t, req)
+	assert.Equal(t, response.StatusGatewayTimeout, resp.StatusLine.StatusCode)
+
+	// Test: Unreachable upstream
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	listener.Close()
+	p.Upstream = &url.URL{Scheme: "http", Host: closedAddr}
+	req, err = request.NewBuilder("GET", base+"/proxy/").Build()
+	require.NoError(t, err)
+	resp, _ = fetch(t, req)
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+}
+
+func TestJoinPath(t *testing.T) {
+	assert.Equal(t, "/a", joinPath("", "/a"))
+	assert.Equal(t, "/a", joinPath("/", "/a"))
+	assert.Equal(t, "/api/a", joinPath("/api", "/a"))
+	assert.Equal(t, "/api/a", joinPath("/api/", "/a"))
+	assert.Equal(t, "/api/a", joinPath("/api", "a"))
+}
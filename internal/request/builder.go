@@ -0,0 +1,138 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/cookie"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+)
+
+// Builder constructs a Request programmatically:
+//
+//	req, err := request.NewBuilder("POST", "http://localhost:42010/submit").
+//		Header("Content-Type", "application/json").
+//		Body(strings.NewReader(`{"ok": true}`)).
+//		Build()
+type Builder struct {
+	req *Request
+	err error
+}
+
+// NewBuilder starts a request for target, which is either an origin-form
+// path such as "/coffee?size=large" or an absolute URL. An absolute URL sets
+// the Host header and Scheme and is sent in origin-form.
+func NewBuilder(method, target string) *Builder {
+	b := &Builder{
+		req: &Request{
+			RequestLine: RequestLine{
+				Method:        method,
+				RequestTarget: target,
+				HttpVersion:   "1.1",
+			},
+			Headers:  headers.NewHeaders(),
+			Trailers: headers.NewHeaders(),
+			State:    requestStateDone,
+		},
+	}
+
+	if !strings.HasPrefix(target, "/") && target != "*" {
+		u, err := url.Parse(target)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			b.err = fmt.Errorf("invalid request target %q", target)
+			return b
+		}
+		b.req.RequestLine.RequestTarget = u.RequestURI()
+		b.req.Scheme = strings.ToLower(u.Scheme)
+		b.Header("Host", u.Host)
+	}
+	return b
+}
+
+// Header adds a header field, combining it with earlier values of the same
+// name.
+func (b *Builder) Header(name, value string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if !headers.IsValidFieldName(name) || !headers.IsValidFieldValue(value) {
+		b.err = fmt.Errorf("invalid header %q", name)
+		return b
+	}
+	b.req.Headers.Set(name, value)
+	b.req.addHeaderOrder(name)
+	return b
+}
+
+// Cookie adds the name and value of c to the Cookie header.
+func (b *Builder) Cookie(c *cookie.Cookie) *Builder {
+	if b.err != nil {
+		return b
+	}
+	pair := c.Name + "=" + c.Value
+	if parsed := cookie.Parse(pair); len(parsed) != 1 || *parsed[0] != (cookie.Cookie{Name: c.Name, Value: c.Value}) {
+		b.err = fmt.Errorf("invalid cookie %q", c.Name)
+		return b
+	}
+	return b.Header("Cookie", pair)
+}
+
+// Body streams the request body from r. Readers with a known size get a
+// Content-Length, anything else is sent chunked.
+func (b *Builder) Body(r io.Reader) *Builder {
+	if b.err != nil {
+		return b
+	}
+	b.req.BodyReader = r
+	switch v := r.(type) {
+	case *bytes.Buffer:
+		b.Header("Content-Length", strconv.Itoa(v.Len()))
+	case *bytes.Reader:
+		b.Header("Content-Length", strconv.Itoa(v.Len()))
+	case *strings.Reader:
+		b.Header("Content-Length", strconv.Itoa(v.Len()))
+	}
+	return b
+}
+
+// BodyBytes sets a body that is already in memory.
+func (b *Builder) BodyBytes(body []byte) *Builder {
+	b.req.Body = body
+	b.req.BodyReader = nil
+	return b
+}
+
+// Trailer sets a trailer field, which forces a chunked body.
+func (b *Builder) Trailer(name, value string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if !headers.IsValidFieldName(name) || !headers.IsValidFieldValue(value) {
+		b.err = fmt.Errorf("invalid trailer %q", name)
+		return b
+	}
+	b.req.Trailers.Set(name, value)
+	if _, err := b.req.Headers.Get("Transfer-Encoding"); err != nil {
+		b.req.Headers.Delete("Content-Length")
+		b.Header("Transfer-Encoding", "chunked")
+	}
+	return b
+}
+
+func (b *Builder) Build() (*Request, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if err := validateRequestLine(b.req.RequestLine.Method, b.req.RequestLine.RequestTarget); err != nil {
+		return nil, err
+	}
+	if !isUpper(b.req.RequestLine.Method) {
+		return nil, errors.New("invalid method")
+	}
+	return b.req, nil
+}
@@ -0,0 +1,28 @@
+package request
+
+import (
+	"errors"
+
+	"github.com/derjabineli/httpfromtcp/internal/cookie"
+)
+
+var ErrNoCookie = errors.New("named cookie not present")
+
+// Cookies returns the cookies sent in the Cookie header.
+func (r *Request) Cookies() []*cookie.Cookie {
+	value, err := r.Headers.Get("Cookie")
+	if err != nil {
+		return nil
+	}
+	return cookie.Parse(value)
+}
+
+// Cookie returns the first cookie called name, or ErrNoCookie.
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
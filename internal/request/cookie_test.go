@@ -0,0 +1,41 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/cookie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookies(t *testing.T) {
+	// Test: Repeated Cookie fields are combined
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: session=abc; theme=dark\r\nCookie: lang=en\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	cookies := r.Cookies()
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "lang", cookies[2].Name)
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", c.Value)
+	_, err = r.Cookie("missing")
+	assert.ErrorIs(t, err, ErrNoCookie)
+
+	// Test: No Cookie header
+	r, err = NewBuilder("GET", "/").Build()
+	require.NoError(t, err)
+	assert.Empty(t, r.Cookies())
+
+	// Test: Builder
+	r, err = NewBuilder("GET", "/").
+		Cookie(&cookie.Cookie{Name: "a", Value: "1"}).
+		Cookie(&cookie.Cookie{Name: "b", Value: "2"}).
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, "a=1; b=2", r.Headers["cookie"])
+	_, err = NewBuilder("GET", "/").Cookie(&cookie.Cookie{Name: "a", Value: "1; b=2"}).Build()
+	assert.Error(t, err)
+}
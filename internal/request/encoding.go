@@ -0,0 +1,95 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content-encoding")
+	ErrBodyTooLarge        = errors.New("decoded body too large")
+)
+
+// DecodeBody undoes the gzip and deflate content codings listed in
+// Content-Encoding, last applied first, and replaces Body with the result.
+// Content-Encoding is removed and Content-Length updated afterwards. Each
+// decoded layer may be at most maxSize bytes, which keeps a small compressed
+// body from expanding without bound; there is no limit when maxSize is zero.
+// Unknown codings are reported with ErrUnsupportedEncoding before anything
+// is decoded, and a body still in BodyReader is read into Body first.
+func (r *Request) DecodeBody(maxSize int64) error {
+	value, err := r.Headers.Get("Content-Encoding")
+	if err != nil {
+		return nil
+	}
+	var codings []string
+	for _, coding := range strings.Split(value, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate":
+			codings = append(codings, coding)
+		default:
+			return fmt.Errorf("%w %q", ErrUnsupportedEncoding, coding)
+		}
+	}
+
+	if err := r.ReadBody(); err != nil {
+		return err
+	}
+	body := r.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		body, err = decodeBody(codings[i], body, maxSize)
+		if err != nil {
+			return err
+		}
+	}
+	r.Body = body
+	r.Headers.Delete("Content-Encoding")
+	if _, err := r.Headers.Get("Content-Length"); err == nil {
+		r.Headers.Overwrite("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+func decodeBody(coding string, body []byte, maxSize int64) ([]byte, error) {
+	var reader io.Reader
+	var err error
+	switch {
+	case coding != "deflate":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case isZlib(body):
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		// Some clients send raw deflate data without the zlib wrapper
+		// that RFC 9110 section 8.4.1.2 calls for
+		reader = flate.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %w", coding, err)
+	}
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %w", coding, err)
+	}
+	if maxSize > 0 && int64(len(decoded)) > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// isZlib checks for the zlib header of RFC 1950: the deflate method and a
+// check value making the first two bytes a multiple of 31.
+func isZlib(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
@@ -0,0 +1,90 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func encodedRequest(t *testing.T, encoding string, body []byte) *Request {
+	raw := "POST /batch HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: " + encoding +
+		"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+	r, err := RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 64})
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	batch := []byte(`[{"id": 1}, {"id": 2}]`)
+
+	// Test: gzip
+	r := encodedRequest(t, "gzip", gzipBytes(t, batch))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, batch, r.Body)
+	assert.NotContains(t, r.Headers, "content-encoding")
+	assert.Equal(t, strconv.Itoa(len(batch)), r.Headers["content-length"])
+
+	// Test: deflate with and without the zlib wrapper
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	zw.Write(batch)
+	zw.Close()
+	r = encodedRequest(t, "deflate", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, batch, r.Body)
+	buf = &bytes.Buffer{}
+	fw, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	fw.Write(batch)
+	fw.Close()
+	r = encodedRequest(t, "deflate", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, batch, r.Body)
+
+	// Test: Stacked codings are undone last first
+	r = encodedRequest(t, "gzip, identity, gzip", gzipBytes(t, gzipBytes(t, batch)))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, batch, r.Body)
+
+	// Test: Unknown codings
+	r = encodedRequest(t, "gzip, br", batch)
+	assert.ErrorIs(t, r.DecodeBody(1024), ErrUnsupportedEncoding)
+	assert.Equal(t, batch, r.Body)
+
+	// Test: Decoded size limit
+	bomb := gzipBytes(t, []byte(strings.Repeat("0", 1<<20)))
+	r = encodedRequest(t, "gzip", bomb)
+	assert.ErrorIs(t, r.DecodeBody(1024), ErrBodyTooLarge)
+	require.NoError(t, r.DecodeBody(0))
+	assert.Len(t, r.Body, 1<<20)
+
+	// Test: Corrupt data
+	r = encodedRequest(t, "gzip", []byte("not gzip"))
+	err := r.DecodeBody(1024)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrBodyTooLarge)
+	truncated := gzipBytes(t, batch)
+	r = encodedRequest(t, "gzip", truncated[:len(truncated)-4])
+	assert.ErrorIs(t, r.DecodeBody(1024), io.ErrUnexpectedEOF)
+
+	// Test: identity leaves the body alone
+	r = encodedRequest(t, "identity", batch)
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, batch, r.Body)
+}
@@ -0,0 +1,49 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrUnsupportedExpectation = errors.New("unsupported expectation")
+
+// ValidateExpect checks the Expect header. The only expectation defined is
+// 100-continue (RFC 9110 section 10.1.1), anything else fails. It reports
+// whether the client is waiting for a 100 Continue before it sends the body,
+// which a request without a body never is.
+func (r *Request) ValidateExpect() (bool, error) {
+	value, err := r.Headers.Get("Expect")
+	if err != nil {
+		return false, nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(value), "100-continue") {
+		return false, fmt.Errorf("%w %q", ErrUnsupportedExpectation, value)
+	}
+	return r.RequestLine.HttpVersion != "1.0" && r.hasBody(), nil
+}
+
+// hasBody reports whether the headers announce a body.
+func (r *Request) hasBody() bool {
+	if _, err := r.Headers.Get("Transfer-Encoding"); err == nil {
+		return true
+	}
+	cl, err := r.Headers.Get("Content-Length")
+	return err == nil && cl != "0"
+}
+
+// ReadBody reads a streamed body from BodyReader into Body, for handlers
+// that need all of it. It does nothing when there is no BodyReader.
+func (r *Request) ReadBody() error {
+	if r.BodyReader == nil {
+		return nil
+	}
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	r.BodyReader = nil
+	return nil
+}
@@ -0,0 +1,87 @@
+package request
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateExpect(t *testing.T) {
+	build := func(fields ...string) *Request {
+		b := NewBuilder("POST", "/upload")
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.Header(fields[i], fields[i+1])
+		}
+		r, err := b.Build()
+		require.NoError(t, err)
+		return r
+	}
+
+	// Test: 100-continue with a body
+	expect, err := build("Expect", "100-Continue", "Content-Length", "5").ValidateExpect()
+	require.NoError(t, err)
+	assert.True(t, expect)
+	expect, err = build("Expect", "100-continue", "Transfer-Encoding", "chunked").ValidateExpect()
+	require.NoError(t, err)
+	assert.True(t, expect)
+
+	// Test: Nothing to wait for
+	expect, err = build("Expect", "100-continue").ValidateExpect()
+	require.NoError(t, err)
+	assert.False(t, expect)
+	expect, err = build("Expect", "100-continue", "Content-Length", "0").ValidateExpect()
+	require.NoError(t, err)
+	assert.False(t, expect)
+	expect, err = build("Content-Length", "5").ValidateExpect()
+	require.NoError(t, err)
+	assert.False(t, expect)
+
+	// Test: Other expectations
+	_, err = build("Expect", "200-ok", "Content-Length", "5").ValidateExpect()
+	assert.ErrorIs(t, err, ErrUnsupportedExpectation)
+}
+
+func TestReaderBodyReader(t *testing.T) {
+	// Test: A Content-Length body streamed after the header
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world" +
+			"POST /second HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"6\r\nhello \r\n6\r\nworld!\r\n0\r\nX-Sum: 1\r\n\r\n" +
+			"GET /third HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err := reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	body, err := io.ReadAll(reader.BodyReader(r))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Empty(t, r.Body)
+
+	// Test: A chunked one, with its trailers
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	r.BodyReader = reader.BodyReader(r)
+	require.NoError(t, r.ReadBody())
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Nil(t, r.BodyReader)
+	assert.Equal(t, "1", r.Trailers["x-sum"])
+
+	// Test: Then the next request
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+
+	// Test: A body cut short
+	reader = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nhello",
+		numBytesPerRead: 64,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader.BodyReader(r))
+	require.Error(t, err)
+}
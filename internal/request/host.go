@@ -0,0 +1,145 @@
+package request
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMissingHost   = errors.New("missing host header")
+	ErrDuplicateHost = errors.New("duplicate host header")
+	ErrMalformedHost = errors.New("malformed host header")
+)
+
+// ValidateHost enforces the Host rules of RFC 9112 section 3.2 and stores
+// the effective authority in r.Host. Every HTTP/1.1 request needs exactly
+// one well formed Host header, but an absolute-form target takes precedence
+// over whatever the header says, so only the target is validated then and
+// the header may even be empty.
+func (r *Request) ValidateHost() error {
+	value, exists := r.Headers["host"]
+	if !exists {
+		return ErrMissingHost
+	}
+	// Headers joins repeated fields with a comma and a host never contains one
+	if strings.Contains(value, ",") {
+		return ErrDuplicateHost
+	}
+	if authority, ok := absoluteFormAuthority(r.RequestLine.RequestTarget); ok {
+		value = authority
+	}
+	host, port, err := SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+
+	r.Host = JoinHostPort(host, port)
+	return nil
+}
+
+// Hostname returns the host of r.Host without the port or IPv6 brackets.
+func (r *Request) Hostname() string {
+	host, _, err := SplitHostPort(r.Host)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// Port returns the port of r.Host, or an empty string when none was given.
+func (r *Request) Port() string {
+	_, port, err := SplitHostPort(r.Host)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// SplitHostPort splits a uri-host with an optional port. IPv6 literals must
+// be enclosed in brackets, which are stripped from the returned host. Hosts
+// are lowercased since they compare case-insensitively.
+func SplitHostPort(hostport string) (host, port string, err error) {
+	if hostport == "" {
+		return "", "", ErrMalformedHost
+	}
+
+	if hostport[0] == '[' {
+		end := strings.IndexByte(hostport, ']')
+		if end == -1 {
+			return "", "", ErrMalformedHost
+		}
+		host = hostport[1:end]
+		ip := net.ParseIP(host)
+		if ip == nil || !strings.Contains(host, ":") {
+			return "", "", ErrMalformedHost
+		}
+		rest := hostport[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return "", "", ErrMalformedHost
+			}
+			port = rest[1:]
+		}
+	} else {
+		if strings.Count(hostport, ":") > 1 {
+			return "", "", ErrMalformedHost
+		}
+		host = hostport
+		if i := strings.IndexByte(hostport, ':'); i != -1 {
+			host, port = hostport[:i], hostport[i+1:]
+		}
+		if host == "" || !isValidRegName(host) {
+			return "", "", ErrMalformedHost
+		}
+	}
+
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 0 || n > 65535 || strings.ContainsAny(port, "+-") {
+			return "", "", ErrMalformedHost
+		}
+	}
+	return strings.ToLower(host), port, nil
+}
+
+// JoinHostPort is the inverse of SplitHostPort.
+func JoinHostPort(host, port string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+// absoluteFormAuthority returns the authority of an absolute-form request
+// target such as http://example.test/path.
+func absoluteFormAuthority(target string) (string, bool) {
+	if strings.HasPrefix(target, "/") || target == "*" {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return "", false
+	}
+	return u.Host, true
+}
+
+// isValidRegName reports whether s only holds characters allowed in a
+// reg-name or IPv4 address (RFC 3986 section 3.2.2).
+func isValidRegName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~!$&'()*+;=%", c) != -1:
+		default:
+			return false
+		}
+	}
+	return true
+}
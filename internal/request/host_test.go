@@ -0,0 +1,101 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateHost(t *testing.T) {
+	// Test: Valid host with port
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: LocalHost:42069\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "localhost:42069", r.Host)
+	assert.Equal(t, "localhost", r.Hostname())
+	assert.Equal(t, "42069", r.Port())
+
+	// Test: Missing host
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ValidateHost(), ErrMissingHost)
+
+	// Test: Duplicate host
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: anotherHost:8080\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ValidateHost(), ErrDuplicateHost)
+
+	// Test: Malformed host
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: local host:99999\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ValidateHost(), ErrMalformedHost)
+
+	// Test: Absolute-form target overrides the host header
+	reader = &chunkReader{
+		data:            "GET http://Example.test:8080/coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "example.test:8080", r.Host)
+
+	// Test: Absolute-form target with an empty host header
+	reader = &chunkReader{
+		data:            "GET http://example.test/coffee HTTP/1.1\r\nHost:\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "example.test", r.Host)
+
+	// Test: Absolute-form target with a malformed authority
+	reader = &chunkReader{
+		data:            "GET http://example.test:99999/ HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ValidateHost(), ErrMalformedHost)
+}
+
+func TestSplitHostPort(t *testing.T) {
+	host, port, err := SplitHostPort("[::1]:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", host)
+	assert.Equal(t, "8080", port)
+
+	host, port, err = SplitHostPort("[2001:DB8::1]")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", host)
+	assert.Equal(t, "", port)
+	assert.Equal(t, "[2001:db8::1]", JoinHostPort(host, port))
+
+	host, port, err = SplitHostPort("127.0.0.1:80")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.Equal(t, "80", port)
+
+	for _, bad := range []string{"", "::1", "[::1", "[example]:80", "[::1]80", "host:port", ":80", "host:-1", "host:65536", "ex/ample"} {
+		_, _, err = SplitHostPort(bad)
+		assert.ErrorIs(t, err, ErrMalformedHost, bad)
+	}
+}
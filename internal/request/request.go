@@ -8,6 +8,7 @@ import (
 	"strings"
 	"unicode"
 
+	"github.com/derjabineli/httpfromtcp/internal/chunked"
 	"github.com/derjabineli/httpfromtcp/internal/headers"
 )
 
@@ -27,6 +28,23 @@ type Request struct {
   Headers headers.Headers
   State ParserState
   Body []byte
+  // Host is the effective authority, set by ValidateHost
+  Host string
+  // Scheme is "http" or "https", used by the client to decide whether the
+  // connection needs TLS. Empty means http.
+  Scheme string
+  // BodyReader, when set, is sent by WriteTo instead of Body
+  BodyReader io.Reader
+  // Trailers are sent after a chunked body by WriteTo
+  Trailers headers.Headers
+  // RemoteAddr is the address of the client, set by the server
+  RemoteAddr string
+  decoder *chunked.Decoder
+  // bodyParsed counts the bytes of a Content-Length body parsed so far,
+  // which a BodyReader takes out of Body again
+  bodyParsed int
+  // headerOrder lists the header names in the order they first appeared
+  headerOrder []string
 }
 
 type RequestLine struct {
@@ -35,43 +53,189 @@ type RequestLine struct {
   HttpVersion   string
 }
 
+// Reader reads successive requests from a persistent connection. Bytes
+// received past the end of one request stay buffered for the next.
+type Reader struct {
+  reader io.Reader
+  buffer []byte
+  readToIndex int
+}
+
+func NewReader(reader io.Reader) *Reader {
+  return &Reader{
+    reader: reader,
+    buffer: make([]byte, bufferSize),
+  }
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
-  buffer := make([]byte, bufferSize)
-  readToIndex := 0
+  requestReader := NewReader(reader)
+  request, err := requestReader.ReadRequest()
+  if err != nil {
+    if errors.Is(err, io.EOF) {
+      return nil, errors.New("incomplete request")
+    }
+    return nil, err
+  }
+  // Nothing should follow a single request with a declared length
+  if _, err := request.Headers.Get("Content-Length"); err == nil && requestReader.readToIndex > 0 {
+    return nil, errors.New("request body size exceeds content length")
+  }
+  return request, nil
+}
+
+// ReadRequest reads the next request. It returns io.EOF if the connection
+// was closed before a new request started.
+func (rr *Reader) ReadRequest() (*Request, error) {
+  request, err := rr.ReadRequestHeader()
+  if err != nil {
+    return nil, err
+  }
+  if err := rr.ReadBody(request); err != nil {
+    return nil, err
+  }
+  return request, nil
+}
+
+// ReadRequestHeader reads the next request up to the end of its header
+// section, leaving the body to ReadBody or BodyReader, which must be done
+// with it before the next request is read. It returns io.EOF if the
+// connection was closed before a new request started.
+func (rr *Reader) ReadRequestHeader() (*Request, error) {
   request := &Request{
     State: requestStateInitialized,
     Headers: headers.NewHeaders(),
+    Trailers: headers.NewHeaders(),
   }
-  for request.State != requestStateDone {
-    if readToIndex >= len(buffer) {
-      newBuf := make([]byte, len(buffer) * 2)
-      copy(newBuf, buffer)
-      buffer = newBuf
+  err := rr.parseUntil(request, func() bool {
+    return request.State != requestStateInitialized && request.State != requestStateParsingHeaders
+  })
+  if err != nil {
+    return nil, err
+  }
+  return request, nil
+}
+
+// ReadBody reads the rest of the body of a request from ReadRequestHeader
+// into its Body.
+func (rr *Reader) ReadBody(request *Request) error {
+  return rr.parseUntil(request, func() bool {
+    return request.State == requestStateDone
+  })
+}
+
+// BodyReader streams the rest of the body of a request from
+// ReadRequestHeader instead of reading it into Body.
+func (rr *Reader) BodyReader(request *Request) io.Reader {
+  // The header may have come with the start of the body
+  b := &bodyReader{rr: rr, request: request, buf: request.Body}
+  request.Body = nil
+  return b
+}
+
+type bodyReader struct {
+  rr *Reader
+  request *Request
+  // buf holds what was parsed but not read yet. The parser appends the
+  // body to request.Body, which is only lent to it.
+  buf []byte
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+  r := b.request
+  if len(b.buf) == 0 {
+    if r.State == requestStateDone {
+      return 0, io.EOF
+    }
+    r.Body = b.buf[:0]
+    err := b.rr.parseUntil(r, func() bool {
+      return len(r.Body) > 0 || r.State == requestStateDone
+    })
+    b.buf, r.Body = r.Body, nil
+    if err != nil {
+      return 0, err
+    }
+    if len(b.buf) == 0 {
+      return 0, io.EOF
     }
+  }
+  n := copy(p, b.buf)
+  if n == len(b.buf) {
+    b.buf = b.buf[:0]
+  } else {
+    b.buf = b.buf[n:]
+  }
+  return n, nil
+}
 
-    numBytesRead, err := reader.Read(buffer[readToIndex:])
+// parseUntil parses request from the buffer, reading more from the
+// connection as needed, until done reports true.
+func (rr *Reader) parseUntil(request *Request, done func() bool) error {
+  for !done() {
+    numBytesParsed, err := request.parse(rr.buffer[:rr.readToIndex])
     if err != nil {
+      return err
+    }
+    if numBytesParsed > 0 {
+      copy(rr.buffer, rr.buffer[numBytesParsed:rr.readToIndex])
+      rr.readToIndex -= numBytesParsed
+      continue
+    }
+    if done() {
+      break
+    }
+
+    numBytesRead, err := rr.Fill()
+    if err != nil {
+      if numBytesRead > 0 {
+        continue
+      }
       if errors.Is(err, io.EOF) {
-        if request.State != requestStateDone {
-          return nil, errors.New("incomplete request")
+        if request.State == requestStateInitialized && rr.readToIndex == 0 {
+          return io.EOF
         }
-        break
+        return errors.New("incomplete request")
       }
+      return err
     }
+  }
+  return nil
+}
 
-    readToIndex += numBytesRead
-    numBytesParsed, err := request.parse(buffer[:readToIndex])
-    if err != nil {
-      return nil, err
-    }
+// Fill reads once from the connection into the buffer, growing it when it
+// is full. The server uses it to wait for either the next request or the
+// client closing the connection while a response is being streamed. It must
+// not run concurrently with ReadRequest.
+func (rr *Reader) Fill() (int, error) {
+  if rr.readToIndex >= len(rr.buffer) {
+    newBuf := make([]byte, len(rr.buffer) * 2)
+    copy(newBuf, rr.buffer)
+    rr.buffer = newBuf
+  }
+  n, err := rr.reader.Read(rr.buffer[rr.readToIndex:])
+  rr.readToIndex += n
+  return n, err
+}
 
-    if numBytesParsed > 0 {
-      copy(buffer, buffer[numBytesParsed:])
-      readToIndex -= numBytesParsed
+// Buffered returns the bytes that were read from the connection but not
+// yet parsed, such as the start of a pipelined request.
+func (rr *Reader) Buffered() []byte {
+  return rr.buffer[:rr.readToIndex]
+}
+
+// KeepAlive reports whether the connection may be reused after this
+// request, which is the default for HTTP/1.1 unless it says "close".
+func (r *Request) KeepAlive() bool {
+  value, err := r.Headers.Get("Connection")
+  if err != nil {
+    return true
+  }
+  for _, option := range strings.Split(value, ",") {
+    if strings.EqualFold(strings.TrimSpace(option), "close") {
+      return false
     }
   }
-  
-  return request, nil
+  return true
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -108,27 +272,45 @@ func (r *Request) parseSingle(data []byte) (int, error) {
     }
     if done {
       r.State = requestStateParsingBody
+      if err := r.startBody(); err != nil {
+        return 0, err
+      }
+    } else if n > 0 {
+      name, _, _ := strings.Cut(string(data[:n]), ":")
+      r.addHeaderOrder(strings.TrimSpace(name))
     }
     return n, nil
   case requestStateParsingBody:
+    if r.decoder != nil {
+      n, body, err := r.decoder.Decode(data, r.Body)
+      if err != nil {
+        return 0, err
+      }
+      r.Body = body
+      if r.decoder.Done() {
+        r.State = requestStateDone
+      }
+      return n, nil
+    }
+
     headerValue, err := r.Headers.Get("Content-Length")
     if err != nil {
       r.State = requestStateDone
       return 0, nil
     }
     contentLength, err := strconv.Atoi(headerValue)
-    if err != nil {
+    if err != nil || contentLength < 0 {
       return 0, errors.New("malformed content-length header")
     }
 
-    r.Body = append(r.Body, data...)
-    if len(r.Body) > contentLength {
-      return 0, errors.New("request body size exceeds content length")
-    } 
-    if len(r.Body) == contentLength {
+    // Anything past the declared length belongs to the next request
+    n := min(len(data), contentLength - r.bodyParsed)
+    r.Body = append(r.Body, data[:n]...)
+    r.bodyParsed += n
+    if r.bodyParsed == contentLength {
       r.State = requestStateDone
     }
-    return len(data), nil
+    return n, nil
   case requestStateDone:
     return 0, errors.New("error: trying to read data in a done state")
   default:
@@ -136,6 +318,24 @@ func (r *Request) parseSingle(data []byte) (int, error) {
   }
 }
 
+// startBody picks the body framing once the headers are complete. A request
+// with both Transfer-Encoding and Content-Length is rejected since the two
+// could be read differently by a proxy in front of us.
+func (r *Request) startBody() error {
+  te, err := r.Headers.Get("Transfer-Encoding")
+  if err != nil {
+    return nil
+  }
+  if _, err := r.Headers.Get("Content-Length"); err == nil {
+    return errors.New("both transfer-encoding and content-length present")
+  }
+  if !chunked.IsChunked(te) {
+    return errors.New("unsupported transfer-encoding")
+  }
+  r.decoder = chunked.NewDecoder(r.Trailers)
+  return nil
+}
+
 func parseRequestLine(request *Request, data []byte) (int, error) {
   requestLineIndex := bytes.Index(data, []byte("\r\n"))
   if requestLineIndex == -1 {
@@ -163,6 +363,16 @@ func parseRequestLine(request *Request, data []byte) (int, error) {
   return requestLineIndex + 2, nil
 }
 
+func (r *Request) addHeaderOrder(name string) {
+  name = strings.ToLower(name)
+  for _, existing := range r.headerOrder {
+    if existing == name {
+      return
+    }
+  }
+  r.headerOrder = append(r.headerOrder, name)
+}
+
 func isUpper(s string) bool {
   for _, r := range s {
     if !unicode.IsUpper(r) && unicode.IsLetter(r) {
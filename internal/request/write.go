@@ -0,0 +1,211 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/chunked"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+)
+
+const writeChunkSize = 32 * 1024
+
+// WriteTo serializes r in HTTP/1.1 wire format. Headers are written in the
+// order they were received or added, followed by any that were set directly
+// on r.Headers. A BodyReader is sent chunked unless a Content-Length was
+// given, while Body is always sent with its length.
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	if err := validateRequestLine(r.RequestLine.Method, r.RequestLine.RequestTarget); err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/%s\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget, version)
+
+	h := headers.NewHeaders()
+	for name, value := range r.Headers {
+		h.Overwrite(name, value)
+	}
+	isChunked, contentLength, err := r.framing(h)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range r.orderedHeaderNames(h) {
+		value := h[name]
+		if !headers.IsValidFieldName(name) || !headers.IsValidFieldValue(value) {
+			return cw.n, fmt.Errorf("invalid header %q", name)
+		}
+		bw.WriteString(name + ": " + value + "\r\n")
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return cw.n, err
+	}
+
+	switch {
+	case r.BodyReader != nil && isChunked:
+		err = r.writeChunked(bw, r.BodyReader)
+	case r.BodyReader != nil:
+		var n int64
+		n, err = io.Copy(bw, io.LimitReader(r.BodyReader, contentLength))
+		if err == nil && n < contentLength {
+			err = errors.New("body shorter than content length")
+		}
+	case isChunked:
+		err = r.writeChunked(bw, bytes.NewReader(r.Body))
+	default:
+		_, err = bw.Write(r.Body)
+	}
+	if err != nil {
+		return cw.n, err
+	}
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// framing settles the body framing headers in h and reports whether the body
+// is chunked or else its length.
+func (r *Request) framing(h headers.Headers) (isChunked bool, contentLength int64, err error) {
+	if te, err := h.Get("Transfer-Encoding"); err == nil {
+		if !chunked.IsChunked(te) {
+			return false, 0, errors.New("request transfer coding must end in chunked")
+		}
+		h.Delete("Content-Length")
+		r.announceTrailers(h)
+		return true, -1, nil
+	}
+
+	if r.BodyReader == nil {
+		if len(r.Body) > 0 || r.expectsBody() {
+			h.Overwrite("Content-Length", strconv.Itoa(len(r.Body)))
+		} else {
+			h.Delete("Content-Length")
+		}
+		return false, int64(len(r.Body)), nil
+	}
+
+	if cl, err := h.Get("Content-Length"); err == nil {
+		contentLength, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || contentLength < 0 {
+			return false, 0, errors.New("malformed content-length header")
+		}
+		return false, contentLength, nil
+	}
+	h.Overwrite("Transfer-Encoding", "chunked")
+	r.announceTrailers(h)
+	return true, -1, nil
+}
+
+func (r *Request) announceTrailers(h headers.Headers) {
+	if len(r.Trailers) == 0 {
+		return
+	}
+	names := make([]string, 0, len(r.Trailers))
+	for name := range r.Trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h.Overwrite("Trailer", strings.Join(names, ", "))
+}
+
+// writeChunked sends body as chunks followed by the trailers. Every chunk
+// is flushed so a streaming body reaches the peer as it is produced.
+func (r *Request) writeChunked(bw *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, writeChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	bw.WriteString("0\r\n")
+	names := make([]string, 0, len(r.Trailers))
+	for name := range r.Trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := r.Trailers[name]
+		if !headers.IsValidFieldName(name) || !headers.IsValidFieldValue(value) {
+			return fmt.Errorf("invalid trailer %q", name)
+		}
+		bw.WriteString(name + ": " + value + "\r\n")
+	}
+	_, err := bw.WriteString("\r\n")
+	return err
+}
+
+// orderedHeaderNames returns the names in h, those with a known position
+// first and the rest sorted.
+func (r *Request) orderedHeaderNames(h headers.Headers) []string {
+	names := make([]string, 0, len(h))
+	seen := map[string]bool{}
+	for _, name := range r.headerOrder {
+		if _, exists := h[name]; exists && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	var rest []string
+	for name := range h {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// expectsBody reports whether the method defines a meaning for a body, in
+// which case an empty one is still announced with Content-Length: 0.
+func (r *Request) expectsBody() bool {
+	switch r.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+func validateRequestLine(method, target string) error {
+	if method == "" || !headers.IsValidFieldName(method) {
+		return errors.New("invalid method")
+	}
+	if target == "" || strings.ContainsAny(target, " \t\r\n\x00") {
+		return errors.New("invalid request target")
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
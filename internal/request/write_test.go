@@ -0,0 +1,103 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestWriteTo(t *testing.T) {
+	// Test: Parsed request keeps its header order
+	data := "POST /submit HTTP/1.1\r\n" +
+		"User-Agent: curl/7.81.0\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Accept: */*\r\n" +
+		"Content-Length: 13\r\n" +
+		"\r\n" +
+		"hello world!\n"
+	r, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: 5})
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	n, err := r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, strings.ToLower(data[:len(data)-len("hello world!\n")]), strings.ToLower(buf.String()[:len(data)-13]))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello world!\n"))
+
+	// Test: Round trip through the parser
+	r2, err := RequestFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 3})
+	require.NoError(t, err)
+	assert.Equal(t, r.RequestLine, r2.RequestLine)
+	assert.Equal(t, r.Headers, r2.Headers)
+	assert.Equal(t, r.Body, r2.Body)
+
+	// Test: Headers added directly come after the ordered ones
+	r.Headers.Set("X-Added", "1")
+	buf.Reset()
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "content-length: 13\r\nx-added: 1\r\n\r\n")
+}
+
+func TestBuilder(t *testing.T) {
+	// Test: Absolute URL with a sized body
+	r, err := NewBuilder("PUT", "http://localhost:42010/items/1?force=true").
+		Header("Content-Type", "application/json").
+		Body(strings.NewReader(`{"id":1}`)).
+		Build()
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /items/1?force=true HTTP/1.1\r\n"+
+		"host: localhost:42010\r\n"+
+		"content-type: application/json\r\n"+
+		"content-length: 8\r\n"+
+		"\r\n"+
+		`{"id":1}`, buf.String())
+
+	// Test: Streaming body of unknown size is chunked with trailers
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello "))
+		pw.Write([]byte("world"))
+		pw.Close()
+	}()
+	r, err = NewBuilder("POST", "/upload").
+		Header("Host", "localhost").
+		Body(pr).
+		Trailer("X-Checksum", "abc").
+		Build()
+	require.NoError(t, err)
+	buf.Reset()
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /upload HTTP/1.1\r\n"+
+		"host: localhost\r\n"+
+		"transfer-encoding: chunked\r\n"+
+		"trailer: x-checksum\r\n"+
+		"\r\n"+
+		"6\r\nhello \r\n5\r\nworld\r\n0\r\nx-checksum: abc\r\n\r\n", buf.String())
+
+	// Test: GET without a body has no framing headers
+	r, err = NewBuilder("GET", "/").Header("Host", "localhost").Build()
+	require.NoError(t, err)
+	buf.Reset()
+	_, err = r.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET / HTTP/1.1\r\nhost: localhost\r\n\r\n", buf.String())
+
+	// Test: Invalid input
+	_, err = NewBuilder("get", "/").Build()
+	require.Error(t, err)
+	_, err = NewBuilder("GET", "/a b").Build()
+	require.Error(t, err)
+	_, err = NewBuilder("GET", "not a url").Build()
+	require.Error(t, err)
+	_, err = NewBuilder("GET", "/").Header("X-Bad", "a\r\nInjected: 1").Build()
+	require.Error(t, err)
+}
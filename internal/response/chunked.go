@@ -0,0 +1,190 @@
+package response
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+)
+
+const defaultChunkSize = 4096
+
+// Fields that can't be sent in a trailer section because they are needed to
+// frame, route or authenticate the message (RFC 9110 section 6.5.1).
+var forbiddenTrailers = map[string]bool{
+	"authorization":     true,
+	"cache-control":     true,
+	"content-encoding":  true,
+	"content-length":    true,
+	"content-range":     true,
+	"content-type":      true,
+	"expect":            true,
+	"host":              true,
+	"max-forwards":      true,
+	"set-cookie":        true,
+	"te":                true,
+	"trailer":           true,
+	"transfer-encoding": true,
+}
+
+// ChunkedWriter streams a chunked body. Small writes are coalesced into
+// chunks of about the configured size and Close ends the body with the last
+// chunk and the trailer section. Only fields announced in the Trailer header
+// may be sent, and trailers are dropped entirely unless the client said it
+// accepts them with "TE: trailers".
+type ChunkedWriter struct {
+	w         *Writer
+	buf       []byte
+	chunkSize int
+	trailer   headers.Headers
+	closed    bool
+}
+
+var (
+	_ io.WriteCloser = (*ChunkedWriter)(nil)
+	_ io.ReaderFrom  = (*ChunkedWriter)(nil)
+)
+
+// NewChunkedWriter returns a ChunkedWriter for w, whose headers must already
+// have been written with chunked transfer coding.
+func NewChunkedWriter(w *Writer) (*ChunkedWriter, error) {
+	return NewChunkedWriterSize(w, defaultChunkSize)
+}
+
+func NewChunkedWriterSize(w *Writer, chunkSize int) (*ChunkedWriter, error) {
+	if w.state != writerStateBody || !w.chunked {
+		return nil, errors.New("response is not using chunked transfer coding")
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	return &ChunkedWriter{
+		w:         w,
+		buf:       make([]byte, 0, chunkSize),
+		chunkSize: chunkSize,
+		trailer:   headers.NewHeaders(),
+	}, nil
+}
+
+// Trailer returns the trailer fields sent by Close.
+func (cw *ChunkedWriter) Trailer() headers.Headers {
+	return cw.trailer
+}
+
+func (cw *ChunkedWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.New("write on closed chunked writer")
+	}
+	total := 0
+	for len(p) > 0 {
+		// A write of at least a full chunk skips the copy into the buffer
+		if len(cw.buf) == 0 && len(p) >= cw.chunkSize {
+			if _, err := cw.w.WriteChunkedBody(p); err != nil {
+				return total, err
+			}
+			return total + len(p), nil
+		}
+		n := copy(cw.buf[len(cw.buf):cw.chunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		p = p[n:]
+		total += n
+		if len(cw.buf) == cw.chunkSize {
+			if err := cw.writeChunk(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom copies r into full sized chunks.
+func (cw *ChunkedWriter) ReadFrom(r io.Reader) (int64, error) {
+	if cw.closed {
+		return 0, errors.New("write on closed chunked writer")
+	}
+	var total int64
+	for {
+		n, err := r.Read(cw.buf[len(cw.buf):cw.chunkSize])
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		total += int64(n)
+		if len(cw.buf) == cw.chunkSize {
+			if err := cw.writeChunk(); err != nil {
+				return total, err
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Flush sends the buffered bytes as a chunk and flushes the response.
+func (cw *ChunkedWriter) Flush() error {
+	if err := cw.writeChunk(); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+func (cw *ChunkedWriter) writeChunk() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.w.WriteChunkedBody(cw.buf)
+	cw.buf = cw.buf[:0]
+	return err
+}
+
+// Close writes the remaining data, the last chunk and the trailer section.
+// The body is always terminated; an error is returned afterwards if a
+// trailer field was set that wasn't announced or isn't allowed.
+func (cw *ChunkedWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	if err := cw.writeChunk(); err != nil {
+		return err
+	}
+	if _, err := cw.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+
+	trailers := headers.NewHeaders()
+	var rejected []string
+	for name, value := range cw.trailer {
+		if !cw.w.trailer[name] || forbiddenTrailers[name] {
+			rejected = append(rejected, name)
+			continue
+		}
+		trailers.Overwrite(name, value)
+	}
+	if !cw.w.acceptsTrailers() {
+		trailers = nil
+	}
+	if err := cw.w.WriteTrailers(trailers); err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		return errors.New("trailer fields not allowed: " + strings.Join(rejected, ", "))
+	}
+	return nil
+}
+
+// acceptsTrailers reports whether the request carried "TE: trailers".
+func (w *Writer) acceptsTrailers() bool {
+	if w.request == nil {
+		return false
+	}
+	te, err := w.request.Headers.Get("TE")
+	if err != nil {
+		return false
+	}
+	return hasToken(te, "trailers")
+}
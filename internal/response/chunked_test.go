@@ -0,0 +1,112 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newChunkedResponse(t *testing.T, te string) (*bytes.Buffer, *Writer) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	req := &request.Request{Headers: headers.NewHeaders()}
+	if te != "" {
+		req.Headers.Set("TE", te)
+	}
+	w.SetRequest(req)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	buf.Reset()
+	return buf, w
+}
+
+func TestChunkedWriter(t *testing.T) {
+	// Test: Small writes are coalesced
+	buf, w := newChunkedResponse(t, "trailers")
+	cw, err := NewChunkedWriterSize(w, 8)
+	require.NoError(t, err)
+	for _, s := range []string{"ab", "cd", "ef", "gh", "ij"} {
+		_, err = cw.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	cw.Trailer().Set("X-Checksum", "abc")
+	require.NoError(t, cw.Close())
+	assert.Equal(t, "8\r\nabcdefgh\r\n2\r\nij\r\n0\r\nx-checksum: abc\r\n\r\n", buf.String())
+
+	// Test: ReadFrom fills whole chunks
+	buf, w = newChunkedResponse(t, "")
+	cw, err = NewChunkedWriterSize(w, 4)
+	require.NoError(t, err)
+	n, err := io.Copy(cw, io.LimitReader(strings.NewReader("0123456789"), 10))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	require.NoError(t, cw.Close())
+	assert.Equal(t, "4\r\n0123\r\n4\r\n4567\r\n2\r\n89\r\n0\r\n\r\n", buf.String())
+
+	// Test: Trailers dropped when the client doesn't accept them
+	buf, w = newChunkedResponse(t, "gzip")
+	cw, err = NewChunkedWriter(w)
+	require.NoError(t, err)
+	cw.Write([]byte("hi"))
+	cw.Trailer().Set("X-Checksum", "abc")
+	require.NoError(t, cw.Close())
+	assert.Equal(t, "2\r\nhi\r\n0\r\n\r\n", buf.String())
+
+	// Test: Undeclared trailers are rejected but the body still ends
+	buf, w = newChunkedResponse(t, "trailers, deflate;q=0.5")
+	cw, err = NewChunkedWriter(w)
+	require.NoError(t, err)
+	cw.Trailer().Set("X-Checksum", "abc")
+	cw.Trailer().Set("X-Surprise", "1")
+	require.Error(t, cw.Close())
+	assert.Equal(t, "0\r\nx-checksum: abc\r\n\r\n", buf.String())
+	require.NoError(t, w.Finish())
+
+	// Test: Nothing but the headers for HEAD
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetRequest(&request.Request{
+		RequestLine: request.RequestLine{Method: "HEAD"},
+		Headers:     headers.Headers{"te": "trailers"},
+	})
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	headOnly := buf.Len()
+	headCW, err := NewChunkedWriterSize(w, 2)
+	require.NoError(t, err)
+	_, err = headCW.Write([]byte("skipped"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("too"))
+	require.NoError(t, err)
+	headCW.Trailer().Set("X-Checksum", "abc")
+	require.NoError(t, headCW.Close())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, headOnly, buf.Len())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+	assert.NotContains(t, buf.String(), "x-checksum: abc")
+
+	// Test: Writing after Close
+	_, err = cw.Write([]byte("late"))
+	require.Error(t, err)
+
+	// Test: Response not using chunked coding
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	_, err = NewChunkedWriter(w)
+	require.Error(t, err)
+}
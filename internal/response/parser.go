@@ -0,0 +1,363 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/chunked"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+)
+
+type ParserState int
+
+const (
+	responseStateInitialized ParserState = iota
+	responseStateParsingHeaders
+	responseStateParsingBody
+	responseStateParsingChunkedBody
+	responseStateDone
+)
+
+const bufferSize = 1024
+
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Trailers   headers.Headers
+	State      ParserState
+	Body       []byte
+
+	method         string
+	decoder        *chunked.Decoder
+	closeDelimited bool
+	// remaining is what's left of the Content-Length or of the current
+	// chunk, or -1 for a body delimited by the connection closing
+	remaining int64
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// Parser reads responses from a connection. Bytes received past the end of
+// one response stay buffered for the next, so a Parser can be reused for
+// every response on a persistent connection.
+type Parser struct {
+	reader      io.Reader
+	buffer      []byte
+	readToIndex int
+	eof         bool
+}
+
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{
+		reader: reader,
+		buffer: make([]byte, bufferSize),
+	}
+}
+
+// ResponseFromReader reads a complete response to req, skipping any interim
+// 1xx responses. req is needed because the answer to a HEAD request never
+// has a body; nil is treated as a GET.
+func ResponseFromReader(reader io.Reader, req *request.Request) (*Response, error) {
+	p := NewParser(reader)
+	for {
+		resp, err := p.ReadResponse(req)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.IsInterim() {
+			return resp, nil
+		}
+	}
+}
+
+// ReadResponse reads the next response including its body. Interim 1xx
+// responses are returned as they are, without a body.
+func (p *Parser) ReadResponse(req *request.Request) (*Response, error) {
+	resp, err := p.ReadResponseHead(req)
+	if err != nil {
+		return nil, err
+	}
+	for resp.State != responseStateDone {
+		if err := p.fill(resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// ReadResponseHead reads the status line and headers of the next response.
+// The body can then be streamed with BodyReader.
+func (p *Parser) ReadResponseHead(req *request.Request) (*Response, error) {
+	resp := &Response{
+		State:    responseStateInitialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+	}
+	if req != nil {
+		resp.method = req.RequestLine.Method
+	}
+	for resp.State < responseStateParsingBody {
+		if err := p.fill(resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// BodyReader streams the body of a response returned by ReadResponseHead.
+// Trailers are available in resp.Trailers once it has returned io.EOF.
+func (p *Parser) BodyReader(resp *Response) io.Reader {
+	return &bodyReader{parser: p, resp: resp}
+}
+
+// Buffered returns the number of bytes read past the last parsed response.
+func (p *Parser) Buffered() int {
+	return p.readToIndex
+}
+
+// IsInterim reports whether resp is a 1xx response other than 101, which
+// will be followed by the final response.
+func (resp *Response) IsInterim() bool {
+	return resp.StatusLine.StatusCode.IsInterim()
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// the body of resp has been read.
+func (resp *Response) KeepAlive() bool {
+	if resp.closeDelimited || resp.StatusLine.HttpVersion != "1.1" {
+		return false
+	}
+	if resp.StatusLine.StatusCode == StatusSwitchingProtocols {
+		return false
+	}
+	if resp.method == "CONNECT" && resp.StatusLine.StatusCode.IsSuccess() {
+		return false
+	}
+	if conn, err := resp.Headers.Get("Connection"); err == nil && hasToken(conn, "close") {
+		return false
+	}
+	return true
+}
+
+// Done reports whether the whole response, body included, has been read.
+func (resp *Response) Done() bool {
+	return resp.State == responseStateDone
+}
+
+// fill parses what is buffered and reads more from the connection when that
+// isn't enough to make progress.
+func (p *Parser) fill(resp *Response) error {
+	numBytesParsed, err := resp.parse(p.buffer[:p.readToIndex])
+	if err != nil {
+		return err
+	}
+	if numBytesParsed > 0 {
+		copy(p.buffer, p.buffer[numBytesParsed:p.readToIndex])
+		p.readToIndex -= numBytesParsed
+		return nil
+	}
+	if resp.State == responseStateDone {
+		return nil
+	}
+
+	if p.eof {
+		if resp.State == responseStateParsingBody && resp.remaining == -1 {
+			resp.State = responseStateDone
+			return nil
+		}
+		return errors.New("incomplete response")
+	}
+	if p.readToIndex >= len(p.buffer) {
+		newBuf := make([]byte, len(p.buffer)*2)
+		copy(newBuf, p.buffer)
+		p.buffer = newBuf
+	}
+	numBytesRead, err := p.reader.Read(p.buffer[p.readToIndex:])
+	p.readToIndex += numBytesRead
+	if errors.Is(err, io.EOF) {
+		p.eof = true
+		return nil
+	}
+	return err
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.State != responseStateDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return 0, err
+		}
+		totalBytesParsed += n
+		if n == 0 {
+			break
+		}
+	}
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.State {
+	case responseStateInitialized:
+		bytesParsed, err := parseStatusLine(r, data)
+		if err != nil {
+			return 0, err
+		}
+		if bytesParsed == 0 {
+			return 0, nil
+		}
+		r.State = responseStateParsingHeaders
+		return bytesParsed, nil
+	case responseStateParsingHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case responseStateParsingBody:
+		if r.remaining == -1 {
+			r.Body = append(r.Body, data...)
+			return len(data), nil
+		}
+		n := min(int64(len(data)), r.remaining)
+		r.Body = append(r.Body, data[:n]...)
+		r.remaining -= n
+		if r.remaining == 0 {
+			r.State = responseStateDone
+		}
+		return int(n), nil
+	case responseStateParsingChunkedBody:
+		n, body, err := r.decoder.Decode(data, r.Body)
+		if err != nil {
+			return 0, err
+		}
+		r.Body = body
+		if r.decoder.Done() {
+			r.State = responseStateDone
+		}
+		return n, nil
+	case responseStateDone:
+		return 0, errors.New("error: trying to read data in a done state")
+	default:
+		return 0, errors.New("error: unknown state")
+	}
+}
+
+// startBody picks the body framing following RFC 9112 section 6.3.
+func (r *Response) startBody() error {
+	code := r.StatusLine.StatusCode
+	switch {
+	case r.method == "HEAD",
+		code.IsInformational(),
+		code == StatusNoContent,
+		code == StatusNotModified,
+		r.method == "CONNECT" && code.IsSuccess():
+		r.State = responseStateDone
+		return nil
+	}
+
+	if te, err := r.Headers.Get("Transfer-Encoding"); err == nil {
+		if chunked.IsChunked(te) {
+			r.decoder = chunked.NewDecoder(r.Trailers)
+			r.State = responseStateParsingChunkedBody
+			return nil
+		}
+		r.remaining = -1
+		r.closeDelimited = true
+		r.State = responseStateParsingBody
+		return nil
+	}
+
+	if cl, err := r.Headers.Get("Content-Length"); err == nil {
+		contentLength, err := parseContentLength(cl)
+		if err != nil {
+			return err
+		}
+		r.remaining = contentLength
+		r.State = responseStateParsingBody
+		if contentLength == 0 {
+			r.State = responseStateDone
+		}
+		return nil
+	}
+
+	r.remaining = -1
+	r.closeDelimited = true
+	r.State = responseStateParsingBody
+	return nil
+}
+
+func parseStatusLine(response *Response, data []byte) (int, error) {
+	statusLineIndex := bytes.Index(data, []byte("\r\n"))
+	if statusLineIndex == -1 {
+		return 0, nil
+	}
+
+	statusLine := string(data[:statusLineIndex])
+	version, rest, _ := strings.Cut(statusLine, " ")
+	code, reasonPhrase, _ := strings.Cut(rest, " ")
+
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return 0, errors.New("invalid http version")
+	}
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || !StatusCode(statusCode).IsValid() {
+		return 0, errors.New("invalid status code")
+	}
+
+	response.StatusLine = StatusLine{
+		HttpVersion:  strings.TrimPrefix(version, "HTTP/"),
+		StatusCode:   StatusCode(statusCode),
+		ReasonPhrase: reasonPhrase,
+	}
+	return statusLineIndex + 2, nil
+}
+
+// parseContentLength accepts a list of identical values, which is what a
+// repeated Content-Length header ends up as in Headers.
+func parseContentLength(value string) (int64, error) {
+	var contentLength int64 = -1
+	for _, v := range strings.Split(value, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || n < 0 || (contentLength != -1 && n != contentLength) {
+			return 0, errors.New("malformed content-length header")
+		}
+		contentLength = n
+	}
+	return contentLength, nil
+}
+
+type bodyReader struct {
+	parser *Parser
+	resp   *Response
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	for len(br.resp.Body) == 0 {
+		if br.resp.State == responseStateDone {
+			return 0, io.EOF
+		}
+		if err := br.parser.fill(br.resp); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.resp.Body)
+	br.resp.Body = br.resp.Body[n:]
+	if len(br.resp.Body) == 0 {
+		br.resp.Body = nil
+	}
+	return n, nil
+}
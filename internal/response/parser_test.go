@@ -0,0 +1,145 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read implementaion that reads chunked data to simulate reading from network connection
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestResponseParse(t *testing.T) {
+	// Test: Content-Length body
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 13\r\nContent-Type: text/plain\r\n\r\nhello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "text/plain", r.Headers["content-type"])
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Chunked body with extensions and trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+			"5;name=value\r\nhello\r\n7\r\n world!\r\n0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = ResponseFromReader(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers["x-checksum"])
+
+	// Test: Body delimited by the connection closing
+	reader = &chunkReader{
+		data:            "HTTP/1.0 200 OK\r\n\r\nuntil the end",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, "until the end", string(r.Body))
+
+	// Test: Interim responses are skipped and an empty reason phrase is allowed
+	reader = &chunkReader{
+		data:            "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\nHTTP/1.1 599 \r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 7,
+	}
+	r, err = ResponseFromReader(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(599), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "ok", string(r.Body))
+
+	// Test: No body for HEAD, 204 and 304
+	head := &request.Request{RequestLine: request.RequestLine{Method: "HEAD"}}
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = ResponseFromReader(reader, head)
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+
+	p := NewParser(&chunkReader{
+		data:            "HTTP/1.1 204 No Content\r\n\r\nHTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nx",
+		numBytesPerRead: 1024,
+	})
+	r, err = p.ReadResponse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusNoContent, r.StatusLine.StatusCode)
+	r, err = p.ReadResponse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusNotModified, r.StatusLine.StatusCode)
+	assert.Nil(t, r.Body)
+	r, err = p.ReadResponse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(r.Body))
+	assert.Equal(t, 0, p.Buffered())
+
+	// Test: Body shorter than Content-Length
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial content",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader, nil)
+	require.Error(t, err)
+
+	// Test: Conflicting Content-Length values
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nabc",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader, nil)
+	require.Error(t, err)
+
+	// Test: Malformed status lines
+	for _, line := range []string{"HTTP/2 200 OK", "HTTP/1.1 20 OK", "HTTP/1.1 abc OK", "garbage"} {
+		_, err = ResponseFromReader(&chunkReader{data: line + "\r\n\r\n", numBytesPerRead: 8}, nil)
+		require.Error(t, err, line)
+	}
+}
+
+func TestResponseBodyReader(t *testing.T) {
+	p := NewParser(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\nX-Done: yes\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err := p.ReadResponseHead(nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+
+	body, err := io.ReadAll(p.BodyReader(r))
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(body))
+	assert.Equal(t, "yes", r.Trailers["x-done"])
+
+	// Test: Truncated chunked body
+	p = NewParser(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n"))
+	r, err = p.ReadResponseHead(nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(p.BodyReader(r))
+	require.Error(t, err)
+}
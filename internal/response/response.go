@@ -6,14 +6,6 @@ import (
 	"github.com/derjabineli/httpfromtcp/internal/headers"
 )
 
-type StatusCode int
-
-const (
-  StatusOK 					StatusCode = 200
-  StatusBadRequest 			StatusCode = 400
-  StatusInternalServerError StatusCode = 500
-)
-
 func GetDefaultHeaders(contentLen int) headers.Headers {
   h := headers.NewHeaders()
   h.Set("Content-Length", strconv.Itoa(contentLen))
@@ -21,3 +13,17 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
   h.Set("Content-Type", "text/plain")
   return h
 }
+
+// WriteError sends a complete plain text response with message as its body,
+// for handlers answering with an error. Unlike GetDefaultHeaders it leaves
+// the connection open, the request having been read in full; headers set
+// with w.Header() beforehand are sent along.
+func WriteError(w *Writer, statusCode StatusCode, message string) {
+  body := []byte(message)
+  h := headers.NewHeaders()
+  h.Set("Content-Length", strconv.Itoa(len(body)))
+  h.Set("Content-Type", "text/plain")
+  w.WriteStatusLine(statusCode)
+  w.WriteHeaders(h)
+  w.WriteBody(body)
+}
@@ -0,0 +1,112 @@
+package response
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+)
+
+// sniffLen is how much of the body http.DetectContentType looks at.
+const sniffLen = 512
+
+// ResponseWriter is a net/http style API on top of a Writer. Headers are
+// collected in the mutable Header map and committed by the first call to
+// WriteHeader or Write, which implies a 200. The underlying Writer stays
+// available through Writer for handlers that need full control.
+type ResponseWriter struct {
+	w *Writer
+}
+
+var (
+	_ io.Writer       = (*ResponseWriter)(nil)
+	_ io.StringWriter = (*ResponseWriter)(nil)
+	_ io.ReaderFrom   = (*ResponseWriter)(nil)
+)
+
+func NewResponseWriter(w *Writer) *ResponseWriter {
+	return &ResponseWriter{w: w}
+}
+
+// Writer returns the low-level Writer the response is written to.
+func (rw *ResponseWriter) Writer() *Writer {
+	return rw.w
+}
+
+func (rw *ResponseWriter) Header() headers.Headers {
+	return rw.w.Header()
+}
+
+// WriteHeader sends the status line and the header map. Calls after the
+// response has been committed are ignored. Like net/http it panics on a
+// status code that isn't three digits since that's a programming error.
+// An interim status such as 103 is sent with the header map as it is, which
+// stays in place for the final response.
+func (rw *ResponseWriter) WriteHeader(statusCode StatusCode) {
+	if rw.w.Committed() {
+		return
+	}
+	if !statusCode.IsValid() {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", statusCode))
+	}
+	rw.w.WriteStatusLine(statusCode)
+	if statusCode.IsInterim() {
+		rw.w.WriteHeaders(maps.Clone(rw.w.Header()))
+		return
+	}
+	rw.w.WriteHeaders(nil)
+}
+
+// Write writes p as part of the body, committing a 200 first if needed. When
+// no Content-Type was set it is sniffed from the first bytes written.
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	if !rw.w.Committed() {
+		h := rw.w.Header()
+		if _, err := h.Get("Content-Type"); err != nil && len(p) > 0 {
+			h.Set("Content-Type", http.DetectContentType(p))
+		}
+		rw.WriteHeader(StatusOK)
+	}
+	return rw.w.WriteBody(p)
+}
+
+func (rw *ResponseWriter) WriteString(s string) (int, error) {
+	return rw.Write([]byte(s))
+}
+
+// ReadFrom copies the body from r with Writer.ReadFrom, committing a 200
+// first if needed. When no Content-Type was set the first bytes are read and
+// sniffed as in Write.
+func (rw *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if !rw.w.Committed() {
+		if _, err := rw.w.Header().Get("Content-Type"); err != nil {
+			buf := make([]byte, sniffLen)
+			m, err := io.ReadFull(r, buf)
+			if m > 0 {
+				written, err := rw.Write(buf[:m])
+				n += int64(written)
+				if err != nil {
+					return n, err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				rw.WriteHeader(StatusOK)
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+		rw.WriteHeader(StatusOK)
+	}
+	m, err := rw.w.ReadFrom(r)
+	return n + m, err
+}
+
+// Flush sends everything written so far to the client.
+func (rw *ResponseWriter) Flush() error {
+	return rw.w.Flush()
+}
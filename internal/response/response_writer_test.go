@@ -0,0 +1,77 @@
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseWriter(t *testing.T) {
+	// Test: Write implies 200 and commits the header map
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	rw := NewResponseWriter(w)
+	rw.Header().Set("Content-Type", "application/json")
+	require.NoError(t, json.NewEncoder(rw).Encode(map[string]int{"answer": 42}))
+	rw.Header().Set("X-Too-Late", "1")
+	rw.WriteHeader(StatusNotFound)
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: application/json\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, out, "{\"answer\":42}\n")
+	assert.NotContains(t, out, "x-too-late")
+
+	// Test: Explicit status, Content-Length and helpers from the standard library
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	rw = NewResponseWriter(w)
+	rw.Header().Set("Content-Length", "11")
+	rw.WriteHeader(StatusCreated)
+	fmt.Fprintf(rw, "hello ")
+	_, err := io.Copy(rw, strings.NewReader("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 201 Created\r\n"))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello world"))
+
+	// Test: Content-Type is sniffed when not set
+	buf = &bytes.Buffer{}
+	rw = NewResponseWriter(NewWriter(buf))
+	rw.WriteString("<html><body>hi</body></html>")
+	require.NoError(t, rw.Flush())
+	assert.Contains(t, buf.String(), "content-type: text/html; charset=utf-8\r\n")
+
+	// Test: Nothing written at all becomes an empty 200
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Header().Set("X-Request-Id", "abc")
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "content-length: 0\r\n")
+	assert.Contains(t, buf.String(), "x-request-id: abc\r\n")
+
+	// Test: Invalid status code
+	rw = NewResponseWriter(NewWriter(&bytes.Buffer{}))
+	assert.Panics(t, func() { rw.WriteHeader(42) })
+}
+
+func TestResponseWriterInterim(t *testing.T) {
+	// Test: An interim status sends the header map and keeps it
+	buf := &bytes.Buffer{}
+	rw := NewResponseWriter(NewWriter(buf))
+	rw.Header().Set("Link", "</style.css>; rel=preload; as=style")
+	rw.WriteHeader(StatusEarlyHints)
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write([]byte("ok"))
+	require.NoError(t, rw.Writer().Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style\r\n\r\nHTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 2, strings.Count(buf.String(), "link: </style.css>"))
+}
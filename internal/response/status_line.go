@@ -1,19 +1,36 @@
 package response
 
 import (
-	"fmt"
+	"errors"
+	"strconv"
 )
 
-func getStatusLine(statusCode StatusCode) []byte {
-	reasonPhrase := ""
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusInternalServerError:
-		reasonPhrase = "Internal Server Error"
+// getStatusLine formats status-line = HTTP-version SP status-code SP
+// [ reason-phrase ]. The space after the code is required even when the
+// reason phrase is empty.
+func getStatusLine(statusCode StatusCode, reasonPhrase string) ([]byte, error) {
+	if !statusCode.IsValid() {
+		return nil, errors.New("invalid status code " + strconv.Itoa(int(statusCode)))
 	}
-	statusLine := []byte(fmt.Sprintf("HTTP/1.1 %v %v \r\n", statusCode, reasonPhrase))
-	return statusLine
-}
\ No newline at end of file
+	if !isValidReasonPhrase(reasonPhrase) {
+		return nil, errors.New("invalid reason phrase")
+	}
+	statusLine := make([]byte, 0, len("HTTP/1.1 000 \r\n")+len(reasonPhrase))
+	statusLine = append(statusLine, "HTTP/1.1 "...)
+	statusLine = strconv.AppendInt(statusLine, int64(statusCode), 10)
+	statusLine = append(statusLine, ' ')
+	statusLine = append(statusLine, reasonPhrase...)
+	statusLine = append(statusLine, "\r\n"...)
+	return statusLine, nil
+}
+
+// reason-phrase = 1*( HTAB / SP / VCHAR / obs-text )
+func isValidReasonPhrase(reasonPhrase string) bool {
+	for i := 0; i < len(reasonPhrase); i++ {
+		c := reasonPhrase[i]
+		if c != '\t' && (c < ' ' || c == 0x7f) {
+			return false
+		}
+	}
+	return true
+}
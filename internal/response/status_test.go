@@ -0,0 +1,52 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: Known status code
+	line, err := getStatusLine(StatusNotFound, StatusText(StatusNotFound))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", string(line))
+
+	// Test: Unknown status code keeps the separator
+	line, err = getStatusLine(599, StatusText(599))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 599 \r\n", string(line))
+
+	// Test: Invalid status codes and reason phrases
+	_, err = getStatusLine(99, "")
+	require.Error(t, err)
+	_, err = getStatusLine(1000, "")
+	require.Error(t, err)
+	_, err = getStatusLine(StatusOK, "OK\r\nX-Injected: 1")
+	require.Error(t, err)
+
+	// Test: Custom reason phrase through the writer
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLineReason(StatusTooManyRequests, "Slow Down"))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 429 Slow Down\r\n", buf.String())
+	require.Error(t, w.WriteStatusLine(StatusOK))
+}
+
+func TestStatusClasses(t *testing.T) {
+	assert.Equal(t, "Created", StatusText(StatusCreated))
+	assert.Equal(t, "Service Unavailable", StatusText(StatusServiceUnavailable))
+	assert.Equal(t, "", StatusText(299))
+
+	assert.True(t, StatusEarlyHints.IsInformational())
+	assert.True(t, StatusNoContent.IsSuccess())
+	assert.True(t, StatusMovedPermanently.IsRedirect())
+	assert.True(t, StatusConflict.IsClientError())
+	assert.True(t, StatusConflict.IsError())
+	assert.True(t, StatusBadGateway.IsServerError())
+	assert.False(t, StatusOK.IsError())
+	assert.False(t, StatusCode(600).IsServerError())
+}
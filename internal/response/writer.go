@@ -1,91 +1,685 @@
 package response
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
 
+	"github.com/derjabineli/httpfromtcp/internal/chunked"
 	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
 )
 
 type WriterState int
 
 const (
 	writerStateStatusLine WriterState = iota
-	writerStateHeaders 
-	writerStateBody 
+	writerStateHeaders
+	writerStateBody
 	writerStateTrailers
+	writerStateDone
 )
 
+var (
+	ErrContentLength  = errors.New("body size exceeds content length")
+	ErrShortBody      = errors.New("body size is less than content length")
+	ErrBodyNotAllowed = errors.New("response status does not allow a body")
+	ErrNotHijackable  = errors.New("connection can't be hijacked")
+	ErrAborted        = errors.New("response was aborted")
+)
+
+// FlushPolicy controls when buffered output is sent to the connection.
+type FlushPolicy int
+
+const (
+	// FlushOnComplete only flushes once the body is complete or when the
+	// handler calls Flush.
+	FlushOnComplete FlushPolicy = iota
+	// FlushEveryChunk also flushes after every chunk of a chunked body, for
+	// streams where latency matters more than the number of packets.
+	FlushEveryChunk
+)
+
+const defaultBufferSize = 4096
+
 type Writer struct {
 	state WriterState
-	Writer io.Writer	
+	// Writer is the destination. Output is buffered, so anything written to
+	// it directly must be preceded by a Flush.
+	Writer      io.Writer
+	buf         *bufio.Writer
+	flushPolicy FlushPolicy
+	// dst counts what the buffer has passed on to Writer, and started is the
+	// count when the status line was written
+	dst     *sentCounter
+	started int64
+
+	request    *request.Request
+	header     headers.Headers
+	statusCode StatusCode
+	// contentLength is the declared Content-Length or -1 when none was sent
+	contentLength int64
+	written       int64
+	chunked       bool
+	closeConn     bool
+	// trailer holds the lowercased field names announced in Trailer
+	trailer map[string]bool
+
+	hijacker HijackFunc
+	hijacked bool
+	aborted  bool
+
+	closeNotifier CloseNotifyFunc
+
+	encoder BodyEncoder
+	// encoded is the writer the body goes through when encoder chose to
+	// transform it
+	encoded io.WriteCloser
 }
 
+var _ io.ReaderFrom = (*Writer)(nil)
+
+// HijackFunc hands the connection over to the caller. The ReadWriter holds
+// anything that was already read past the current request.
+type HijackFunc func() (net.Conn, *bufio.ReadWriter, error)
+
+// CloseNotifyFunc returns a channel that is closed when the client closes
+// the connection.
+type CloseNotifyFunc func() <-chan struct{}
+
+// BodyEncoder is consulted by WriteHeaders before the framing of the body
+// is decided. It may change the header fields and returns a writer the body
+// is passed through, which writes its output to dst, or nil to send the body
+// unchanged. A returned writer with a Flush() error method is flushed by
+// Flush and it is closed when the body is complete.
+type BodyEncoder func(statusCode StatusCode, h headers.Headers, dst io.Writer) io.WriteCloser
+
 func NewWriter(w io.Writer) *Writer {
+	return NewWriterSize(w, defaultBufferSize)
+}
+
+// NewWriterSize returns a Writer whose output buffer has at least size bytes.
+func NewWriterSize(w io.Writer, size int) *Writer {
+	dst := &sentCounter{w: w}
 	return &Writer{
-		state: writerStateStatusLine,
-		Writer: w,
+		state:         writerStateStatusLine,
+		Writer:        w,
+		buf:           bufio.NewWriterSize(dst, size),
+		dst:           dst,
+		contentLength: -1,
+	}
+}
+
+// sentCounter counts the bytes written to the destination.
+type sentCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *sentCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadFrom lets io.Copy reach the ReadFrom of the destination, which is
+// where a *net.TCPConn uses sendfile or splice.
+func (c *sentCounter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.w, r)
+	c.n += n
+	return n, err
+}
+
+func (w *Writer) SetFlushPolicy(policy FlushPolicy) {
+	w.flushPolicy = policy
+}
+
+// Flush sends any buffered output to the destination. Streaming handlers
+// call it to push out what they have written so far.
+func (w *Writer) Flush() error {
+	if flusher, ok := w.encoded.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// SetBodyEncoder installs a BodyEncoder, e.g. to compress the response. It
+// must be called before the headers are written.
+func (w *Writer) SetBodyEncoder(encoder BodyEncoder) {
+	w.encoder = encoder
+}
+
+// BodyEncoder returns the installed BodyEncoder, so a middleware can chain
+// its own with it.
+func (w *Writer) BodyEncoder() BodyEncoder {
+	return w.encoder
+}
+
+// SetRequest tells the writer which request it is answering, since the
+// framing of a response depends on it (a HEAD response never has a body).
+func (w *Writer) SetRequest(req *request.Request) {
+	w.request = req
+}
+
+// Header returns the header map that will be merged into the header section
+// when it is written. Fields set here are only sent if the headers passed to
+// WriteHeaders don't already carry them, and changes after the headers have
+// been written have no effect.
+func (w *Writer) Header() headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
+}
+
+// SetHijacker is called by the server to make the connection available to
+// Hijack.
+func (w *Writer) SetHijacker(hijacker HijackFunc) {
+	w.hijacker = hijacker
+}
+
+// SetCloseNotifier is called by the server to make CloseNotify work.
+func (w *Writer) SetCloseNotifier(notifier CloseNotifyFunc) {
+	w.closeNotifier = notifier
+}
+
+// CloseNotify returns a channel that is closed when the client closes the
+// connection before the response is complete, so that long running handlers
+// such as event streams can stop. It is only closed while the handler is
+// running, and it is nil, i.e. never ready, when the server can't tell.
+func (w *Writer) CloseNotify() <-chan struct{} {
+	if w.closeNotifier == nil {
+		return nil
+	}
+	return w.closeNotifier()
+}
+
+// Hijack takes over the connection, for protocols like WebSocket that leave
+// HTTP behind. It must be called before anything is written, and afterwards
+// the server neither writes to nor closes the connection.
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.hijacked || w.Committed() {
+		return nil, nil, errors.New("hijacking after the response was started")
+	}
+	conn, rw, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.closeConn = true
+	w.state = writerStateDone
+	return conn, rw, nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// Abort marks the response as failed after it has been started, e.g. when
+// the source of a streamed body breaks. Finish then returns ErrAborted so the
+// server resets the connection instead of completing a truncated message.
+func (w *Writer) Abort() {
+	w.aborted = true
+	w.closeConn = true
+}
+
+// Reset discards the response written so far, so that it can be started
+// over, e.g. by a middleware that buffered the body to look at it. That is
+// only possible while all of it is still in the buffer: once anything has
+// been sent, or the connection was hijacked, Reset fails and leaves the
+// response alone. The body encoder is kept, but an encoder that was already
+// consulted is dropped without being closed.
+func (w *Writer) Reset() error {
+	if w.hijacked || w.state == writerStateDone {
+		return errors.New("resetting a finished response")
+	}
+	if w.state == writerStateStatusLine {
+		return nil
+	}
+	if w.dst.n != w.started {
+		return errors.New("resetting a response that was already sent")
 	}
+	w.buf.Reset(w.dst)
+	w.state = writerStateStatusLine
+	w.statusCode = 0
+	w.contentLength = -1
+	w.written = 0
+	w.chunked = false
+	w.closeConn = false
+	w.trailer = nil
+	w.aborted = false
+	w.encoded = nil
+	return nil
+}
+
+// Committed reports whether the status line has already been written.
+func (w *Writer) Committed() bool {
+	return w.state != writerStateStatusLine
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-  if w.state!= writerStateStatusLine {
+	return w.WriteStatusLineReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineReason writes a status line with a custom reason phrase.
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reasonPhrase string) error {
+	if w.state != writerStateStatusLine {
 		return errors.New("writing status line out of order")
 	}
-	
-	statusLine := getStatusLine(statusCode)
-	_, err := w.Writer.Write(statusLine)
+
+	statusLine, err := getStatusLine(statusCode, reasonPhrase)
+	if err != nil {
+		return err
+	}
+	w.statusCode = statusCode
 	w.state = writerStateHeaders
+	if statusCode.IsInterim() && !w.interimAllowed() {
+		return nil
+	}
+	w.started = w.dst.n
+	_, err = w.buf.Write(statusLine)
 	return err
 }
 
+// WriteHeaders writes the header section and works out how the body will be
+// framed. Content-Length is dropped where RFC 9110 forbids it and when no
+// framing was chosen for a response that may carry a body, the writer
+// switches to chunked transfer coding on its own.
+//
+// The headers of an interim response, a 1xx other than 101 such as 103
+// Early Hints, are sent right away as they are, and the writer then expects
+// the next status line. Any number of interim responses may precede the
+// final one.
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
-  	if w.state!= writerStateHeaders {
+	if w.state != writerStateHeaders {
 		return errors.New("writing headers out of order")
 	}
-  	for header, value := range headers {
-		w.Writer.Write([]byte(fmt.Sprintf("%v: %v\r\n", header, value)))
-  	}
-  	_, err := w.Writer.Write([]byte("\r\n"))
+	if w.statusCode.IsInterim() {
+		return w.writeInterimHeaders(headers)
+	}
+
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	for name, value := range w.header {
+		if _, exists := headers[name]; !exists {
+			headers[name] = value
+		}
+	}
+	if w.statusCode.IsInformational() || w.statusCode == StatusNoContent {
+		headers.Delete("Content-Length")
+		headers.Delete("Transfer-Encoding")
+	}
+	if w.encoder != nil {
+		w.encoded = w.encoder(w.statusCode, headers, encodedBody{w})
+	}
+
+	if te, err := headers.Get("Transfer-Encoding"); err == nil {
+		// Content-Length must not be sent alongside Transfer-Encoding
+		headers.Delete("Content-Length")
+		w.chunked = chunked.IsChunked(te)
+	} else if cl, err := headers.Get("Content-Length"); err == nil {
+		contentLength, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || contentLength < 0 {
+			return errors.New("malformed content-length header")
+		}
+		w.contentLength = contentLength
+	} else if w.bodyAllowed() && !w.isHead() {
+		headers.Overwrite("Transfer-Encoding", "chunked")
+		w.chunked = true
+	}
+
+	if w.request != nil && !w.request.KeepAlive() {
+		headers.Overwrite("Connection", "close")
+	}
+	if conn, err := headers.Get("Connection"); err == nil && hasToken(conn, "close") {
+		w.closeConn = true
+	}
+	// Without a length or chunking the body ends when the connection does
+	if !w.chunked && w.contentLength < 0 && w.bodyAllowed() && !w.isHead() {
+		w.closeConn = true
+	}
+
+	if trailer, err := headers.Get("Trailer"); err == nil {
+		w.trailer = map[string]bool{}
+		for _, name := range strings.Split(trailer, ",") {
+			w.trailer[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+
+	w.writeFields(headers)
+	_, err := w.buf.WriteString("\r\n")
 	w.state = writerStateBody
-  return err
+	return err
+}
+
+// WriteEarlyHints sends a 103 Early Hints response with a Link field for
+// each of links, e.g. "</style.css>; rel=preload; as=style", so that the
+// client can fetch them while the final response is being prepared (RFC
+// 8297).
+func (w *Writer) WriteEarlyHints(links ...string) error {
+	if err := w.WriteStatusLine(StatusEarlyHints); err != nil {
+		return err
+	}
+	h := headers.NewHeaders()
+	for _, link := range links {
+		h.Set("Link", link)
+	}
+	return w.WriteHeaders(h)
+}
+
+// writeInterimHeaders completes an interim response. Its fields are left
+// alone: the pending Header() fields and the body encoder are for the final
+// response.
+func (w *Writer) writeInterimHeaders(fields headers.Headers) error {
+	w.state = writerStateStatusLine
+	w.statusCode = 0
+	if !w.interimAllowed() {
+		return nil
+	}
+	w.writeFields(fields)
+	if _, err := w.buf.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.buf.Flush()
 }
 
+// WriteBody writes b using the framing declared in the headers. Writing
+// past the declared Content-Length fails without writing anything.
 func (w *Writer) WriteBody(b []byte) (int, error) {
 	if w.state != writerStateBody {
 		return 0, errors.New("writing body out of order")
 	}
-	n, err := w.Writer.Write(b)
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if w.encoded != nil {
+		return w.encoded.Write(b)
+	}
+	return w.writeBody(b)
+}
+
+// writeBody frames b, which has already been through the encoder if there
+// is one.
+func (w *Writer) writeBody(b []byte) (int, error) {
+	if !w.bodyAllowed() {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.isHead() {
+		return len(b), nil
+	}
+	if w.contentLength >= 0 && w.written+int64(len(b)) > w.contentLength {
+		return 0, ErrContentLength
+	}
+
+	if w.chunked {
+		if _, err := w.writeChunk(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n, err := w.buf.Write(b)
+	w.written += int64(n)
+	if err == nil && w.written == w.contentLength {
+		err = w.Flush()
+	}
+	return n, err
+}
+
+// ReadFrom copies the body from r until EOF, making Writer an io.ReaderFrom
+// so that io.Copy needs no buffer of its own. A body with a Content-Length,
+// or one delimited by closing the connection, that isn't going through a
+// body encoder skips the output buffer: what is buffered is flushed and r
+// is copied straight to the destination, where a *net.TCPConn uses sendfile
+// for an *os.File and splice for another connection. No more than the rest
+// of the Content-Length is read from r. Other bodies are copied through
+// WriteBody, flushing after every read so streams stay streams.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.state != writerStateBody {
+		return 0, errors.New("writing body out of order")
+	}
+	if w.encoded != nil || w.chunked || w.isHead() || !w.bodyAllowed() {
+		return w.copyBody(r)
+	}
+	if err := w.buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	remaining := int64(math.MaxInt64)
+	if w.contentLength >= 0 {
+		remaining = w.contentLength - w.written
+	}
+	// sendfile looks through a single *io.LimitedReader only, so an
+	// io.CopyN from a file is limited in place rather than wrapped again
+	src := &io.LimitedReader{R: r, N: remaining}
+	outer, limited := r.(*io.LimitedReader)
+	if limited {
+		src = &io.LimitedReader{R: outer.R, N: min(outer.N, remaining)}
+	}
+	n, err := io.Copy(w.dst, src)
+	if limited {
+		outer.N -= n
+	}
+	w.written += n
 	return n, err
 }
 
+// copyBody is ReadFrom for bodies that need the framing of WriteBody.
+func (w *Writer) copyBody(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			m, werr := w.WriteBody(buf[:n])
+			total += int64(m)
+			if werr == nil {
+				werr = w.Flush()
+			}
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != writerStateBody {
 		return 0, errors.New("writing body out of order")
 	}
-	chunkSize := len(p)
-	chunk := []byte(fmt.Sprintf("%x\r\n", chunkSize))
-	chunk = append(chunk, p...)
-	chunk = append(chunk, []byte("\r\n")...)
-	n, err := w.Writer.Write(chunk)
-	return n, err
+	// An empty chunk would be read as the end of the body
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.encoded != nil {
+		return w.encoded.Write(p)
+	}
+	if w.isHead() {
+		return len(p), nil
+	}
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	n, _ := fmt.Fprintf(w.buf, "%x\r\n", len(p))
+	m, _ := w.buf.Write(p)
+	k, err := w.buf.WriteString("\r\n")
+	w.written += int64(m)
+	if err == nil && w.flushPolicy == FlushEveryChunk {
+		err = w.Flush()
+	}
+	return n + m + k, err
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	doneLine := fmt.Sprintf("%x\r\n", 0)
-	n, err := w.Writer.Write([]byte(doneLine))
+	if w.state != writerStateBody {
+		return 0, errors.New("writing body out of order")
+	}
+	if err := w.closeEncoder(); err != nil {
+		return 0, err
+	}
 	w.state = writerStateTrailers
-	return n, err
+	// The last chunk and the trailers are part of the body a HEAD response
+	// leaves out
+	if w.isHead() {
+		return 0, nil
+	}
+	doneLine := fmt.Sprintf("%x\r\n", 0)
+	return w.buf.WriteString(doneLine)
 }
 
 func (w *Writer) WriteTrailers(headers headers.Headers) error {
 	if w.state != writerStateTrailers {
-		return errors.New("writing trailers out of order")	
+		return errors.New("writing trailers out of order")
 	}
-	for header, value := range headers{
-		w.Writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", header, value)))
+	if w.isHead() {
+		w.state = writerStateDone
+		return w.Flush()
 	}
-	_, err := w.Writer.Write([]byte("\r\n"))
-	return err
+	w.writeFields(headers)
+	if _, err := w.buf.WriteString("\r\n"); err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	return w.Flush()
+}
+
+func (w *Writer) writeFields(fields headers.Headers) {
+	for name := range fields {
+		for _, value := range fields.Values(name) {
+			w.buf.WriteString(name)
+			w.buf.WriteString(": ")
+			w.buf.WriteString(value)
+			w.buf.WriteString("\r\n")
+		}
+	}
+}
+
+// Finish completes the message once the handler is done with it: a chunked
+// body gets its last chunk and an empty trailer section, a response that was
+// never started becomes an empty 200 and buffered output is flushed. It
+// returns an error
+// when the response can't be completed, e.g. fewer bytes than the declared
+// Content-Length were written, in which case the connection must be aborted
+// rather than leave the client waiting for the rest.
+func (w *Writer) Finish() error {
+	if w.aborted {
+		return ErrAborted
+	}
+	switch w.state {
+	case writerStateStatusLine:
+		// The handler wrote nothing, answer with an empty 200 like net/http
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "0")
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		w.state = writerStateDone
+		return w.Flush()
+	case writerStateDone:
+		if w.hijacked {
+			return nil
+		}
+		return w.Flush()
+	case writerStateHeaders:
+		return errors.New("response headers were never written")
+	case writerStateBody:
+		if err := w.closeEncoder(); err != nil {
+			return err
+		}
+		if w.chunked {
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+			return w.WriteTrailers(nil)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if w.contentLength > w.written && w.bodyAllowed() && !w.isHead() {
+			return ErrShortBody
+		}
+		w.state = writerStateDone
+		return nil
+	case writerStateTrailers:
+		return w.WriteTrailers(nil)
+	default:
+		return errors.New("error: unknown state")
+	}
+}
+
+// closeEncoder writes out what the encoder still holds.
+func (w *Writer) closeEncoder() error {
+	if w.encoded == nil {
+		return nil
+	}
+	encoded := w.encoded
+	w.encoded = nil
+	return encoded.Close()
+}
+
+// encodedBody receives the output of the body encoder.
+type encodedBody struct {
+	w *Writer
+}
+
+func (e encodedBody) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return e.w.writeBody(p)
+}
+
+// KeepAlive reports whether the connection can carry another response once
+// this one is finished.
+func (w *Writer) KeepAlive() bool {
+	return w.state == writerStateDone && !w.closeConn
+}
+
+// bodyAllowed reports whether the status code permits a body (RFC 9110
+// sections 15.2, 15.3.5 and 15.4.5).
+func (w *Writer) bodyAllowed() bool {
+	return !w.statusCode.IsInformational() &&
+		w.statusCode != StatusNoContent &&
+		w.statusCode != StatusNotModified
+}
+
+// interimAllowed reports whether the client understands interim responses,
+// which HTTP/1.0 clients don't (RFC 9110 section 15.2). Those are dropped.
+func (w *Writer) interimAllowed() bool {
+	return w.request == nil || w.request.RequestLine.HttpVersion != "1.0"
+}
+
+func (w *Writer) isHead() bool {
+	return w.request != nil && w.request.RequestLine.Method == "HEAD"
+}
+
+// hasToken reports whether the comma separated list value contains token.
+func hasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		v, _, _ = strings.Cut(v, ";")
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
 }
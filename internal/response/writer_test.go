@@ -0,0 +1,412 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterContentLength(t *testing.T) {
+	// Test: Body matching the declared length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nhello")))
+
+	// Test: Body longer than the declared length
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hel"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("lo!"))
+	assert.ErrorIs(t, err, ErrContentLength)
+	assert.False(t, bytes.HasSuffix(buf.Bytes(), []byte("lo!")))
+
+	// Test: Body shorter than the declared length
+	_, err = w.WriteBody([]byte("l"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.Finish(), ErrShortBody)
+}
+
+func TestWriteError(t *testing.T) {
+	// Test: A complete plain text response that keeps the connection open
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	WriteError(w, StatusNotFound, "Not found")
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-length: 9\r\n")
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+	assert.NotContains(t, out, "connection:")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nNot found"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Headers set beforehand are sent along
+	buf.Reset()
+	w = NewWriter(buf)
+	w.Header().Set("Allow", "GET")
+	WriteError(w, StatusMethodNotAllowed, "Method not allowed")
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "allow: GET\r\n")
+}
+
+func TestWriterBodyNotAllowed(t *testing.T) {
+	// Test: 204 drops Content-Length and refuses a body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Flush())
+	assert.NotContains(t, buf.String(), "content-length")
+	_, err := w.WriteBody([]byte("body"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+
+	// Test: 304 keeps Content-Length but refuses a body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "content-length: 10")
+	_, err = w.WriteBody([]byte("body"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+
+	// Test: HEAD response discards the body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetRequest(&request.Request{RequestLine: request.RequestLine{Method: "HEAD"}})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	n, err := w.WriteBody([]byte("body"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+}
+
+func TestWriterAutomaticChunking(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "transfer-encoding: chunked\r\n")
+
+	_, err := w.WriteBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n")))
+
+	// Test: Nothing can be written after finishing
+	_, err = w.WriteBody([]byte("late"))
+	require.Error(t, err)
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Buffer.Write(p)
+}
+
+func TestWriterBuffering(t *testing.T) {
+	// Test: A small response goes out in a single write
+	dst := &countingWriter{}
+	w := NewWriter(dst)
+	h := GetDefaultHeaders(13)
+	h.Set("X-One", "1")
+	h.Set("X-Two", "2")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, 0, dst.writes)
+	_, err := w.WriteBody([]byte("{\"ok\": true}\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, dst.writes)
+
+	// Test: Explicit flush while streaming
+	dst = &countingWriter{}
+	w = NewWriterSize(dst, 64)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteBody([]byte("tick"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 1, dst.writes)
+	assert.True(t, bytes.HasSuffix(dst.Bytes(), []byte("4\r\ntick\r\n")))
+
+	// Test: Flush after every chunk
+	w.SetFlushPolicy(FlushEveryChunk)
+	_, err = w.WriteBody([]byte("tock"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, dst.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 3, dst.writes)
+	assert.True(t, bytes.HasSuffix(dst.Bytes(), []byte("4\r\ntock\r\n0\r\n\r\n")))
+}
+
+type upperEncoder struct {
+	dst    io.Writer
+	closed bool
+}
+
+func (u *upperEncoder) Write(p []byte) (int, error) {
+	return u.dst.Write(bytes.ToUpper(p))
+}
+
+func (u *upperEncoder) Close() error {
+	u.closed = true
+	_, err := u.dst.Write([]byte("!"))
+	return err
+}
+
+func TestWriterBodyEncoder(t *testing.T) {
+	// Test: The encoder rewrites the headers and the body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	enc := &upperEncoder{}
+	w.SetBodyEncoder(func(statusCode StatusCode, h headers.Headers, dst io.Writer) io.WriteCloser {
+		h.Delete("Content-Length")
+		h.Set("X-Encoded", "upper")
+		enc.dst = dst
+		return enc
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, enc.closed)
+	assert.Contains(t, buf.String(), "x-encoded: upper\r\n")
+	assert.Contains(t, buf.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n5\r\nHELLO\r\n1\r\n!\r\n0\r\n\r\n")))
+
+	// Test: A nil writer leaves the body alone
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetBodyEncoder(func(StatusCode, headers.Headers, io.Writer) io.WriteCloser {
+		return nil
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nhello")))
+}
+
+func TestWriterReset(t *testing.T) {
+	// Test: A buffered response can be started over
+	dst := &countingWriter{}
+	w := NewWriter(dst)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hel"))
+	require.NoError(t, err)
+	require.NoError(t, w.Reset())
+	assert.False(t, w.Committed())
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	require.NoError(t, w.WriteHeaders(nil))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(dst.String(), "HTTP/1.1 304 Not Modified\r\n"))
+	assert.NotContains(t, dst.String(), "hel")
+
+	// Test: Not once something was sent
+	dst = &countingWriter{}
+	w = NewWriter(dst)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.Flush())
+	assert.Error(t, w.Reset())
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(dst.String(), "\r\n\r\nhello"))
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+
+	// Test: A body with a length bypasses the buffer
+	dst := &countingWriter{}
+	w := NewWriter(dst)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	n, err := w.ReadFrom(strings.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(dst.String(), "\r\n\r\n"+body))
+
+	// Test: No more than the Content-Length is read, and a short body is
+	// still reported
+	dst = &countingWriter{}
+	w = NewWriter(dst)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	src := strings.NewReader("hello, world")
+	n, err = w.ReadFrom(src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, 7, src.Len())
+	require.NoError(t, w.Finish())
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.ReadFrom(strings.NewReader("hi"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.Finish(), ErrShortBody)
+
+	// Test: An io.CopyN keeps its limit
+	dst = &countingWriter{}
+	w = NewWriter(dst)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	src = strings.NewReader("0123456789")
+	n, err = io.CopyN(NewResponseWriter(w), src, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, 7, src.Len())
+	_, err = io.CopyN(NewResponseWriter(w), src, 1)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(dst.String(), "\r\n\r\n0123"))
+
+	// Test: Chunked bodies are framed
+	buf := &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	n, err = w.ReadFrom(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+}
+
+func TestWriterReadFromFile(t *testing.T) {
+	body := bytes.Repeat([]byte("sendfile"), 1<<17)
+	path := filepath.Join(t.TempDir(), "body")
+	require.NoError(t, os.WriteFile(path, body, 0o644))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	// Test: A file is copied to a TCP connection
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	n, err := io.Copy(NewResponseWriter(w), file)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	require.NoError(t, w.Finish())
+	conn.Close()
+	data := <-received
+	assert.True(t, bytes.HasSuffix(data, append([]byte("\r\n\r\n"), body...)))
+}
+
+func TestWriterSetCookie(t *testing.T) {
+	// Test: Every Set-Cookie value gets a line of its own
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Header().Set("Set-Cookie", "a=1; Path=/")
+	w.Header().Set("Set-Cookie", "b=2; Expires=Wed, 02 Jan 2030 02:04:05 GMT")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "set-cookie: a=1; Path=/\r\nset-cookie: b=2; Expires=Wed, 02 Jan 2030 02:04:05 GMT\r\n")
+
+	resp, err := ResponseFromReader(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Expires=Wed, 02 Jan 2030 02:04:05 GMT"}, resp.Headers.Values("Set-Cookie"))
+}
+
+func TestWriterInterim(t *testing.T) {
+	// Test: Early hints are sent right away, before the final response
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Header().Set("Set-Cookie", "a=1")
+	require.NoError(t, w.WriteEarlyHints("</style.css>; rel=preload; as=style", "</app.js>; rel=preload; as=script"))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script\r\n\r\n", buf.String())
+	assert.False(t, w.Committed())
+
+	// Test: Any number of them
+	h := headers.NewHeaders()
+	h.Set("Link", "</font.woff2>; rel=preload; as=font")
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err := w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 2, strings.Count(buf.String(), "HTTP/1.1 103 Early Hints\r\n"))
+	assert.Equal(t, 1, strings.Count(buf.String(), "set-cookie: a=1\r\n"))
+	assert.Contains(t, buf.String(), "\r\n\r\nHTTP/1.1 200 OK\r\n")
+
+	resp, err := ResponseFromReader(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "ok", string(resp.Body))
+
+	// Test: A response that ends after the hints is an empty 200
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteEarlyHints("</a.css>; rel=preload"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nHTTP/1.1 200 OK\r\ncontent-length: 0\r\n\r\n"))
+
+	// Test: HTTP/1.0 clients don't get any
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetRequest(&request.Request{RequestLine: request.RequestLine{Method: "GET", HttpVersion: "1.0"}})
+	require.NoError(t, w.WriteEarlyHints("</a.css>; rel=preload"))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+}
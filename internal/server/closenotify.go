@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+)
+
+// aLongTimeAgo is a read deadline that makes a blocked Read return at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// closeWatcher tells a handler that the client has closed the connection,
+// by reading ahead on it while the handler runs. The request has been read
+// in full by then, so what arrives is either the end of the connection or
+// the start of a pipelined request. The latter is left in the reader for the
+// next ReadRequest and ends the watch, since the client is evidently still
+// there.
+type closeWatcher struct {
+	conn   net.Conn
+	reader *request.Reader
+
+	mu      sync.Mutex
+	stopped bool
+	// closed is closed when the client is gone
+	closed chan struct{}
+	// done is closed when the read ahead has returned
+	done chan struct{}
+}
+
+// notify is the CloseNotifyFunc of the response. The read ahead only starts
+// when a handler asks for it.
+func (c *closeWatcher) notify() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+		if !c.stopped {
+			c.done = make(chan struct{})
+			go c.watch()
+		}
+	}
+	return c.closed
+}
+
+func (c *closeWatcher) watch() {
+	defer close(c.done)
+	n, err := c.reader.Fill()
+	if n == 0 && err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		close(c.closed)
+	}
+}
+
+// stop ends the read ahead before the connection is read from or handed
+// over again, and reports whether the client is gone.
+func (c *closeWatcher) stop() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		c.stopped = true
+		return false
+	}
+	if !c.stopped {
+		c.stopped = true
+		c.conn.SetReadDeadline(aLongTimeAgo)
+		<-c.done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseNotify(t *testing.T) {
+	gone := make(chan bool, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		closed := w.CloseNotify()
+		if req.RequestLine.RequestTarget != "/stream" {
+			body := []byte(req.RequestLine.RequestTarget)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(headers.Headers{"content-length": strconv.Itoa(len(body))})
+			w.WriteBody(body)
+			return
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(nil)
+		w.WriteBody([]byte("started"))
+		w.Flush()
+		select {
+		case <-closed:
+			gone <- true
+		case <-time.After(5 * time.Second):
+			gone <- false
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The handler learns that the client closed the connection
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	conn.Close()
+	assert.True(t, <-gone)
+
+	// Test: Pipelined requests read ahead are still answered
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /second HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "HTTP/1.1 200 OK"))
+	assert.True(t, strings.HasSuffix(string(data), "/second"))
+}
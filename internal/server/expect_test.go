@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpectContinue(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/reject" {
+			response.WriteError(w, response.StatusContentTooLarge, "too large")
+			return
+		}
+		if err := req.ReadBody(); err != nil {
+			response.WriteError(w, response.StatusBadRequest, err.Error())
+			return
+		}
+		response.WriteError(w, response.StatusOK, "got "+string(req.Body))
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	readLine := func(r *bufio.Reader) string {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		return line
+	}
+	readHeaders := func(r *bufio.Reader) string {
+		var fields strings.Builder
+		for line := readLine(r); line != "\r\n"; line = readLine(r) {
+			fields.WriteString(line)
+		}
+		return fields.String()
+	}
+
+	// Test: 100 Continue once the handler reads the body, which the client
+	// only sends then
+	conn, r := dial()
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", readLine(r))
+	assert.Equal(t, "\r\n", readLine(r))
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readLine(r))
+	readHeaders(r)
+	body := make([]byte, len("got hello"))
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+	assert.Equal(t, "got hello", string(body))
+
+	// Test: No 100 when the handler answers without the body, and the
+	// connection is closed rather than wait for it
+	conn, r = dial()
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /reject HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5000000\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large\r\n", readLine(r))
+	_, err = io.ReadAll(r)
+	require.NoError(t, err)
+
+	// Test: Other expectations fail and close the connection
+	conn, r = dial()
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 200-ok\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed\r\n", readLine(r))
+	assert.Contains(t, readHeaders(r), "connection: close\r\n")
+	_, err = io.ReadAll(r)
+	require.NoError(t, err)
+}
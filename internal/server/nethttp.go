@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// FromHTTPHandler runs a net/http handler under Server. The ResponseWriter
+// it gets also implements http.Flusher and http.Hijacker. Trailers are sent
+// for the names announced in the Trailer header before the response was
+// started.
+func FromHTTPHandler(h http.Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		r, err := toHTTPRequest(req)
+		if err != nil {
+			response.WriteError(w, response.StatusBadRequest, fmt.Sprintf("Invalid request %v", err))
+			return
+		}
+		rw := &httpResponseWriter{w: w, header: http.Header{}}
+		h.ServeHTTP(rw, r)
+		rw.finish()
+	}
+}
+
+func toHTTPRequest(req *request.Request) (*http.Request, error) {
+	target := req.RequestLine.RequestTarget
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, err
+	}
+	proto := "HTTP/" + req.RequestLine.HttpVersion
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("invalid version %q", proto)
+	}
+
+	header := req.Headers.HTTP()
+	host := req.Host
+	if host == "" {
+		host = header.Get("Host")
+	}
+	header.Del("Host")
+
+	var body io.Reader = bytes.NewReader(req.Body)
+	contentLength := int64(len(req.Body))
+	if req.BodyReader != nil {
+		body = req.BodyReader
+		contentLength = -1
+		if cl, err := req.Headers.Get("Content-Length"); err == nil {
+			if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+				contentLength = n
+			}
+		}
+	}
+
+	r := &http.Request{
+		Method:        req.RequestLine.Method,
+		URL:           u,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          io.NopCloser(body),
+		ContentLength: contentLength,
+		Close:         !req.KeepAlive(),
+		Host:          host,
+		Trailer:       req.Trailers.HTTP(),
+		RemoteAddr:    req.RemoteAddr,
+		RequestURI:    target,
+	}
+	if contentLength == 0 {
+		r.Body = http.NoBody
+	}
+	return r, nil
+}
+
+// httpResponseWriter implements http.ResponseWriter on top of a Writer. Like
+// net/http it holds the status until the first write, so the Content-Type
+// can still be sniffed after WriteHeader.
+type httpResponseWriter struct {
+	w         *response.Writer
+	header    http.Header
+	status    int
+	committed bool
+}
+
+var (
+	_ http.Flusher  = (*httpResponseWriter)(nil)
+	_ http.Hijacker = (*httpResponseWriter)(nil)
+)
+
+func (rw *httpResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *httpResponseWriter) WriteHeader(code int) {
+	if rw.status != 0 || rw.w.Hijacked() {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+	}
+	// Interim responses are sent right away with the header map as it is,
+	// which stays in place for the final response. A 101 would have to come
+	// with a hijacked connection, so it is dropped.
+	if code < 200 {
+		if code != http.StatusSwitchingProtocols && !rw.committed {
+			rw.w.WriteStatusLine(response.StatusCode(code))
+			rw.w.WriteHeaders(headers.FromHTTP(rw.header))
+		}
+		return
+	}
+	rw.status = code
+}
+
+// commit writes the status line and headers, sniffing the Content-Type from
+// the first bytes of the body when none was set.
+func (rw *httpResponseWriter) commit(p []byte) {
+	if rw.committed {
+		return
+	}
+	rw.committed = true
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.header.Get("Content-Type") == "" && len(p) > 0 {
+		rw.header.Set("Content-Type", http.DetectContentType(p))
+	}
+
+	h := rw.w.Header()
+	for name, values := range rw.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		// Set joins repeated fields with the right separator, which keeps
+		// Set-Cookie fields apart
+		for i, value := range values {
+			if i == 0 {
+				h.Overwrite(name, value)
+			} else {
+				h.Set(name, value)
+			}
+		}
+	}
+	rw.w.WriteStatusLine(response.StatusCode(rw.status))
+	rw.w.WriteHeaders(nil)
+}
+
+func (rw *httpResponseWriter) Write(p []byte) (int, error) {
+	if rw.w.Hijacked() {
+		return 0, http.ErrHijacked
+	}
+	rw.commit(p)
+	return rw.w.WriteBody(p)
+}
+
+func (rw *httpResponseWriter) Flush() {
+	if rw.w.Hijacked() {
+		return
+	}
+	rw.commit(nil)
+	rw.w.Flush()
+}
+
+func (rw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.committed {
+		return nil, nil, errors.New("hijacking after the response was started")
+	}
+	return rw.w.Hijack()
+}
+
+// finish completes the response after the handler returned, sending the
+// trailers if the body is chunked.
+func (rw *httpResponseWriter) finish() {
+	if rw.w.Hijacked() {
+		return
+	}
+	if !rw.committed {
+		if rw.header.Get("Content-Length") == "" && rw.header.Get("Transfer-Encoding") == "" {
+			rw.header.Set("Content-Length", "0")
+		}
+		rw.commit(nil)
+	}
+
+	body, err := response.NewChunkedWriter(rw.w)
+	if err != nil {
+		return
+	}
+	for _, declared := range rw.header.Values("Trailer") {
+		for _, name := range strings.Split(declared, ",") {
+			name = strings.TrimSpace(name)
+			if value := rw.header.Get(name); value != "" {
+				body.Trailer().Set(name, value)
+			}
+		}
+	}
+	for name, values := range rw.header {
+		if trailer, ok := strings.CutPrefix(name, http.TrailerPrefix); ok {
+			body.Trailer().Set(trailer, strings.Join(values, ", "))
+		}
+	}
+	body.Close()
+}
+
+var errHijacked = errors.New("connection was hijacked")
+
+// ToHTTPHandler mounts h in a net/http server. The response is written to a
+// pipe and parsed again, which keeps the Writer's framing rules and lets a
+// streaming handler reach the client whenever it flushes.
+func ToHTTPHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := fromHTTPRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pr, pw := io.Pipe()
+		w := response.NewWriter(pw)
+		w.SetRequest(req)
+		var hijacked atomic.Bool
+		if hj, ok := rw.(http.Hijacker); ok {
+			w.SetHijacker(func() (net.Conn, *bufio.ReadWriter, error) {
+				conn, brw, err := hj.Hijack()
+				if err == nil {
+					hijacked.Store(true)
+					pw.CloseWithError(errHijacked)
+				}
+				return conn, brw, err
+			})
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h(w, req)
+			if !w.Hijacked() {
+				pw.CloseWithError(w.Finish())
+			}
+		}()
+		defer func() {
+			pr.Close()
+			<-done
+		}()
+
+		parser := response.NewParser(pr)
+		head, err := parser.ReadResponseHead(req)
+		for err == nil && head.IsInterim() {
+			_, err = io.Copy(io.Discard, parser.BodyReader(head))
+			if err == nil {
+				head, err = parser.ReadResponseHead(req)
+			}
+		}
+		if err != nil {
+			if !hijacked.Load() {
+				http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		for name := range head.Headers {
+			switch name {
+			case "connection", "keep-alive", "transfer-encoding":
+				continue
+			}
+			for _, value := range head.Headers.Values(name) {
+				rw.Header().Add(http.CanonicalHeaderKey(name), value)
+			}
+		}
+		rw.WriteHeader(int(head.StatusLine.StatusCode))
+
+		controller := http.NewResponseController(rw)
+		buf := make([]byte, 32*1024)
+		body := parser.BodyReader(head)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				rw.Write(buf[:n])
+				controller.Flush()
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// Abort the connection so a truncated body isn't mistaken for
+				// a complete one
+				panic(http.ErrAbortHandler)
+			}
+		}
+		for name, value := range head.Trailers {
+			rw.Header().Set(http.TrailerPrefix+http.CanonicalHeaderKey(name), value)
+		}
+	})
+}
+
+func fromHTTPRequest(r *http.Request) (*request.Request, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+	b := request.NewBuilder(r.Method, target)
+	for name, value := range headers.FromHTTP(r.Header) {
+		b.Header(name, value)
+	}
+	req, err := b.BodyBytes(body).Build()
+	if err != nil {
+		return nil, err
+	}
+	if r.Host != "" {
+		req.Headers.Overwrite("Host", r.Host)
+	}
+	if r.ProtoMajor > 0 {
+		req.RequestLine.HttpVersion = fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	}
+	for name, values := range r.Trailer {
+		req.Trailers.Overwrite(name, strings.Join(values, ", "))
+	}
+	if r.TLS != nil {
+		req.Scheme = "https"
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if err := req.ValidateHost(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
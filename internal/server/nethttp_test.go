@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromHTTPHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Query", r.URL.Query().Get("name"))
+		w.Header().Set("X-Host", r.Host)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	mux.HandleFunc("/trailers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		io.WriteString(w, "a")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "b")
+		w.Header().Set("X-Sum", "ab")
+	})
+	mux.HandleFunc("/cookies", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		w.Header().Add("X-Multi", "x")
+		w.Header().Add("X-Multi", "y")
+	})
+	mux.HandleFunc("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString("echo " + line)
+		rw.Flush()
+	})
+
+	s, err := Serve(0, FromHTTPHandler(mux))
+	require.NoError(t, err)
+	defer s.Close()
+	base := fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	// Test: Request and response are translated
+	resp, err := http.Get(base + "/hello?name=gopher")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "/hello", resp.Header.Get("X-Path"))
+	assert.Equal(t, "gopher", resp.Header.Get("X-Query"))
+	assert.Equal(t, base[len("http://"):], resp.Header.Get("X-Host"))
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Test: Request body
+	resp, err = http.Post(base+"/echo", "text/plain", strings.NewReader("ping"))
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ping", string(body))
+
+	// Test: Unknown path is a 404 from the mux
+	resp, err = http.Get(base + "/missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Test: Flushed chunked body with trailers
+	req, _ := http.NewRequest("GET", base+"/trailers", nil)
+	req.Header.Set("TE", "trailers")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ab", string(body))
+	assert.Equal(t, "ab", resp.Trailer.Get("X-Sum"))
+
+	// Test: Each cookie keeps its own Set-Cookie line, other fields are
+	// combined
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /cookies HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(raw), "set-cookie:"))
+	assert.Contains(t, string(raw), "set-cookie: a=1\r\n")
+	assert.Contains(t, string(raw), "set-cookie: b=2\r\n")
+	assert.Contains(t, string(raw), "x-multi: x, y\r\n")
+
+	// Test: Hijacked connection keeps bytes sent after the request
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\nhi\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo hi\n", line)
+}
+
+func TestToHTTPHandler(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/stream":
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Trailer", "X-Count")
+			w.WriteHeaders(h)
+			body, err := response.NewChunkedWriter(w)
+			if err != nil {
+				return
+			}
+			io.WriteString(body, "one ")
+			body.Flush()
+			io.WriteString(body, "two")
+			body.Trailer().Set("X-Count", "2")
+			body.Close()
+		case "/short":
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.WriteBody([]byte("short"))
+		default:
+			host, _ := req.Headers.Get("Host")
+			response.WriteError(w, response.StatusAccepted, req.RequestLine.Method+" "+host+" "+string(req.Body))
+		}
+	}
+	ts := httptest.NewServer(ToHTTPHandler(handler))
+	defer ts.Close()
+
+	// Test: Request and response are translated
+	resp, err := http.Post(ts.URL+"/", "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "POST "+ts.Listener.Addr().String()+" data", string(body))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+
+	// Test: Chunked body and trailers
+	req, _ := http.NewRequest("GET", ts.URL+"/stream", nil)
+	req.Header.Set("TE", "trailers")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "one two", string(body))
+	assert.Equal(t, "2", resp.Trailer.Get("X-Count"))
+
+	// Test: A body shorter than its Content-Length aborts the response
+	resp, err = http.Get(ts.URL + "/short")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+}
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync/atomic"
+	"time"
 
 	"github.com/derjabineli/httpfromtcp/internal/request"
 	"github.com/derjabineli/httpfromtcp/internal/response"
@@ -14,27 +19,54 @@ type Server struct {
   listener net.Listener 
   closed atomic.Bool
 	handler Handler
+  config Config
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// Config holds the optional settings of a Server. The zero value is usable.
+type Config struct {
+  // WriteBufferSize is the size of the response output buffer
+  WriteBufferSize int
+  // FlushPolicy controls when buffered response output is sent
+  FlushPolicy response.FlushPolicy
+  // IdleTimeout is how long a persistent connection waits for the next
+  // request, defaulting to two minutes
+  IdleTimeout time.Duration
+}
+
+const defaultIdleTimeout = 2 * time.Minute
 
 func Serve(port int, handler Handler) (*Server, error) {
+  return ServeWithConfig(port, handler, Config{})
+}
+
+func ServeWithConfig(port int, handler Handler, config Config) (*Server, error) {
   portAddr := fmt.Sprintf(":%d", port)
   listener, err := net.Listen("tcp", portAddr)
   if err != nil {
     return nil, err
   }
 
+  if config.IdleTimeout <= 0 {
+    config.IdleTimeout = defaultIdleTimeout
+  }
   s := &Server{
     listener: listener,
 		handler: handler,
+    config: config,
   }
 
   go s.listen()
   return s, nil
 }
 
+// Addr returns the address the server is listening on, which is how to find
+// the port when serving on port 0.
+func (s *Server) Addr() net.Addr {
+  return s.listener.Addr()
+}
+
 func (s *Server) Close() error {
   s.closed.Store(true)
   if s.listener != nil {
@@ -58,15 +90,138 @@ func (s *Server) listen() {
   }
  }
 
+// handle serves requests on conn until either side asks to close it.
 func (s *Server) handle(conn net.Conn) {
-  defer conn.Close() 
-	w := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-  if err != nil {
-    w.WriteStatusLine(response.StatusBadRequest)
-    body := []byte(fmt.Sprintf("Error parsing request %v", err))
-    w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-    w.WriteBody(body)
+  hijacked := false
+  defer func() {
+    if !hijacked {
+      conn.Close()
+    }
+  }()
+  reader := request.NewReader(conn)
+  for {
+    conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+    w := response.NewWriterSize(conn, s.config.WriteBufferSize)
+    w.SetFlushPolicy(s.config.FlushPolicy)
+    req, err := reader.ReadRequestHeader()
+    if err != nil {
+      readFailed(w, err)
+      return
+    }
+    w.SetRequest(req)
+    expectContinue, err := req.ValidateExpect()
+    if err != nil {
+      reject(w, response.StatusExpectationFailed, err.Error())
+      return
+    }
+    // A client expecting 100 Continue only sends the body once the handler
+    // asks for it
+    var body *continueReader
+    if expectContinue {
+      body = &continueReader{w: w, body: reader.BodyReader(req)}
+      req.BodyReader = body
+    } else if err := reader.ReadBody(req); err != nil {
+      readFailed(w, err)
+      return
+    }
+    conn.SetReadDeadline(time.Time{})
+
+    req.RemoteAddr = conn.RemoteAddr().String()
+    watcher := &closeWatcher{conn: conn, reader: reader}
+    // The watcher reads ahead, which has to wait until the body is read
+    if body == nil {
+      w.SetCloseNotifier(watcher.notify)
+    }
+    w.SetHijacker(func() (net.Conn, *bufio.ReadWriter, error) {
+      watcher.stop()
+      hijacked = true
+      buffered := bytes.NewReader(bytes.Clone(reader.Buffered()))
+      rw := bufio.NewReadWriter(
+        bufio.NewReader(io.MultiReader(buffered, conn)),
+        bufio.NewWriter(conn),
+      )
+      return conn, rw, nil
+    })
+    if err := req.ValidateHost(); err != nil {
+      reject(w, response.StatusBadRequest, fmt.Sprintf("Invalid host %v", err))
+      return
+    }
+    s.handler(w, req)
+    clientGone := watcher.stop()
+    if w.Hijacked() {
+      return
+    }
+    if err := w.Finish(); err != nil {
+      // A client that went away is the usual end of a stream, not an error
+      if !clientGone {
+        log.Printf("Aborting response: %v", err)
+      }
+      abort(conn)
+      return
+    }
+    // The rest of a body that wasn't read may still be on its way
+    if body != nil && !body.eof {
+      return
+    }
+    if clientGone || !w.KeepAlive() || s.closed.Load() {
+      return
+    }
+  }
+}
+
+// readFailed answers a request that couldn't be read, unless the client
+// just closed the connection or went quiet.
+func readFailed(w *response.Writer, err error) {
+  var netErr net.Error
+  if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+    return
+  }
+  reject(w, response.StatusBadRequest, fmt.Sprintf("Error parsing request %v", err))
+}
+
+// continueReader is the body of a request that expects 100 Continue, which
+// is sent when the handler first reads from it. A handler that answers
+// without reading the body gets no 100, and a handler that reads it after
+// starting the final response can't send one anymore.
+type continueReader struct {
+  w *response.Writer
+  body io.Reader
+  asked bool
+  eof bool
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+  if !c.asked {
+    c.asked = true
+    if !c.w.Committed() {
+      if err := c.w.WriteStatusLine(response.StatusContinue); err != nil {
+        return 0, err
+      }
+      if err := c.w.WriteHeaders(nil); err != nil {
+        return 0, err
+      }
+    }
+  }
+  n, err := c.body.Read(p)
+  if err == io.EOF {
+    c.eof = true
   }
-	s.handler(w, req)
+  return n, err
+}
+
+// abort makes the deferred Close reset the connection so the client can't
+// mistake a truncated response for a complete one.
+func abort(conn net.Conn) {
+  if tcpConn, ok := conn.(*net.TCPConn); ok {
+    tcpConn.SetLinger(0)
+  }
+}
+
+// reject answers a request the server couldn't hand to the handler and asks
+// for the connection to be closed, since where the next request starts is
+// unknown.
+func reject(w *response.Writer, statusCode response.StatusCode, message string) {
+  w.Header().Set("Connection", "close")
+  response.WriteError(w, statusCode, message)
+  w.Finish()
 }
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+// HostMux dispatches requests to a Handler based on the request host, so a
+// single Server can serve several virtual hosts. Patterns are either exact
+// host names ("api.example.test") or wildcards ("*.example.test") matching
+// any subdomain. Exact names win over wildcards and longer wildcards win
+// over shorter ones.
+type HostMux struct {
+	exact     map[string]Handler
+	wildcards map[string]Handler
+	fallback  Handler
+}
+
+func NewHostMux() *HostMux {
+	return &HostMux{
+		exact:     map[string]Handler{},
+		wildcards: map[string]Handler{},
+	}
+}
+
+// Handle registers handler for the host pattern.
+func (m *HostMux) Handle(pattern string, handler Handler) error {
+	pattern = normalizeHostname(pattern)
+	if handler == nil {
+		return errors.New("nil handler")
+	}
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		if suffix == "" || strings.Contains(suffix, "*") {
+			return errors.New("invalid wildcard host pattern")
+		}
+		if _, exists := m.wildcards[suffix]; exists {
+			return errors.New("duplicate host pattern " + pattern)
+		}
+		m.wildcards[suffix] = handler
+		return nil
+	}
+
+	if pattern == "" || strings.Contains(pattern, "*") {
+		return errors.New("invalid host pattern")
+	}
+	if _, exists := m.exact[pattern]; exists {
+		return errors.New("duplicate host pattern " + pattern)
+	}
+	m.exact[pattern] = handler
+	return nil
+}
+
+// HandleDefault sets the handler used when no pattern matches. Without one
+// unmatched requests get a 421 Misdirected Request.
+func (m *HostMux) HandleDefault(handler Handler) {
+	m.fallback = handler
+}
+
+// Serve is a Handler that dispatches to the handler registered for the
+// request host.
+func (m *HostMux) Serve(w *response.Writer, req *request.Request) {
+	if req.Host == "" {
+		if err := req.ValidateHost(); err != nil {
+			response.WriteError(w, response.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	handler := m.match(normalizeHostname(req.Hostname()))
+	if handler == nil {
+		response.WriteError(w, response.StatusMisdirectedRequest, "no site configured for host "+req.Host)
+		return
+	}
+	handler(w, req)
+}
+
+func (m *HostMux) match(host string) Handler {
+	if handler, ok := m.exact[host]; ok {
+		return handler
+	}
+	// Walk the labels from the most to the least specific suffix
+	for i := strings.IndexByte(host, '.'); i != -1; {
+		if handler, ok := m.wildcards[host[i+1:]]; ok {
+			return handler
+		}
+		next := strings.IndexByte(host[i+1:], '.')
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return m.fallback
+}
+
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
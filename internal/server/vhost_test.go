@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveHost(m *HostMux, host string) string {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.RequestLine.RequestTarget = "/"
+	req.Headers.Set("Host", host)
+	buf := &bytes.Buffer{}
+	m.Serve(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func named(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		response.WriteError(w, response.StatusOK, name)
+	}
+}
+
+func TestHostMux(t *testing.T) {
+	m := NewHostMux()
+	require.NoError(t, m.Handle("example.test", named("exact")))
+	require.NoError(t, m.Handle("*.example.test", named("wildcard")))
+	require.NoError(t, m.Handle("*.api.example.test", named("api")))
+	require.Error(t, m.Handle("example.test", named("again")))
+	require.Error(t, m.Handle("*.", named("bad")))
+
+	// Test: Exact match ignores case, port and trailing dot
+	assert.Contains(t, serveHost(m, "Example.Test.:42069"), "exact")
+
+	// Test: Wildcard matches nested subdomains
+	assert.Contains(t, serveHost(m, "www.example.test"), "wildcard")
+	assert.Contains(t, serveHost(m, "a.b.example.test"), "wildcard")
+
+	// Test: Longest wildcard wins
+	assert.Contains(t, serveHost(m, "v1.api.example.test"), "api")
+
+	// Test: Unknown host without a default
+	assert.Contains(t, serveHost(m, "other.test"), "421 Misdirected Request")
+
+	// Test: Unknown host with a default
+	m.HandleDefault(named("default"))
+	assert.Contains(t, serveHost(m, "other.test"), "default")
+
+	// Test: Malformed host
+	assert.Contains(t, serveHost(m, "[::1"), "400 Bad Request")
+}
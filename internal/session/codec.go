@@ -0,0 +1,118 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidCookie = errors.New("invalid session cookie")
+
+// payload is what the session cookie carries.
+type payload struct {
+	ID string `json:"id"`
+	// Accessed is when the cookie was issued, in Unix seconds
+	Accessed int64             `json:"t"`
+	Values   map[string]string `json:"v,omitempty"`
+}
+
+// encode turns p into a cookie value: the base64url encoded payload,
+// encrypted with Encrypt, a dot and the base64url encoded HMAC-SHA256 of
+// the cookie name and the payload.
+func (m *Manager) encode(p payload) (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	key := m.Keys[0]
+	if m.Encrypt {
+		if data, err = encrypt(key, m.cookieName(), data); err != nil {
+			return "", err
+		}
+	}
+	value := base64.RawURLEncoding.EncodeToString(data)
+	return value + "." + base64.RawURLEncoding.EncodeToString(sign(key, m.cookieName(), value)), nil
+}
+
+// decode verifies and opens a cookie value. rotated reports that it was
+// signed with a key other than the first.
+func (m *Manager) decode(value string) (p payload, rotated bool, err error) {
+	data, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return p, false, ErrInvalidCookie
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return p, false, ErrInvalidCookie
+	}
+	for i, key := range m.Keys {
+		if !hmac.Equal(sum, sign(key, m.cookieName(), data)) {
+			continue
+		}
+		plain, err := base64.RawURLEncoding.DecodeString(data)
+		if err == nil && m.Encrypt {
+			plain, err = decrypt(key, m.cookieName(), plain)
+		}
+		if err != nil || json.Unmarshal(plain, &p) != nil || p.ID == "" {
+			return payload{}, false, ErrInvalidCookie
+		}
+		return p, i > 0, nil
+	}
+	return p, false, ErrInvalidCookie
+}
+
+// subkey derives independent keys for signing and encryption from key.
+func subkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// sign binds the value to the cookie name, so that it can't be moved to
+// another cookie signed with the same key.
+func sign(key []byte, name, value string) []byte {
+	mac := hmac.New(sha256.New, subkey(key, "sign"))
+	mac.Write([]byte(name))
+	mac.Write([]byte{'='})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(subkey(key, "encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals data with AES-256-GCM behind a random nonce.
+func encrypt(key []byte, name string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func decrypt(key []byte, name string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrInvalidCookie
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, []byte(name))
+}
@@ -0,0 +1,313 @@
+// Package session keeps server-side sessions for handlers, either entirely
+// in a signed cookie or in a Store keyed by a session ID that the cookie
+// carries.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/cookie"
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+)
+
+const (
+	defaultCookieName  = "session"
+	defaultIdleTimeout = 30 * time.Minute
+	// maxCookieSize is the smallest limit browsers are required to support
+	// (RFC 6265 section 6.1)
+	maxCookieSize = 4096
+)
+
+// Manager is a middleware giving every request passing through it a
+// Session, available to the handlers below it through Get.
+//
+// The session cookie is HMAC signed and, with Encrypt, AES-GCM encrypted.
+// It is sent when the response headers are written, so changes after that
+// point only survive with a Store, and only for sessions that already
+// existed. A session that hasn't been used for IdleTimeout is gone.
+//
+// Only a Store can revoke a session. Without one the server keeps no record
+// of the sessions it issued, so after Regenerate or Destroy the client's old
+// cookie stays valid until its IdleTimeout runs out, for whoever holds a
+// copy of it. Use a Store wherever logging out or regenerating the ID on
+// login has to lock out an earlier cookie.
+type Manager struct {
+	Next server.Handler
+	// Keys are the secrets the cookie is signed with, ideally 32 random
+	// bytes each. New cookies use the first key and every key is tried when
+	// verifying one, so keys are rotated by putting a new key in front and
+	// dropping the old one once the sessions using it have expired.
+	// Cookies verified with an older key are reissued with the first.
+	Keys [][]byte
+	// Encrypt hides the content of the cookie from the client
+	Encrypt bool
+	// Store keeps the session values on the server, leaving only the
+	// session ID in the cookie. Without a Store the values travel in the
+	// cookie, which limits them to a few kilobytes, and sessions can't be
+	// revoked.
+	Store Store
+	// IdleTimeout is how long an unused session lives, 30 minutes when zero
+	IdleTimeout time.Duration
+
+	// CookieName is "session" when empty
+	CookieName string
+	// Path defaults to "/"
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite cookie.SameSite
+
+	sessions sync.Map
+	now      func() time.Time
+}
+
+func New(next server.Handler, keys ...[]byte) *Manager {
+	return &Manager{Next: next, Keys: keys, SameSite: cookie.SameSiteLax, now: time.Now}
+}
+
+// Session holds the values of one client's session. It is safe for use by
+// several goroutines.
+type Session struct {
+	mu     sync.Mutex
+	id     string
+	values map[string]string
+	// loaded means the client sent a valid cookie for the session
+	loaded bool
+	// modified means the cookie has to be sent again
+	modified bool
+	// previousID is the ID the session had before Regenerate or Destroy
+	previousID string
+	accessed   time.Time
+}
+
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.modified = true
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.modified = true
+	}
+}
+
+// Regenerate gives the session a new ID and keeps its values. Call it
+// whenever the privileges of the session change, e.g. on login, so that an
+// ID an attacker planted or learned beforehand is worthless. That takes a
+// Store: without one the previous cookie remains valid.
+func (s *Session) Regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renew()
+}
+
+// Destroy removes all values and the ID of the session, e.g. on logout.
+// The client's cookie is deleted unless values are set again. Without a
+// Store a copy of the old cookie still carries the session.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[string]string{}
+	s.renew()
+}
+
+func (s *Session) renew() {
+	if s.loaded && s.previousID == "" {
+		s.previousID = s.id
+	}
+	s.id = newID()
+	s.modified = true
+}
+
+// Get returns the session of req, or nil when req didn't come through m.
+func (m *Manager) Get(req *request.Request) *Session {
+	s, ok := m.sessions.Load(req)
+	if !ok {
+		return nil
+	}
+	return s.(*Session)
+}
+
+func (m *Manager) Serve(w *response.Writer, req *request.Request) {
+	if len(m.Keys) == 0 {
+		response.WriteError(w, response.StatusInternalServerError, "Sessions aren't configured")
+		return
+	}
+	s := m.load(req)
+	m.sessions.Store(req, s)
+	defer m.sessions.Delete(req)
+
+	next := w.BodyEncoder()
+	w.SetBodyEncoder(func(statusCode response.StatusCode, h headers.Headers, dst io.Writer) io.WriteCloser {
+		m.save(s, h)
+		if next != nil {
+			return next(statusCode, h, dst)
+		}
+		return nil
+	})
+	m.Next(w, req)
+	w.SetBodyEncoder(next)
+
+	// A handler that wrote nothing gets the empty response of Finish,
+	// which still picks up the cookie from the pending headers
+	if !w.Committed() && !w.Hijacked() {
+		m.save(s, w.Header())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.persist(s)
+}
+
+// load restores the session named by the cookie of req, or starts a new
+// one when there is no valid cookie or the session has expired.
+func (m *Manager) load(req *request.Request) *Session {
+	now := m.clock()
+	if c, err := req.Cookie(m.cookieName()); err == nil {
+		p, rotated, err := m.decode(c.Value)
+		accessed := time.Unix(p.Accessed, 0)
+		if err == nil && now.Sub(accessed) < m.idleTimeout() {
+			values := p.Values
+			ok := true
+			if m.Store != nil {
+				values, ok = m.Store.Load(p.ID)
+			}
+			if ok {
+				if values == nil {
+					values = map[string]string{}
+				}
+				return &Session{id: p.ID, values: values, loaded: true, modified: rotated, accessed: accessed}
+			}
+		}
+	}
+	return &Session{id: newID(), values: map[string]string{}, accessed: now}
+}
+
+// save adds the session cookie to h when the client needs a new one, and
+// updates the Store.
+func (m *Manager) save(s *Session, h headers.Headers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := m.clock()
+
+	var c *cookie.Cookie
+	switch {
+	case len(s.values) == 0:
+		// Nothing worth a cookie, and one the client has is deleted
+		if s.loaded && s.modified {
+			c = m.cookie("")
+			c.MaxAge = -1
+		}
+	case s.modified || now.Sub(s.accessed) > m.idleTimeout()/10:
+		// Unmodified sessions are refreshed now and then to keep them alive
+		// without a Set-Cookie on every response
+		s.accessed = now
+		p := payload{ID: s.id, Accessed: now.Unix()}
+		if m.Store == nil {
+			p.Values = s.values
+		}
+		value, err := m.encode(p)
+		if err != nil || len(value) > maxCookieSize {
+			log.Printf("Can't store session in a cookie of %d bytes: %v", len(value), err)
+			break
+		}
+		c = m.cookie(value)
+	}
+	if c != nil {
+		if err := cookie.Set(h, c); err != nil {
+			log.Printf("Invalid session cookie: %v", err)
+		}
+	}
+	m.persist(s)
+}
+
+// persist writes the session to the Store, if there is one. s.mu must be
+// held.
+func (m *Manager) persist(s *Session) {
+	if m.Store == nil {
+		return
+	}
+	if s.previousID != "" {
+		m.Store.Delete(s.previousID)
+	}
+	if len(s.values) == 0 {
+		if s.loaded {
+			m.Store.Delete(s.id)
+		}
+		return
+	}
+	m.Store.Save(s.id, maps.Clone(s.values), s.accessed.Add(m.idleTimeout()))
+}
+
+func (m *Manager) cookie(value string) *cookie.Cookie {
+	path := m.Path
+	if path == "" {
+		path = "/"
+	}
+	return &cookie.Cookie{
+		Name:     m.cookieName(),
+		Value:    value,
+		Path:     path,
+		Domain:   m.Domain,
+		Secure:   m.Secure,
+		HttpOnly: true,
+		SameSite: m.SameSite,
+	}
+}
+
+func (m *Manager) cookieName() string {
+	if m.CookieName == "" {
+		return defaultCookieName
+	}
+	return m.CookieName
+}
+
+func (m *Manager) idleTimeout() time.Duration {
+	if m.IdleTimeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return m.IdleTimeout
+}
+
+func (m *Manager) clock() time.Time {
+	if m.now == nil {
+		return time.Now()
+	}
+	return m.now()
+}
+
+// newID returns 256 random bits, enough that IDs can't be guessed.
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
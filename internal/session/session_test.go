@@ -0,0 +1,306 @@
+package session
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/compress"
+	"github.com/derjabineli/httpfromtcp/internal/cookie"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	key    = []byte("0123456789abcdef0123456789abcdef")
+	newKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+// serve sends a request with the session cookie value, if any, and returns
+// the response and the new session cookie, nil when none was set.
+func serve(t *testing.T, m *Manager, value string) (*response.Response, *cookie.Cookie) {
+	b := request.NewBuilder("GET", "/")
+	if value != "" {
+		b.Cookie(&cookie.Cookie{Name: m.cookieName(), Value: value})
+	}
+	req, err := b.Build()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	m.Serve(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.ResponseFromReader(buf, req)
+	require.NoError(t, err)
+
+	var set *cookie.Cookie
+	for _, line := range resp.Headers.Values("Set-Cookie") {
+		name, rest, _ := strings.Cut(line, "=")
+		value, attributes, _ := strings.Cut(rest, ";")
+		set = &cookie.Cookie{Name: name, Value: value}
+		if strings.Contains(attributes, "Max-Age=0") {
+			set.MaxAge = -1
+		}
+	}
+	return resp, set
+}
+
+// counter is a handler counting visits in the session.
+func counter(m *Manager) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		s := m.Get(req)
+		visits, _ := s.Get("visits")
+		visits += "x"
+		s.Set("visits", visits)
+		body := []byte(visits)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+}
+
+func newManager(keys ...[]byte) (*Manager, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := New(nil, keys...)
+	m.now = func() time.Time { return now }
+	m.Next = counter(m)
+	return m, &now
+}
+
+func TestManagerCookie(t *testing.T) {
+	m, now := newManager(key)
+
+	// Test: A new session gets a cookie
+	resp, c := serve(t, m, "")
+	assert.Equal(t, "x", string(resp.Body))
+	require.NotNil(t, c)
+	line := resp.Headers["set-cookie"]
+	assert.Contains(t, line, "; Path=/")
+	assert.Contains(t, line, "; HttpOnly")
+	assert.Contains(t, line, "; SameSite=Lax")
+
+	// Test: And keeps its values
+	resp, c = serve(t, m, c.Value)
+	assert.Equal(t, "xx", string(resp.Body))
+	require.NotNil(t, c)
+
+	// Test: A tampered cookie starts over
+	data, mac, _ := strings.Cut(c.Value, ".")
+	resp, _ = serve(t, m, data+"x."+mac)
+	assert.Equal(t, "x", string(resp.Body))
+	resp, _ = serve(t, m, "garbage")
+	assert.Equal(t, "x", string(resp.Body))
+
+	// Test: Idle sessions expire
+	*now = now.Add(31 * time.Minute)
+	resp, _ = serve(t, m, c.Value)
+	assert.Equal(t, "x", string(resp.Body))
+
+	// Test: A cookie isn't accepted under another name
+	other, _ := newManager(key)
+	other.CookieName = "other"
+	resp, _ = serve(t, other, c.Value)
+	assert.Equal(t, "x", string(resp.Body))
+}
+
+func TestManagerEncrypt(t *testing.T) {
+	m, _ := newManager(key)
+	m.Encrypt = true
+	m.Next = func(w *response.Writer, req *request.Request) {
+		s := m.Get(req)
+		if user, ok := s.Get("user"); ok {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(user)))
+			w.WriteBody([]byte(user))
+			return
+		}
+		s.Set("user", "eli")
+	}
+
+	// Test: Values are hidden in the cookie and can be read back
+	_, c := serve(t, m, "")
+	require.NotNil(t, c)
+	data, _, _ := strings.Cut(c.Value, ".")
+	assert.NotContains(t, data, "ZWxp")
+	resp, _ := serve(t, m, c.Value)
+	assert.Equal(t, "eli", string(resp.Body))
+
+	// Test: A signed but unencrypted cookie isn't accepted
+	plain, _ := newManager(key)
+	_, c = serve(t, plain, "")
+	resp, _ = serve(t, m, c.Value)
+	assert.Empty(t, resp.Body)
+}
+
+func TestManagerKeyRotation(t *testing.T) {
+	old, _ := newManager(key)
+	_, c := serve(t, old, "")
+
+	// Test: Old keys still verify, and the cookie moves to the new key
+	m, _ := newManager(newKey, key)
+	m.Next = counter(m)
+	resp, rotated := serve(t, m, c.Value)
+	assert.Equal(t, "xx", string(resp.Body))
+	require.NotNil(t, rotated)
+	resp, _ = serve(t, old, rotated.Value)
+	assert.Equal(t, "x", string(resp.Body))
+
+	// Test: Dropped keys don't
+	m, _ = newManager(newKey)
+	resp, _ = serve(t, m, c.Value)
+	assert.Equal(t, "x", string(resp.Body))
+}
+
+func TestManagerRefresh(t *testing.T) {
+	m, now := newManager(key)
+	m.Next = func(w *response.Writer, req *request.Request) {
+		body := []byte("old")
+		if _, ok := m.Get(req).Get("user"); !ok {
+			m.Get(req).Set("user", "eli")
+			body = []byte("new")
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	_, c := serve(t, m, "")
+	require.NotNil(t, c)
+
+	// Test: Unmodified sessions only get a cookie now and then
+	*now = now.Add(time.Minute)
+	resp, refreshed := serve(t, m, c.Value)
+	assert.Equal(t, "old", string(resp.Body))
+	assert.Nil(t, refreshed)
+	*now = now.Add(4 * time.Minute)
+	_, refreshed = serve(t, m, c.Value)
+	require.NotNil(t, refreshed)
+
+	// Test: Which keeps them alive past the idle timeout of the first cookie
+	*now = now.Add(26 * time.Minute)
+	resp, _ = serve(t, m, refreshed.Value)
+	assert.Equal(t, "old", string(resp.Body))
+	resp, _ = serve(t, m, c.Value)
+	assert.Equal(t, "new", string(resp.Body))
+}
+
+func TestManagerStore(t *testing.T) {
+	m, now := newManager(key)
+	store := NewMemoryStore()
+	store.now = m.now
+	m.Store = store
+	var regenerate bool
+	var ids []string
+	m.Next = func(w *response.Writer, req *request.Request) {
+		s := m.Get(req)
+		if regenerate {
+			s.Regenerate()
+		}
+		ids = append(ids, s.ID())
+		counter(m)(w, req)
+		// Stored sessions also keep changes made after the headers
+		s.Set("late", "yes")
+	}
+
+	// Test: The cookie only carries the ID
+	resp, c := serve(t, m, "")
+	require.NotNil(t, c)
+	assert.Equal(t, 1, store.Len())
+	data, _, _ := strings.Cut(c.Value, ".")
+	assert.NotContains(t, data, "dmlzaXRz")
+	resp, _ = serve(t, m, c.Value)
+	assert.Equal(t, "xx", string(resp.Body))
+	values, ok := store.Load(ids[1])
+	require.True(t, ok)
+	assert.Equal(t, "yes", values["late"])
+
+	// Test: Regenerate keeps the values under a new ID
+	regenerate = true
+	resp, regenerated := serve(t, m, c.Value)
+	regenerate = false
+	assert.Equal(t, "xxx", string(resp.Body))
+	require.NotNil(t, regenerated)
+	assert.NotEqual(t, ids[1], ids[2])
+	assert.Equal(t, 1, store.Len())
+	resp, _ = serve(t, m, c.Value)
+	assert.Equal(t, "x", string(resp.Body))
+	resp, _ = serve(t, m, regenerated.Value)
+	assert.Equal(t, "xxxx", string(resp.Body))
+
+	// Test: Destroy deletes the session and the cookie, which no longer
+	// works
+	m.Next = func(w *response.Writer, req *request.Request) {
+		m.Get(req).Destroy()
+	}
+	_, deleted := serve(t, m, regenerated.Value)
+	require.NotNil(t, deleted)
+	assert.Equal(t, -1, deleted.MaxAge)
+	_, ok = store.Load(ids[len(ids)-1])
+	assert.False(t, ok)
+	m.Next = counter(m)
+	resp, _ = serve(t, m, regenerated.Value)
+	assert.Equal(t, "x", string(resp.Body))
+
+	// Test: Expired sessions are gone from the store
+	_, c = serve(t, m, "")
+	assert.Equal(t, 3, store.Len())
+	*now = now.Add(31 * time.Minute)
+	resp, _ = serve(t, m, c.Value)
+	assert.Equal(t, "x", string(resp.Body))
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestManagerWithoutKeys(t *testing.T) {
+	m := New(func(w *response.Writer, req *request.Request) {})
+	resp, _ := serve(t, m, "")
+	assert.Equal(t, response.StatusInternalServerError, resp.StatusLine.StatusCode)
+
+	req, err := request.NewBuilder("GET", "/").Build()
+	require.NoError(t, err)
+	assert.Nil(t, m.Get(req))
+}
+
+func TestManagerOverCompress(t *testing.T) {
+	// Test: The session cookie survives the compression, compressed or not
+	page := strings.Repeat("<p>hello, world</p>\n", 100)
+	var m *Manager
+	m = New(compress.New(func(w *response.Writer, req *request.Request) {
+		m.Get(req).Set("user", "eli")
+		body := page
+		if req.RequestLine.RequestTarget == "/small" {
+			body = "hi"
+		}
+		h := response.GetDefaultHeaders(len(body))
+		h.Overwrite("Content-Type", "text/html")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}).Serve, key)
+	for _, target := range []string{"/", "/small"} {
+		req, err := request.NewBuilder("GET", target).Header("Accept-Encoding", "gzip").Build()
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		w.SetRequest(req)
+		m.Serve(w, req)
+		require.NoError(t, w.Finish())
+		resp, err := response.ResponseFromReader(buf, req)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp.Headers["set-cookie"], "session="), target)
+		if target == "/small" {
+			assert.Equal(t, "hi", string(resp.Body))
+			continue
+		}
+		assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+		r, err := gzip.NewReader(bytes.NewReader(resp.Body))
+		require.NoError(t, err)
+		body, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, page, string(body))
+	}
+}
@@ -0,0 +1,84 @@
+package session
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Store keeps session values on the server, keyed by session ID.
+type Store interface {
+	// Load returns the values of a session, or false when there is no such
+	// session or it has expired.
+	Load(id string) (map[string]string, bool)
+	// Save stores the values of a session until expires.
+	Save(id string, values map[string]string, expires time.Time)
+	Delete(id string)
+}
+
+// sweepInterval is how often MemoryStore looks for expired sessions.
+const sweepInterval = time.Minute
+
+// MemoryStore is a Store in the memory of the process, so sessions don't
+// survive a restart. Expired sessions are removed as they are found.
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: map[string]memorySession{},
+		now:      time.Now,
+	}
+}
+
+func (s *MemoryStore) Load(id string) (map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if !s.now().Before(session.expires) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return maps.Clone(session.values), true
+}
+
+func (s *MemoryStore) Save(id string, values map[string]string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for id, session := range s.sessions {
+			if !now.Before(session.expires) {
+				delete(s.sessions, id)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.sessions[id] = memorySession{values: maps.Clone(values), expires: expires}
+}
+
+func (s *MemoryStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// Len returns the number of sessions held, expired ones included until they
+// are swept.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
@@ -0,0 +1,212 @@
+package sse
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+const (
+	defaultBufferSize = 16
+	defaultHistory    = 100
+	defaultHeartbeat  = 15 * time.Second
+)
+
+// Hub fans out published events to every subscribed connection. Each
+// subscriber has a bounded buffer, and one that falls further behind is
+// dropped rather than holding up the others: its stream ends and the client
+// reconnects, catching up on what it missed through Last-Event-ID. The
+// recent events kept for that are in History.
+type Hub struct {
+	// BufferSize is how many events a subscriber can fall behind, 16 when
+	// zero
+	BufferSize int
+	// History is how many past events are kept for clients that resume, 100
+	// when zero
+	History int
+	// Heartbeat is the interval of the heartbeat comments Serve sends on a
+	// quiet stream, 15 seconds when zero
+	Heartbeat time.Duration
+	// Retry, when set, is sent to new streams as the reconnection delay
+	Retry time.Duration
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	history     []Event
+	lastID      uint64
+	closed      bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[*Subscription]struct{}{}}
+}
+
+// Subscription receives the events published on a Hub.
+type Subscription struct {
+	hub    *Hub
+	events chan Event
+}
+
+// Events returns the events of the subscription. The channel is closed when
+// the subscriber fell behind, the subscription was closed or the hub was.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close unsubscribes.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Publish sends e to all subscribers. An event without an ID is given the
+// next number in sequence, so clients can resume after it.
+func (h *Hub) Publish(e Event) error {
+	if err := e.Valid(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	if e.ID == "" {
+		h.lastID++
+		e.ID = strconv.FormatUint(h.lastID, 10)
+	}
+	h.history = append(h.history, e)
+	if n := len(h.history) - h.historySize(); n > 0 {
+		h.history = h.history[n:]
+	}
+	for s := range h.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			h.remove(s)
+		}
+	}
+	return nil
+}
+
+// Subscribe adds a subscriber. When lastEventID is the ID of an event still
+// in the history, the events after it are delivered first.
+func (h *Hub) Subscribe(lastEventID string) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var missed []Event
+	if lastEventID != "" {
+		for i, e := range h.history {
+			if e.ID == lastEventID {
+				missed = h.history[i+1:]
+				break
+			}
+		}
+	}
+
+	s := &Subscription{
+		hub:    h,
+		events: make(chan Event, h.bufferSize()+len(missed)),
+	}
+	for _, e := range missed {
+		s.events <- e
+	}
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	if h.subscribers == nil {
+		h.subscribers = map[*Subscription]struct{}{}
+	}
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+// Len returns the number of subscribers.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// Close ends all subscriptions, and with them the streams of Serve.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		h.remove(s)
+	}
+}
+
+// remove ends a subscription. h.mu must be held.
+func (h *Hub) remove(s *Subscription) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// Serve streams the events of the hub to the client until it goes away,
+// resuming after the Last-Event-ID it sends on reconnecting.
+func (h *Hub) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		response.WriteError(w, response.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	heartbeat := h.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeat
+	}
+	stream, err := NewWriter(w, req, heartbeat)
+	if err != nil {
+		log.Printf("Couldn't start event stream: %v", err)
+		return
+	}
+	defer stream.Close()
+	if method == "HEAD" {
+		return
+	}
+	if h.Retry > 0 {
+		if err := stream.Send(Event{Retry: h.Retry}); err != nil {
+			return
+		}
+	}
+
+	sub := h.Subscribe(stream.LastEventID())
+	defer sub.Close()
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			if err := stream.Send(e); err != nil {
+				return
+			}
+		case <-stream.Done():
+			return
+		}
+	}
+}
+
+func (h *Hub) bufferSize() int {
+	if h.BufferSize <= 0 {
+		return defaultBufferSize
+	}
+	return h.BufferSize
+}
+
+func (h *Hub) historySize() int {
+	if h.History <= 0 {
+		return defaultHistory
+	}
+	return h.History
+}
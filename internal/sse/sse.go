@@ -0,0 +1,246 @@
+// Package sse streams Server-Sent Events, the text/event-stream format of
+// the HTML Living Standard (section 9.2), on chunked responses.
+package sse
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/headers"
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+)
+
+var (
+	ErrInvalidField = errors.New("event field contains a line break")
+	ErrClientGone   = errors.New("client closed the event stream")
+	ErrClosed       = errors.New("event stream is closed")
+)
+
+// Event is one message of an event stream.
+type Event struct {
+	// ID is remembered by the client and sent back in the Last-Event-ID
+	// header when it reconnects
+	ID string
+	// Event is the event type, "message" for the client when empty
+	Event string
+	// Data may span several lines. An event without Data only updates the
+	// ID and Retry of the client and doesn't reach its listeners.
+	Data string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+// Valid checks that the fields that have to fit on one line do.
+func (e Event) Valid() error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+	return nil
+}
+
+// appendEvent appends the wire form of e to b: one line per field, a data
+// line for every line of Data and a blank line to dispatch the event.
+func appendEvent(b []byte, e Event) []byte {
+	if e.ID != "" {
+		b = appendField(b, "id", e.ID)
+	}
+	if e.Event != "" {
+		b = appendField(b, "event", e.Event)
+	}
+	if e.Retry > 0 {
+		b = appendField(b, "retry", strconv.FormatInt(e.Retry.Milliseconds(), 10))
+	}
+	if e.Data != "" {
+		for _, line := range splitLines(e.Data) {
+			b = appendField(b, "data", line)
+		}
+	}
+	return append(b, '\n')
+}
+
+func appendField(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, ": "...)
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// splitLines splits s at CRLF, CR and LF, all of which end a line in an
+// event stream.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
+
+// Writer sends events on a response, flushing each one, and keeps idle
+// connections open with heartbeat comments. It is safe for concurrent use.
+type Writer struct {
+	mu          sync.Mutex
+	w           *response.Writer
+	lastEventID string
+	err         error
+	// sent means something was written since the last heartbeat tick
+	sent bool
+
+	// done is closed once the stream has ended for any reason
+	done chan struct{}
+	// stopped is closed when the heartbeat goroutine has returned
+	stopped chan struct{}
+}
+
+// NewWriter starts an event stream on w, writing the status line and
+// headers right away so that the client knows the stream is open. Fields
+// already set on w.Header() are sent along. A heartbeat comment is sent
+// whenever the stream has been quiet for heartbeat, which keeps proxies
+// from timing out the connection and finds out when the client has gone.
+// Zero turns heartbeats off.
+//
+// Close must be called before the handler returns.
+func NewWriter(w *response.Writer, req *request.Request, heartbeat time.Duration) (*Writer, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	// no-transform keeps the compression middleware from holding events
+	// back in its buffer
+	h.Set("Cache-Control", "no-cache, no-transform")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s := &Writer{
+		w:       w,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.lastEventID, _ = req.Headers.Get("Last-Event-ID")
+	go s.run(heartbeat, w.CloseNotify())
+	return s, nil
+}
+
+// LastEventID is the ID of the last event the client received before it
+// reconnected, empty for a new client.
+func (s *Writer) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the stream has ended, because the client went away,
+// a write failed or Close was called.
+func (s *Writer) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream ended, or nil while it is open.
+func (s *Writer) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Send writes e and flushes it to the client.
+func (s *Writer) Send(e Event) error {
+	if err := e.Valid(); err != nil {
+		return err
+	}
+	return s.write(appendEvent(nil, e))
+}
+
+// Comment writes a comment, which the client ignores.
+func (s *Writer) Comment(text string) error {
+	return s.write(appendComment(nil, text))
+}
+
+func appendComment(b []byte, text string) []byte {
+	for _, line := range splitLines(text) {
+		b = append(b, ": "...)
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// Close ends the stream and stops the heartbeats. The response itself is
+// completed by the server once the handler returns.
+func (s *Writer) Close() error {
+	s.end(ErrClosed)
+	<-s.stopped
+	return nil
+}
+
+func (s *Writer) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = true
+	return s.writeLocked(b)
+}
+
+// heartbeat writes a comment unless something else was sent since the
+// last one.
+func (s *Writer) heartbeat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil && !s.sent {
+		s.writeLocked(appendComment(nil, "heartbeat"))
+	}
+	s.sent = false
+}
+
+// writeLocked writes b and flushes it. s.mu must be held.
+func (s *Writer) writeLocked(b []byte) error {
+	_, err := s.w.WriteBody(b)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// run sends the heartbeats and watches for the client going away.
+func (s *Writer) run(heartbeat time.Duration, clientGone <-chan struct{}) {
+	defer close(s.stopped)
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			s.heartbeat()
+		case <-clientGone:
+			s.end(ErrClientGone)
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Writer) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail(err)
+}
+
+// fail records the first error and ends the stream. s.mu must be held.
+func (s *Writer) fail(err error) {
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+	}
+}
@@ -0,0 +1,205 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derjabineli/httpfromtcp/internal/request"
+	"github.com/derjabineli/httpfromtcp/internal/response"
+	"github.com/derjabineli/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendEvent(t *testing.T) {
+	// Test: Every field on its own line, then a blank line
+	e := Event{ID: "7", Event: "build", Data: "passed", Retry: 3 * time.Second}
+	assert.Equal(t, "id: 7\nevent: build\nretry: 3000\ndata: passed\n\n", string(appendEvent(nil, e)))
+
+	// Test: Data is split at every kind of line break
+	e = Event{Data: "one\ntwo\r\nthree\rfour\n"}
+	assert.Equal(t, "data: one\ndata: two\ndata: three\ndata: four\ndata: \n\n", string(appendEvent(nil, e)))
+
+	// Test: Only what is set
+	assert.Equal(t, "id: 8\n\n", string(appendEvent(nil, Event{ID: "8"})))
+
+	// Test: Fields that can't be split
+	assert.ErrorIs(t, Event{ID: "1\n2"}.Valid(), ErrInvalidField)
+	assert.ErrorIs(t, Event{ID: "1\x00"}.Valid(), ErrInvalidField)
+	assert.ErrorIs(t, Event{Event: "a\rb"}.Valid(), ErrInvalidField)
+	assert.NoError(t, Event{Data: "a\rb"}.Valid())
+}
+
+// syncBuffer is a bytes.Buffer the heartbeat goroutine can write to while
+// the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWriter(t *testing.T) {
+	req, err := request.NewBuilder("GET", "/events").Header("Last-Event-ID", "41").Build()
+	require.NoError(t, err)
+	buf := &syncBuffer{}
+	w := response.NewWriter(buf)
+	w.SetRequest(req)
+	w.Header().Set("X-Stream", "builds")
+	s, err := NewWriter(w, req, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	// Test: The headers are sent right away
+	out := buf.String()
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, out, "content-type: text/event-stream\r\n")
+	assert.Contains(t, out, "cache-control: no-cache, no-transform\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, out, "x-stream: builds\r\n")
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: Every event is flushed in a chunk of its own
+	require.NoError(t, s.Send(Event{ID: "42", Data: "a\nb"}))
+	assert.Contains(t, buf.String(), "\r\n18\r\nid: 42\ndata: a\ndata: b\n\n\r\n")
+	assert.ErrorIs(t, s.Send(Event{Event: "x\ny"}), ErrInvalidField)
+
+	// Test: Heartbeats on a quiet stream
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), ": heartbeat\n")
+	}, time.Second, 5*time.Millisecond)
+
+	// Test: Closed
+	require.NoError(t, s.Close())
+	<-s.Done()
+	assert.ErrorIs(t, s.Err(), ErrClosed)
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n0\r\n\r\n"))
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	h.BufferSize = 2
+	h.History = 3
+
+	// Test: Every subscriber gets every event, numbered
+	a := h.Subscribe("")
+	b := h.Subscribe("")
+	require.NoError(t, h.Publish(Event{Data: "one"}))
+	assert.Equal(t, Event{ID: "1", Data: "one"}, <-a.Events())
+	assert.Equal(t, Event{ID: "1", Data: "one"}, <-b.Events())
+	assert.ErrorIs(t, h.Publish(Event{ID: "\n"}), ErrInvalidField)
+
+	// Test: A subscriber that falls behind is dropped, the others aren't held up
+	for i := 2; i <= 4; i++ {
+		require.NoError(t, h.Publish(Event{Data: strconv.Itoa(i)}))
+		<-a.Events()
+	}
+	assert.Equal(t, 1, h.Len())
+	var ids []string
+	for e := range b.Events() {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []string{"2", "3"}, ids)
+
+	// Test: Resuming replays the history after the last event seen
+	c := h.Subscribe("2")
+	assert.Equal(t, "3", (<-c.Events()).ID)
+	assert.Equal(t, "4", (<-c.Events()).ID)
+	c.Close()
+	_, ok := <-c.Events()
+	assert.False(t, ok)
+	c = h.Subscribe("1")
+	assert.Empty(t, c.Events())
+
+	// Test: Closing ends all subscriptions
+	h.Close()
+	_, ok = <-a.Events()
+	assert.False(t, ok)
+	_, ok = <-c.Events()
+	assert.False(t, ok)
+	assert.ErrorIs(t, h.Publish(Event{Data: "late"}), ErrClosed)
+}
+
+func TestHubServe(t *testing.T) {
+	h := NewHub()
+	h.Retry = 2 * time.Second
+	s, err := server.Serve(0, h.Serve)
+	require.NoError(t, err)
+	defer s.Close()
+
+	connect := func(lastEventID string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		req := "GET /events HTTP/1.1\r\nHost: localhost\r\n"
+		if lastEventID != "" {
+			req += "Last-Event-ID: " + lastEventID + "\r\n"
+		}
+		_, err = io.WriteString(conn, req+"\r\n")
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	// readEvent skips the chunk framing and returns the next event
+	readEvent := func(r *bufio.Reader) string {
+		var event strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			if strings.HasSuffix(line, "\r\n") {
+				continue
+			}
+			if line == "\n" {
+				return event.String()
+			}
+			event.WriteString(line)
+		}
+	}
+
+	// Test: Events reach the client as they are published
+	conn, r := connect("")
+	assert.Equal(t, "retry: 2000\n", readEvent(r))
+	assert.Eventually(t, func() bool { return h.Len() == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, h.Publish(Event{Event: "build", Data: "started"}))
+	require.NoError(t, h.Publish(Event{Event: "build", Data: "passed"}))
+	assert.Equal(t, "id: 1\nevent: build\ndata: started\n", readEvent(r))
+	assert.Equal(t, "id: 2\nevent: build\ndata: passed\n", readEvent(r))
+
+	// Test: The subscription ends with the connection
+	conn.Close()
+	assert.Eventually(t, func() bool { return h.Len() == 0 }, 2*time.Second, time.Millisecond)
+
+	// Test: A reconnecting client resumes after its last event
+	require.NoError(t, h.Publish(Event{Data: "missed"}))
+	conn, r = connect("2")
+	defer conn.Close()
+	readEvent(r)
+	assert.Equal(t, "id: 3\ndata: missed\n", readEvent(r))
+
+	// Test: Only GET and HEAD
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /events HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n", line)
+}